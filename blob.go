@@ -16,6 +16,12 @@ type Blob struct {
 	Size    int64
 	ModTime time.Time
 
+	// status change time, inode and change attribute of the file at the time it was indexed.
+	// each of them is zero if the platform does not provide it.
+	ChangeTime time.Time
+	Inode      uint64
+	ChangeAttr uint64
+
 	HashAlgorithm crypto.Hash
 
 	// hash of the full blob
@@ -33,6 +39,34 @@ func (b *Blob) HasChanged(size int64, mtime time.Time) bool {
 		b.ModTime.UTC() != mtime.UTC()
 }
 
+// HasChangedStamp reports whether a file has changed since this blob has been indexed.
+// Only size and modification time are compared unless paranoid is set, in which case
+// the status change time, inode and change attribute must be unchanged as well.
+// Paranoid comparison detects content changes by tools which preserve the modification
+// time (rsync -t, cp -p, touch -r), at the cost of also reporting metadata-only changes.
+func (b *Blob) HasChangedStamp(s FileStamp, paranoid bool) bool {
+	if b.HasChanged(s.Size, s.ModTime) {
+		return true
+	}
+	if !paranoid {
+		return false
+	}
+	return !b.ChangeTime.Equal(s.ChangeTime) ||
+		b.Inode != s.Inode ||
+		b.ChangeAttr != s.ChangeAttr
+}
+
+// HasMergedBlocks reports whether the number of hashed blocks does not match the size.
+// Earlier versions of Hasher merged the hashes of the blocks of a write which spanned more
+// than one block. Blobs which have been hashed by them must be hashed again.
+func (b *Blob) HasMergedBlocks() bool {
+	if b.Size == 0 || b.HashBlockSize <= 0 {
+		return false
+	}
+	blockSize := int64(b.HashBlockSize)
+	return int64(len(b.HashedBlocks)) != (b.Size+blockSize-1)/blockSize
+}
+
 var (
 	blobErrNil        = errors.New("invalid nil block")
 	blobErrEmptyName  = errors.New("invalid empty name")
@@ -81,6 +81,56 @@ func TestBlobHasChanged(t *testing.T) {
 	}
 }
 
+func TestBlobHasChangedStamp(t *testing.T) {
+	now := time.Now()
+	blob := Blob{Size: 1, ModTime: now, ChangeTime: now, Inode: 2}
+	stamp := FileStamp{Size: 1, ModTime: now, ChangeTime: now, Inode: 2}
+
+	if blob.HasChangedStamp(stamp, true) {
+		t.Error("equal stamp reports changed")
+	}
+
+	stamp.ChangeTime = now.Add(time.Second)
+	if blob.HasChangedStamp(stamp, false) {
+		t.Error("ctime change reports changed without paranoid checks")
+	}
+	if !blob.HasChangedStamp(stamp, true) {
+		t.Error("ctime change does not report changed")
+	}
+
+	stamp.ChangeTime = now
+	stamp.Inode = 3
+	if !blob.HasChangedStamp(stamp, true) {
+		t.Error("inode change does not report changed")
+	}
+
+	stamp.Inode = 2
+	stamp.Size = 2
+	if !blob.HasChangedStamp(stamp, false) {
+		t.Error("size change does not report changed")
+	}
+}
+
+func TestBlobHasMergedBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		size, blockSize, blocks int
+		merged                  bool
+	}{
+		{0, 16, 0, false},
+		{1, 16, 1, false},
+		{16, 16, 1, false},
+		{17, 16, 2, false},
+		{256, 16, 16, false},
+		{256, 16, 15, true},
+		{256, 16, 1, true},
+	} {
+		blob := Blob{Size: int64(tc.size), HashBlockSize: tc.blockSize, HashedBlocks: make([][]byte, tc.blocks)}
+		if got := blob.HasMergedBlocks(); got != tc.merged {
+			t.Errorf("%d bytes in %d blocks of %d - want %v; got %v", tc.size, tc.blocks, tc.blockSize, tc.merged, got)
+		}
+	}
+}
+
 func TestBlobCheckOptimisticLock(t *testing.T) {
 	var a, b Blob
 	a.Version = 0
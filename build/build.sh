@@ -8,7 +8,7 @@ cd "$base"
 
 root_package="github.com/phicode/blkidx"
 cmd_packages="blkidx"
-dependencies="github.com/mattn/go-sqlite3"
+dependencies="github.com/mattn/go-sqlite3 google.golang.org/grpc google.golang.org/genproto/googleapis/rpc/errdetails go.etcd.io/bbolt github.com/lib/pq"
 
 go_get_flags="-v"
 install_flags=""
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	. "github.com/phicode/blkidx"
+)
+
+var flagPartial = flag.Bool("partial", false, "find-copies: also list files which share some hashed blocks")
+
+// findCopies hashes the given files, which need not be indexed, and lists all
+// indexed files with the same content.
+func findCopies(ctx context.Context, idx Index, t *targets) error {
+	if !t.explicit {
+		return errors.New("find-copies: no files given")
+	}
+	if err := t.requireOnline(); err != nil {
+		return err
+	}
+	config := IndexConfig{HashAlgorithm: DefaultHashAlgorithm, BlockSizes: DefaultHashBlockSize}
+
+	var failed, group int
+	for pe := range walkFiles(ctx, t.paths) {
+		if pe.Err != nil {
+			fmt.Fprintln(os.Stderr, pe.Err)
+			failed++
+			continue
+		}
+		blob, err := IndexFile(ctx, pe.Path, config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+			continue
+		}
+		// an indexed file is not a copy of itself
+		blob.Name = volumes.Name(pe.Path)
+		copies, err := FindCopies(ctx, idx, blob, *flagPartial)
+		if err != nil {
+			return err
+		}
+		group++
+		printCopies(blob, pe.Path, copies, group)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("find-copies failed for %d files", failed)
+	}
+	return nil
+}
+
+// printCopies prints the hashed file and its copies, which form a group in machine readable output.
+func printCopies(blob *Blob, path string, copies []Copy, group int) {
+	r := blobRecord(blob)
+	r.Path, r.Group, r.Status = path, group, "source"
+	out.emit(r, fmt.Sprintf("%s: %d copies", path, len(copies)))
+	for _, c := range copies {
+		r := blobRecord(c.Blob)
+		r.Group, r.Status = group, "copy"
+		text := "  " + displayName(c.Name)
+		if !c.Full {
+			r.Status = "partial"
+			r.Detail = fmt.Sprintf("%d of %d blocks", c.SharedBlocks, len(c.HashedBlocks))
+			text += " (" + r.Detail + ")"
+		}
+		out.emit(r, text)
+	}
+}
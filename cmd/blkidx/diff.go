@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/phicode/blkidx/fs"
+
+	. "github.com/phicode/blkidx"
+)
+
+var (
+	flagIndexA = flag.String("index-a", "", "diff: database of the first path, defaults to -db")
+	flagIndexB = flag.String("index-b", "", "diff: database of the second path, defaults to -db")
+)
+
+// diff compares the indexed files below pathA and pathB by their stored hashes.
+// an error is returned if any file is changed, incomparable or only on one side.
+func diff(ctx context.Context, idx Index, pathA, pathB string) error {
+	idxA, rootA, closeA, err := openDiffSide(ctx, idx, *flagIndexA, pathA)
+	if err != nil {
+		return err
+	}
+	defer closeA()
+	idxB, rootB, closeB, err := openDiffSide(ctx, idx, *flagIndexB, pathB)
+	if err != nil {
+		return err
+	}
+	defer closeB()
+
+	r, err := Diff(ctx, idxA, rootA, idxB, rootB)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.Both {
+		if p.A == p.B {
+			out.emit(&record{Name: p.A, Status: "both"}, "= "+p.A)
+		} else {
+			out.emit(&record{Name: p.A, Status: "both", Detail: p.B}, "= "+p.A+" -> "+p.B)
+		}
+	}
+	for _, rel := range r.Changed {
+		out.emit(&record{Name: rel, Status: "changed"}, "~ "+rel)
+	}
+	for _, rel := range r.Incomparable {
+		out.emit(&record{Name: rel, Status: "incomparable"}, "? "+rel)
+	}
+	for _, rel := range r.OnlyA {
+		out.emit(&record{Name: rel, Status: "only-a"}, "- "+rel)
+	}
+	for _, rel := range r.OnlyB {
+		out.emit(&record{Name: rel, Status: "only-b"}, "+ "+rel)
+	}
+	out.summary()
+	out.summary(fmt.Sprintf("in both: %d, changed: %d, incomparable: %d, only in %s: %d, only in %s: %d", //
+		len(r.Both), len(r.Changed), len(r.Incomparable), rootA, len(r.OnlyA), rootB, len(r.OnlyB)))
+	if n := r.Differences(); n > 0 {
+		return fmt.Errorf("%s and %s differ in %d files", rootA, rootB, n)
+	}
+	return nil
+}
+
+// openDiffSide opens the index of one side of a diff, which is idx unless dbUrl is set,
+// and returns the blob name of path in that index.
+func openDiffSide(ctx context.Context, idx Index, dbUrl, path string) (Index, string, func(), error) {
+	closer := func() {}
+	if dbUrl != "" {
+		var c io.Closer
+		var err error
+		if idx, c, err = openDbIndex(ctx, dbUrl); err != nil {
+			return nil, "", nil, fmt.Errorf("failed to open the %s database %q: %v", *flagDbDriver, dbUrl, err)
+		}
+		closer = func() { c.Close() }
+	}
+	if strings.HasPrefix(path, VolumeNamePrefix) {
+		return idx, strings.TrimRight(path, "/"), closer, nil
+	}
+	abs, err := fs.CleanAbsolute(path)
+	if err != nil {
+		closer()
+		return nil, "", nil, err
+	}
+	vols, err := LoadVolumes(ctx, idx)
+	if err != nil {
+		closer()
+		return nil, "", nil, fmt.Errorf("failed to load volumes: %v", err)
+	}
+	return idx, vols.Name(abs), closer, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/phicode/blkidx"
+)
+
+var (
+	flagDirs          = flag.Bool("dirs", false, "dups, rm-dups: find duplicated directories instead of files")
+	flagMinSimilarity = flag.Float64("min-similarity", 0.9,
+		"dups -dirs: list directories which share at least this fraction of their content, 0 for identical directories only")
+)
+
+// dirDups shows all groups of identical directories and all pairs of similar directories
+// of which at least one is located below the targets. rm-dups deletes identical directories only.
+func dirDups(ctx context.Context, idx Index, t *targets, rm bool) error {
+	if *flagMinSimilarity < 0 || *flagMinSimilarity > 1 {
+		return fmt.Errorf("invalid similarity %v, must be between 0 and 1", *flagMinSimilarity)
+	}
+	minSimilarity := *flagMinSimilarity
+	if rm {
+		minSimilarity = 0
+	}
+	dd, err := FindDuplicateDirs(ctx, idx, minSimilarity)
+	if err != nil {
+		return fmt.Errorf("find duplicate directories failed: %v", err)
+	}
+	var groups []DirGroup
+	for _, g := range dd.Identical {
+		if *flagAll || t.containsAny(g.Dirs) {
+			groups = append(groups, g)
+		}
+	}
+	var similar []SimilarDirs
+	for _, s := range dd.Similar {
+		if *flagAll || t.containsAny(Names{s.A, s.B}) {
+			similar = append(similar, s)
+		}
+	}
+	if len(groups) == 0 && len(similar) == 0 {
+		out.println("no duplicate directories found")
+		return nil
+	}
+
+	var savings int64
+	separator := strings.Repeat("-", 80)
+	for group, g := range groups {
+		out.println(separator)
+		out.println(fmt.Sprintf("identical: %d files, %s", g.Files, formatSize(g.Size)))
+		for i, dir := range g.Dirs {
+			out.emit(dirRecord(dir, g.Size, group+1, "identical"), fmt.Sprintf("%d - %s", i+1, displayName(dir)))
+		}
+
+		if rm {
+			n, err := askRemoveDirs(ctx, idx, g)
+			savings += g.Size * int64(n)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "removed", formatSize(savings))
+				return err
+			}
+		} else {
+			savings += g.Size * int64(len(g.Dirs)-1)
+		}
+	}
+	for i, s := range similar {
+		group := len(groups) + i + 1
+		percent := fmt.Sprintf("%.1f%%", 100*s.Similarity)
+		out.println(separator)
+		out.println(fmt.Sprintf("similar: %s, %s in common", percent, formatSize(s.Common)))
+		a, b := dirRecord(s.A, s.SizeA, group, "similar"), dirRecord(s.B, s.SizeB, group, "similar")
+		a.Detail, b.Detail = percent, percent
+		out.emit(a, fmt.Sprintf("1 - %s (%s)", displayName(s.A), formatSize(s.SizeA)))
+		out.emit(b, fmt.Sprintf("2 - %s (%s)", displayName(s.B), formatSize(s.SizeB)))
+	}
+	out.summary()
+	if rm {
+		out.summary("removed", formatSize(savings))
+	} else {
+		out.summary("removing all identical directories would save", formatSize(savings))
+	}
+	return nil
+}
+
+func dirRecord(dir string, size int64, group int, status string) *record {
+	r := &record{Name: dir, Size: &size, Group: group, Status: status}
+	r.Path, _ = volumes.Path(dir)
+	return r
+}
+
+// askRemoveDirs asks which directories of the group to delete. the files of each directory are
+// confirmed to be copies of the files of the kept directory, then they are deleted together with
+// all directories which are empty afterwards.
+func askRemoveDirs(ctx context.Context, idx Index, g DirGroup) (int, error) {
+	keep, remove, err := askSelection("directory", g.Dirs)
+	if err != nil || len(remove) == 0 {
+		return 0, err
+	}
+
+	var removed int
+	for _, dir := range remove {
+		confirmed, names, err := ConfirmDirDuplicates(ctx, idx, volumes, keep, dir)
+		if err != nil {
+			return removed, fmt.Errorf("duplicate confirmation failed: %v", err)
+		}
+		if !confirmed.OK() {
+			printUnconfirmed(confirmed, keep)
+			fmt.Println("not deleted:", displayName(dir))
+			continue
+		}
+		path, _ := volumes.Path(dir)
+		fmt.Println("deleting", path)
+		for _, name := range names {
+			file, _ := volumes.Path(name)
+			if err := os.Remove(file); err != nil {
+				return removed, err
+			}
+			if err := idx.Remove(ctx, Names{name}); err != nil {
+				return removed, fmt.Errorf("file removed but still in index due do: %v", err)
+			}
+		}
+		if err := removeEmptyDirs(path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// removeEmptyDirs removes root and all directories below it, which must be empty
+// once their subdirectories have been removed.
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// children before their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
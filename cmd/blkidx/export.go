@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/phicode/blkidx"
+)
+
+var (
+	flagExportFormat = flag.String("export-format", "jsonl", "export: jsonl or binary")
+	flagOnConflict   = flag.String("on-conflict", "skip",
+		"import: which blob is kept if it differs from an existing one: skip, replace or newer")
+)
+
+// exportIndex writes the index to the named file, or to stdout if name is "-".
+func exportIndex(ctx context.Context, idx Index, name string) (err error) {
+	var out io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+	var w RecordWriter
+	switch *flagExportFormat {
+	case "jsonl":
+		w = NewJSONLWriter(out)
+	case "binary":
+		if w, err = NewBinaryWriter(out); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid export format %q", *flagExportFormat)
+	}
+	n, err := Export(ctx, idx, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "files exported:", n)
+	return nil
+}
+
+// importIndex merges an export in any format from the named file, or from stdin if name is "-".
+func importIndex(ctx context.Context, idx Index, name string) error {
+	policy, err := ParseImportPolicy(*flagOnConflict)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	r, err := NewRecordReader(in)
+	if err != nil {
+		return err
+	}
+	result, err := Import(ctx, idx, r, policy)
+	for _, c := range result.Conflicts {
+		kind, resolution := "file", "kept existing"
+		r := &record{Name: c.Name, Status: "kept", Detail: kind}
+		if c.Volume {
+			kind, r.Detail = "volume", "volume"
+		}
+		if c.Replaced {
+			resolution, r.Status = "replaced", "replaced"
+		}
+		out.emit(r, fmt.Sprintf("conflict: %s %s: %s", kind, c.Name, resolution))
+	}
+	out.summary()
+	out.summary(fmt.Sprintf("added: %d, unchanged: %d, replaced: %d, skipped: %d, volumes added: %d", //
+		result.Added, result.Unchanged, result.Replaced, result.Skipped, result.Volumes))
+	return err
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/phicode/blkidx/remote"
+	"google.golang.org/grpc"
+
+	. "github.com/phicode/blkidx"
+)
+
+// indexServer serves the index over grpc until the context is done.
+// calls which are in progress are completed before it returns.
+func indexServer(ctx context.Context, idx Index) error {
+	l, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	remote.Register(s, idx)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	logger.Info("serving the index", "address", l.Addr().String())
+	return s.Serve(l)
+}
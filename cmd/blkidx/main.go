@@ -2,35 +2,58 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"os/user"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/phicode/blkidx/fs"
+	"github.com/phicode/blkidx/remote"
 
 	. "github.com/phicode/blkidx"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
 	flagDb          *string
+	flagDbDriver    = flag.String("db-driver", "sqlite3", "index backend of -db: sqlite3 (a database file), bolt (a bbolt database file, needs no cgo), wal (a directory with a snapshot and a write-ahead log) or postgres (a connection url like postgres://user@host/db)")
 	flagConcurrency = flag.Int("c", 1, "concurrency")
-	logger          = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	flagWalkers     = flag.Int("w", fs.DefaultWalkConcurrency, "concurrent directory readers")
+	flagRetries     = flag.Int("retries", 2, "how often files which change while being hashed are hashed again")
+	flagRetryDelay  = flag.Duration("retry-delay", time.Second, "delay before hashing a changed file again")
+	flagParanoid    = flag.Bool("paranoid", false, "also re-index files whose ctime, inode or change attribute changed")
+	flagAll         = flag.Bool("all", false, "dups, rm-dups: consider all duplicates in the index regardless of the given paths")
+	flagLogFormat   = flag.String("log-format", "text", "log format: text or json")
+	flagLogLevel    = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	flagRemote      = flag.String("remote", "", "use the index of an index-server at host:port instead of -db")
+	logger          *slog.Logger
+
+	// the volumes of the index, used to map file system paths to blob names and back
+	volumes *VolumeSet
 )
 
+// the names of the default -db in the home directory by -db-driver
+var defaultDbNames = map[string]string{
+	"sqlite3":  ".blkidx.sqlite3",
+	"bolt":     ".blkidx.bolt",
+	"wal":      ".blkidx.wal",
+	"postgres": "", // no default, -db is required
+}
+
 func init() {
-	var db string
-	if user, err := user.Current(); err == nil {
-		db = user.HomeDir + string(os.PathSeparator) + ".blkidx.sqlite3"
-	}
-	flagDb = flag.String("db", db, "sqlite database file to store")
+	flagDb = flag.String("db", defaultDb("sqlite3"), "index database file, directory or url, see -db-driver")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `
@@ -45,15 +68,114 @@ commands:
   remove-missing [path...]   remove files from the index which
                              are also missing on the filesystem.
 
-  list                       list all files that are currently in the index.
+  list [path...]             list all files that are currently in the index,
+                             or only those below the given paths.
 
   list-missing [path...]     list only files that are in the index
                              but not on the filesystem.
 
+  query [path...]            list the indexed files below the given paths, or
+                             all files, which match every query option:
+                             -glob, -min-size, -max-size, -modified-since,
+                             -modified-before, -indexed-since, -indexed-before,
+                             -hash (a hex prefix), -algorithm and -block-size.
+                             sorted by -sort name, size, mtime or itime, with
+                             -desc in descending order, at most -limit files.
+
+  stats [path...]            report the number and size of the indexed files
+                             below the given paths, or of all files: totals,
+                             a size histogram, the largest extensions, the
+                             largest duplicate groups and the directories
+                             with the most duplicate bytes (at most -top each).
+                             duplicates are only counted within the paths.
+
   dups [path...]             show all files in the index which
                              have the same checksums.
+                             only the index is consulted, copies on volumes
+                             which are not mounted are marked [offline].
+                             with -format json, jsonl, csv or null files are
+                             written as records with a group id.
 
   rm-dups [path...]          interactive duplicate removal.
+                             files are re-checked against the index and
+                             compared byte by byte before they are deleted.
+
+                             with -tui dups and rm-dups show a full-screen
+                             terminal ui to browse the groups, preview files
+                             and mark files to keep or delete. the marked
+                             files are deleted after a final confirmation.
+
+                             with -dirs dups and rm-dups compare directories:
+                             directories whose trees have the same names and
+                             contents are grouped and directories which share
+                             at least -min-similarity of their content are
+                             listed in pairs. rm-dups only deletes directories
+                             which contain no files besides confirmed copies.
+
+  find-copies <path...>      hash the given files and list all files in the
+                             index with the same content. the files do not
+                             need to be indexed. with -partial files which
+                             share some blocks are listed as well.
+
+  diff <pathA> <pathB>       compare the indexed files below two paths by their
+                             stored hashes, e.g. to verify a backup. lists files
+                             in both (=), changed at the same path (~), hashed
+                             with different algorithms (?), only in A (-) and
+                             only in B (+). exits with an error unless all files
+                             are in both. with -index-a and -index-b the paths
+                             are looked up in other databases.
+
+  export [file]              export the index to file or stdout in the format
+                             of -export-format: jsonl (json lines) or binary.
+
+  import <file>              merge an export in either format into the index,
+                             "-" reads from stdin. files which differ from
+                             existing files are reported and resolved by
+                             -on-conflict: skip, replace or newer.
+
+  manifest [path...]         write a checksum manifest of the indexed files to
+                             stdout in the format of -manifest-format:
+                             gnu (sha1sum/sha256sum), bsd (--tag), sfv or
+                             hashdeep. stored hashes are used unless the format
+                             or -manifest-hash need another algorithm.
+
+  check-manifest <file> [dir]
+                             verify the files of a manifest in any of these
+                             formats, relative names are resolved against dir
+                             or the working directory. with -manifest-import
+                             verified files are added to the index.
+
+  serve [path...]            serve a json api and a web ui to browse duplicates
+                             on -listen until interrupted. the api under /api/
+                             offers blobs (by name or hash), query, dups, stats
+                             and index. with -allow-index index runs can be
+                             started below the given paths by posting
+                             {"paths": [...]} to /api/index.
+
+  index-server               serve the index of -db to other machines over grpc
+                             on -listen until interrupted. the other machines
+                             use it with -remote <host:port> instead of -db,
+                             e.g. to index their disks into a central index.
+                             there is neither authentication nor encryption,
+                             only listen on trusted networks.
+
+  volume add <name> <path>   register the directory path as a volume. files
+                             on a volume are indexed relative to the volume
+                             and found again if it is mounted elsewhere.
+                             the volume is identified by its file system uuid
+                             if path is a mount point, otherwise by a marker
+                             file named `+VolumeMarkerFile+` in path.
+
+  volume list                list all volumes and where they are mounted.
+
+  volume remove <name>       remove a volume, its files remain in the index.
+
+paths are file system paths or names relative to a volume: vol:<volume>/<path>.
+volume names refer to volumes even if they are not mounted.
+
+list, list-missing, query, stats, dups, find-copies, diff, check-manifest, remove, import
+and volume list write records with -format json, jsonl or csv, or nul
+terminated paths with -format null. summaries are only written as text.
 
 
 options:
@@ -65,62 +187,179 @@ options:
 func main() {
 	flag.Parse()
 	args := flag.Args()
+	if _, found := defaultDbNames[*flagDbDriver]; !found {
+		fmt.Fprintf(os.Stderr, "invalid db driver %q\n", *flagDbDriver)
+		errUsage()
+	}
+	if !flagIsSet("db") {
+		*flagDb = defaultDb(*flagDbDriver)
+	}
 	if *flagDb == "" || len(args) == 0 {
 		errUsage()
 	}
-	found, err := run(args, *flagDb)
+	var err error
+	if logger, err = newLogger(*flagLogFormat, *flagLogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		errUsage()
+	}
+	if out, err = newOutput(os.Stdout, *flagFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		errUsage()
+	}
+	// the first signal stops indexing gracefully, a second one terminates the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	found, err := run(ctx, args, *flagDb)
 	if !found {
 		errUsage()
 	}
+	if cerr := out.close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
 }
 
+// defaultDb returns the default -db of the driver in the home directory of the user.
+func defaultDb(driver string) string {
+	user, err := user.Current()
+	if err != nil || defaultDbNames[driver] == "" {
+		return ""
+	}
+	return user.HomeDir + string(os.PathSeparator) + defaultDbNames[driver]
+}
+
+func flagIsSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func newLogger(format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
 func errUsage() {
 	flag.Usage()
 	os.Exit(1)
 }
 
-func run(args []string, dbUrl string) (found bool, err error) {
-	idx, dbCloser, err := openDbIndex(dbUrl)
+func run(ctx context.Context, args []string, dbUrl string) (found bool, err error) {
+	idx, dbCloser, err := openIndex(ctx, dbUrl)
 	if err != nil {
-		return true, fmt.Errorf("failed to open the sqlite3 database: %v", err)
+		return true, err
 	}
 	defer dbCloser.Close()
 
-	var paths fs.Paths
-	if len(args) == 1 {
-		paths, err = fs.WorkingDirectory()
-	} else {
-		paths, err = fs.NewPaths(args[1:]...)
+	if args[0] == "index-server" {
+		if len(args) != 1 {
+			return false, nil
+		}
+		return true, indexServer(ctx, idx)
+	}
+	if args[0] == "volume" {
+		return volume(ctx, idx, args[1:])
+	}
+	switch {
+	case args[0] == "export" && len(args) == 1:
+		return true, exportIndex(ctx, idx, "-")
+	case args[0] == "export" && len(args) == 2:
+		return true, exportIndex(ctx, idx, args[1])
+	case args[0] == "import" && len(args) == 2:
+		return true, importIndex(ctx, idx, args[1])
+	}
+	if args[0] == "check-manifest" {
+		if len(args) < 2 || len(args) > 3 {
+			return false, nil
+		}
+		if volumes, err = LoadVolumes(ctx, idx); err != nil {
+			return true, fmt.Errorf("failed to load volumes: %v", err)
+		}
+		dir := "."
+		if len(args) == 3 {
+			dir = args[2]
+		}
+		return true, checkManifest(ctx, idx, args[1], dir)
+	}
+	if args[0] == "diff" {
+		if len(args) != 3 {
+			return false, nil
+		}
+		return true, diff(ctx, idx, args[1], args[2])
+	}
+	if volumes, err = LoadVolumes(ctx, idx); err != nil {
+		return true, fmt.Errorf("failed to load volumes: %v", err)
 	}
+
+	t, err := parseTargets(args[1:])
 	if err != nil {
 		return true, err
 	}
+	var dirs []string
+	for path := range t.paths {
+		dirs = append(dirs, path)
+	}
+	if err = volumes.Discover(ctx, idx, dirs...); err != nil {
+		return true, err
+	}
+	t.resolve()
 
 	switch args[0] {
 	case "index":
-		index(idx, paths)
+		err = index(ctx, idx, t)
 
 	case "remove":
-		err = remove(idx, paths, nil)
+		err = remove(ctx, idx, t, nil)
 
 	case "remove-missing":
-		removeMissing(idx, paths)
+		err = removeMissing(ctx, idx, t)
 
 	case "list":
-		err = list(idx)
+		err = list(ctx, idx, t)
 
 	case "list-missing":
-		err = listMissing(idx, paths)
+		err = listMissing(ctx, idx, t)
 
 	case "dups":
-		err = dups(idx, paths, false)
+		err = dups(ctx, idx, t, false)
 
 	case "rm-dups":
-		err = dups(idx, paths, true)
+		err = dups(ctx, idx, t, true)
+
+	case "find-copies":
+		err = findCopies(ctx, idx, t)
+
+	case "manifest":
+		err = manifest(ctx, idx, t)
+
+	case "query":
+		err = query(ctx, idx, t)
+
+	case "stats":
+		err = stats(ctx, idx, t)
+
+	case "serve":
+		err = serve(ctx, idx, t)
 
 	default:
 		return false, nil
@@ -128,14 +367,54 @@ func run(args []string, dbUrl string) (found bool, err error) {
 	return true, err
 }
 
-func openDbIndex(dbUrl string) (Index, io.Closer, error) {
+// openIndex opens the index of the index server of -remote, or the database of -db-driver otherwise.
+func openIndex(ctx context.Context, dbUrl string) (Index, io.Closer, error) {
+	if *flagRemote != "" {
+		idx, closer, err := remote.Dial(*flagRemote)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to the index server: %v", err)
+		}
+		return idx, closer, nil
+	}
+	idx, closer, err := openDbIndex(ctx, dbUrl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open the %s database: %v", *flagDbDriver, err)
+	}
+	return idx, closer, nil
+}
+
+func openDbIndex(ctx context.Context, dbUrl string) (Index, io.Closer, error) {
+	switch *flagDbDriver {
+	case "wal":
+		idx, err := OpenWalIndex(ctx, dbUrl)
+		if err != nil {
+			return nil, nil, err
+		}
+		idx.Log = logger
+		return idx, idx, nil
+	case "bolt":
+		db, err := bolt.Open(dbUrl, 0644, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, nil, err
+		}
+		idx, err := NewBoltIndex(ctx, db)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return idx, db, nil
+	}
 	// TODO: doesn'nt work, see comment below
 	//dbUrl := "file:" + *flagDb + "?cache=shared&mode=rwc"
-	db, err := sql.Open("sqlite3", dbUrl)
+	dialect, err := SqlDialectOf(*flagDbDriver)
 	if err != nil {
 		return nil, nil, err
 	}
-	idx, err := NewSqlIndex(db)
+	db, err := sql.Open(*flagDbDriver, dbUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx, err := NewSqlIndexWithDialect(ctx, db, dialect)
 	if err != nil {
 		db.Close()
 		return nil, nil, err
@@ -148,67 +427,129 @@ func openDbIndex(dbUrl string) (Index, io.Closer, error) {
 	return idx, db, nil
 }
 
-func index(idx Index, paths fs.Paths) {
-	var indexer = &Indexer{
+func index(ctx context.Context, idx Index, t *targets) error {
+	if err := t.requireOnline(); err != nil {
+		return err
+	}
+	result, err := newIndexer(idx).IndexAll(ctx, walkFiles(ctx, t.paths))
+	printIndexResult(result, err != nil)
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 || result.Unstable > 0 {
+		return fmt.Errorf("indexing failed for %d files, %d files were unstable", result.Failed, result.Unstable)
+	}
+	return nil
+}
+
+func newIndexer(idx Index) *Indexer {
+	return &Indexer{
 		Index:       idx,
 		Log:         logger,
 		Concurrency: *flagConcurrency,
+		Retry: RetryPolicy{
+			Retries: *flagRetries,
+			Delay:   *flagRetryDelay,
+		},
+		Paranoid: *flagParanoid,
+		Volumes:  volumes,
 	}
+}
 
-	indexer.IndexAll(fs.WalkFiles(paths))
+func printIndexResult(r *IndexResult, interrupted bool) {
+	fmt.Fprintln(os.Stderr)
+	if interrupted {
+		fmt.Fprintln(os.Stderr, "indexing interrupted")
+	}
+	fmt.Fprintf(os.Stderr, "new: %d, updated: %d, unchanged: %d, failed: %d, unstable: %d\n", //
+		r.New, r.Updated, r.Unchanged, r.Failed, r.Unstable)
+	fmt.Fprintf(os.Stderr, "hashed %s in %v\n", formatSize(r.BytesHashed), r.Duration.Round(time.Millisecond))
+	for _, e := range r.Errors {
+		fmt.Fprintf(os.Stderr, "  %s: %s: %v\n", e.Stage, e.Path, e.Err)
+	}
 }
 
-//TODO: review
-func remove(idx Index, paths fs.Paths, exclude fs.Paths) error {
-	names, err := idx.AllNames()
+func remove(ctx context.Context, idx Index, t *targets, exclude fs.Paths) error {
+	if exclude == nil && out.text() {
+		// the removed names are not listed
+		n, err := idx.RemoveUnder(ctx, t.names)
+		if err != nil {
+			return err
+		}
+		c, _ := idx.Count(ctx)
+		out.println("files removed:", n, "remaining:", c)
+		return nil
+	}
+
+	names, err := NamesUnder(ctx, idx, t.names)
 	if err != nil {
 		return err
 	}
-
-	for path, _ := range paths {
-		var remove Names
-		for _, name := range names {
-			if strings.HasPrefix(name, path) {
-				if _, found := exclude[name]; !found {
-					remove = append(remove, name)
-				}
-			}
+	var remove Names
+	for _, name := range names {
+		if _, found := exclude[name]; !found {
+			remove = append(remove, name)
 		}
-		if len(remove) > 0 {
-			if err := idx.Remove(remove); err != nil {
-				return err
-			}
+	}
+	if len(remove) > 0 {
+		if err := idx.Remove(ctx, remove); err != nil {
+			return err
 		}
 	}
+	for _, name := range remove {
+		r := &record{Name: name, Status: "removed"}
+		r.Path, _ = volumes.Path(name)
+		out.record(r)
+	}
 
-	c, _ := idx.Count()
-	fmt.Println("files removed:", len(names)-c, "remaining:", c)
+	c, _ := idx.Count(ctx)
+	out.println("files removed:", len(remove), "remaining:", c)
 	return nil
 }
 
-func removeMissing(idx Index, paths fs.Paths) {
-	var exclude fs.Paths = findAllFiles(paths)
-	remove(idx, paths, exclude)
+func removeMissing(ctx context.Context, idx Index, t *targets) error {
+	// nothing would be found on a volume which is not mounted
+	if err := t.requireOnline(); err != nil {
+		return err
+	}
+	var exclude fs.Paths = findAllNames(ctx, t.paths)
+	if err := ctx.Err(); err != nil {
+		// an interrupted walk does not know about all present files
+		return err
+	}
+	return remove(ctx, idx, t, exclude)
 }
 
-func list(idx Index) error {
-	names, err := idx.AllNames()
+// list lists all files in the index, or only those below the explicitly given targets.
+// only the index is consulted, files on volumes which are not mounted are listed as well.
+func list(ctx context.Context, idx Index, t *targets) error {
+	var listed int
+	err := idx.ForEach(ctx, func(b *Blob) error {
+		if t.explicit && !t.contains(b.Name) {
+			return nil
+		}
+		out.emit(blobRecord(b), displayName(b.Name))
+		listed++
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	names.Sort()
-
-	for _, name := range names {
-		fmt.Println(name)
-	}
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, "files listed:", len(names))
+	out.summary()
+	out.summary("files listed:", listed)
 	return nil
 }
 
 // TODO: review
-func listMissing(idx Index, paths fs.Paths) error {
-	names, err := getMissing(idx, paths, findAllFiles(paths))
+func listMissing(ctx context.Context, idx Index, t *targets) error {
+	if err := t.requireOnline(); err != nil {
+		return err
+	}
+	present := findAllNames(ctx, t.paths)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	names, err := getMissing(ctx, idx, t, present)
 	if err != nil {
 		return err
 	}
@@ -218,99 +559,174 @@ func listMissing(idx Index, paths fs.Paths) error {
 	}
 	ns.Sort()
 	for _, name := range ns {
-		fmt.Println(name)
+		r := nameRecord(ctx, idx, name)
+		r.Status = "missing"
+		out.emit(r, displayName(name))
 	}
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, "files missing:", len(ns))
+	out.summary()
+	out.summary("files missing:", len(ns))
 	return nil
 }
 
 // TODO: review
-func getMissing(idx Index, paths fs.Paths, present fs.Paths) (fs.Paths, error) {
-	names, err := idx.AllNames()
-	if err != nil {
-		return nil, err
-	}
-
+func getMissing(ctx context.Context, idx Index, t *targets, present fs.Paths) (fs.Paths, error) {
 	missing := make(fs.Paths)
-	for path, _ := range paths {
-		for _, name := range names {
-			if strings.HasPrefix(name, path) {
-				if _, found := present[name]; !found {
-					missing[name] = struct{}{}
-				}
-			}
+	err := idx.ForEachName(ctx, t.names, func(name string) error {
+		if _, found := present[name]; !found {
+			missing[name] = struct{}{}
 		}
-	}
-
-	return missing, nil
+		return nil
+	})
+	return missing, err
 }
 
-func dups(idx Index, paths fs.Paths, rm bool) error {
-	equalBlobs, err := idx.FindEqualHashes()
+// dups shows all groups of equal files which contain at least one file below the targets.
+// only the index is consulted, so copies on volumes which are not mounted are shown as well.
+func dups(ctx context.Context, idx Index, t *targets, rm bool) error {
+	if rm && !out.text() {
+		return fmt.Errorf("rm-dups is interactive and only supports the text format")
+	}
+	if *flagDirs {
+		if *flagTUI {
+			return fmt.Errorf("-tui does not support -dirs")
+		}
+		return dirDups(ctx, idx, t, rm)
+	}
+	var equalBlobs []EqualBlobs
+	var err error
+	if *flagAll {
+		equalBlobs, err = idx.FindEqualHashes(ctx)
+	} else {
+		equalBlobs, err = FindEqualHashesUnder(ctx, idx, t.names)
+	}
 	if err != nil {
 		return fmt.Errorf("find duplicates failed: %v", err)
 	}
-	equalBlobs = reduceEqualBlobs(equalBlobs, findAllFiles(paths))
 	if len(equalBlobs) == 0 {
-		fmt.Println("no duplicates found")
+		out.println("no duplicates found")
 		return nil
 	}
+	if *flagTUI {
+		return reviewDuplicates(ctx, idx, equalBlobs, rm)
+	}
 
 	var savings int64
 	separator := strings.Repeat("-", 80)
-	for _, equal := range equalBlobs {
-		fmt.Println(separator)
+	for group, equal := range equalBlobs {
+		out.println(separator)
 		for i, name := range equal.Names {
-			fmt.Printf("%d - %s\n", (i + 1), name)
+			r := nameRecord(ctx, idx, name)
+			r.Group = group + 1
+			out.emit(r, fmt.Sprintf("%d - %s", (i+1), displayName(name)))
 		}
 
 		if rm {
-			n, err := askRemove(idx, equal)
+			n, err := askRemove(ctx, idx, equal)
+			savings += equal.Size * int64(n)
 			if err != nil {
+				fmt.Fprintln(os.Stderr, "removed", formatSize(savings))
 				return err
 			}
-			savings += equal.Size * int64(n)
 		} else {
 			savings += (equal.Size * (int64(len(equal.Names) - 1)))
 		}
 	}
-	fmt.Fprintln(os.Stderr)
+	out.summary()
 	if rm {
-		fmt.Fprintln(os.Stderr, "removed", formatSize(savings))
+		out.summary("removed", formatSize(savings))
 	} else {
-		fmt.Fprintln(os.Stderr, "removing all duplicates would save", formatSize(savings))
+		out.summary("removing all duplicates would save", formatSize(savings))
 	}
 	return nil
 }
 
-func askRemove(idx Index, equal EqualBlobs) (int, error) {
+func askRemove(ctx context.Context, idx Index, equal EqualBlobs) (int, error) {
+	keep, remove, err := askSelection("file", equal.Names)
+	if err != nil || len(remove) == 0 {
+		return 0, err
+	}
+	return removeDuplicates(ctx, idx, keep, remove)
+}
+
+// removeDuplicates deletes the files of remove once they are confirmed to be copies of keep.
+func removeDuplicates(ctx context.Context, idx Index, keep string, remove Names) (int, error) {
+	confirmed, err := ConfirmDuplicates(ctx, idx, volumes, keep, remove)
+	if err != nil {
+		return 0, fmt.Errorf("duplicate confirmation failed: %v", err)
+	}
+	if !confirmed.OK() {
+		printUnconfirmed(confirmed, keep)
+		fmt.Println("nothing deleted in this group")
+		return 0, nil
+	}
+
+	for i, name := range remove {
+		file, _ := volumes.Path(name)
+		fmt.Println("deleting", file)
+		if err := os.Remove(file); err != nil {
+			return i, err
+		}
+		var deleted Names = Names{name}
+		if err := idx.Remove(ctx, deleted); err != nil {
+			return i + 1, fmt.Errorf("file removed but still in index due do: %v", err)
+		}
+	}
+
+	return len(remove), nil
+}
+
+// askSelection asks which of the names to delete. the first name which is not selected is kept,
+// nothing is removed if all names are selected.
+func askSelection(kind string, names Names) (keep string, remove Names, err error) {
 	r := bufio.NewReader(os.Stdin)
 
-	fmt.Println(`enter space-separated file indexes to delete or enter to delete-nothing
-!!! this really deleted the file !!!`)
+	fmt.Printf(`enter space-separated %s indexes to delete or enter to delete-nothing
+!!! this really deleted the %s !!!
+`, kind, kind)
 	indexes, err := readIntFieldsLine(r, -1)
 	if err != nil {
-		return 0, err
+		return "", nil, err
 	}
 	if len(indexes) == 0 {
-		return 0, nil
+		return "", nil, nil
 	}
+	selected := make(map[int]bool, len(indexes))
 	for _, index := range indexes {
-		if index >= 0 && index < len(equal.Names) {
-			file := equal.Names[index]
-			fmt.Println("deleting", file)
-			if err := os.Remove(file); err != nil {
-				return 0, err // TODO: still report how much was already saved
-			}
-			var deleted Names = Names{file}
-			if err := idx.Remove(deleted); err != nil {
-				return 0, fmt.Errorf("file removed but still in index due do: %v", err) // TODO: same as above
-			}
+		if index >= 0 && index < len(names) {
+			selected[index] = true
 		}
 	}
+	for i, name := range names {
+		if selected[i] {
+			remove = append(remove, name)
+		} else if keep == "" {
+			keep = name
+		}
+	}
+	if keep == "" {
+		fmt.Println("at least one copy must be kept, nothing deleted")
+		return "", nil, nil
+	}
+	return keep, remove, nil
+}
 
-	return len(indexes), nil
+// printUnconfirmed prints why duplicates of keep could not be confirmed
+func printUnconfirmed(confirmed *ConfirmResult, keep string) {
+	for _, name := range confirmed.Stale {
+		fmt.Println("stale index entry, re-index to update:", displayName(name))
+	}
+	for _, name := range confirmed.Mismatched {
+		fmt.Println("content differs from", displayName(keep)+":", displayName(name))
+	}
+	for _, name := range confirmed.Same {
+		fmt.Println("same file as", displayName(keep)+":", displayName(name))
+	}
+	for _, name := range confirmed.Offline {
+		fmt.Println("volume not mounted:", displayName(name))
+	}
+	for _, name := range confirmed.Unindexed {
+		fmt.Println("not indexed:", displayName(name))
+	}
 }
 
 func readIntFieldsLine(r *bufio.Reader, offset int) ([]int, error) {
@@ -333,19 +749,28 @@ func readIntFieldsLine(r *bufio.Reader, offset int) ([]int, error) {
 	return indexes, nil
 }
 
-func findAllFiles(paths fs.Paths) fs.Paths {
-	c := fs.WalkFiles(paths)
-	return fs.AggregateLogErrors(c, logger)
+func walkFiles(ctx context.Context, paths fs.Paths) <-chan *fs.PathElem {
+	w := &fs.Walker{Concurrency: *flagWalkers}
+	return w.Walk(ctx, paths)
 }
 
-func reduceEqualBlobs(ebs []EqualBlobs, filesInPaths fs.Paths) []EqualBlobs {
-	var rv []EqualBlobs
-	for _, eb := range ebs {
-		if eb.ContainsAnyName(filesInPaths) {
-			rv = append(rv, eb)
-		}
+// findAllNames walks all paths and returns the blob names of all files found
+func findAllNames(ctx context.Context, paths fs.Paths) fs.Paths {
+	files := fs.AggregateLogErrors(walkFiles(ctx, paths), logger)
+	names := make(fs.Paths, len(files))
+	for file := range files {
+		names[volumes.Name(file)] = struct{}{}
+	}
+	return names
+}
+
+// displayName returns the file system path of a blob name, or the name itself
+// marked as offline if it belongs to a volume which is not mounted
+func displayName(name string) string {
+	if path, online := volumes.Path(name); online {
+		return path
 	}
-	return rv
+	return name + " [offline]"
 }
 
 func formatSize(s int64) string {
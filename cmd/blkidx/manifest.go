@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/phicode/blkidx/fs"
+
+	. "github.com/phicode/blkidx"
+)
+
+var (
+	flagManifestFormat = flag.String("manifest-format", "gnu", "manifest: gnu (sha256sum), bsd, sfv or hashdeep")
+	flagManifestHash   = flag.String("manifest-hash", "",
+		"manifest: md5, sha1, sha256 or sha512, files are hashed if the index used another algorithm")
+	flagManifestImport = flag.Bool("manifest-import", false, "check-manifest: index verified files")
+)
+
+// manifest writes a checksum manifest of all indexed files below the targets to stdout.
+// names are relative to the working directory if the files are located below it.
+func manifest(ctx context.Context, idx Index, t *targets) error {
+	if err := t.requireOnline(); err != nil {
+		return err
+	}
+	format, err := ParseManifestFormat(*flagManifestFormat)
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	w := NewManifestWriter(os.Stdout, format)
+
+	var written, failed int
+	err = idx.ForEach(ctx, func(blob *Blob) error {
+		if !t.contains(blob.Name) {
+			return nil
+		}
+		e, err := manifestEntry(ctx, blob, format, wd)
+		if err == nil {
+			err = w.Write(e)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+			return nil
+		}
+		written++
+		return nil
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "files written:", written)
+	if failed > 0 {
+		return fmt.Errorf("manifest failed for %d files", failed)
+	}
+	return nil
+}
+
+// manifestEntry returns the entry of an indexed file. the stored hash is used unless the
+// format or -manifest-hash require another algorithm. files which changed since they
+// have been indexed are rejected.
+func manifestEntry(ctx context.Context, blob *Blob, format ManifestFormat, wd string) (ManifestEntry, error) {
+	path, _ := volumes.Path(blob.Name)
+	e := ManifestEntry{Name: filepath.ToSlash(path), Hash: blob.Hash, Size: blob.Size}
+	if fs.IsUnder(path, wd) && path != wd {
+		rel, _ := filepath.Rel(wd, path)
+		e.Name = filepath.ToSlash(rel)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return e, err
+	}
+	if blob.HasChanged(info.Size(), info.ModTime()) {
+		return e, fmt.Errorf("%s: changed since it has been indexed", path)
+	}
+
+	stored, _ := ManifestAlgorithm(blob.HashAlgorithm)
+	e.Algorithm = stored
+	switch {
+	case format == ManifestSFV:
+		e.Algorithm = ManifestCRC32
+	case *flagManifestHash != "":
+		e.Algorithm = *flagManifestHash
+	}
+	if e.Algorithm == stored {
+		return e, nil
+	}
+	if e.Algorithm == "" {
+		return e, fmt.Errorf("%s: hash algorithm %v is not supported by manifests", path, blob.HashAlgorithm)
+	}
+	e.Hash, _, err = HashFileManifest(ctx, path, e.Algorithm)
+	return e, err
+}
+
+// checkManifest verifies the files of a manifest which are relative to dir.
+func checkManifest(ctx context.Context, idx Index, file, dir string) error {
+	dir, err := fs.CleanAbsolute(dir)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var (
+		r      = NewManifestReader(in)
+		counts = make(map[ManifestStatus]int)
+		hashed = make(fs.Paths)
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		c := CheckManifestEntry(ctx, idx, volumes, dir, e)
+		counts[c.Status]++
+		r := &record{Name: e.Name, Path: c.Path, Hash: hex.EncodeToString(e.Hash), Status: c.Status.String()}
+		if e.Size >= 0 {
+			r.Size = &e.Size
+		}
+		text := fmt.Sprintf("%s: %v", e.Name, c.Status)
+		if c.Err != nil {
+			r.Detail = c.Err.Error()
+			text += ": " + r.Detail
+		}
+		out.emit(r, text)
+		if c.Status == ManifestOK && !c.FromIndex {
+			hashed[c.Path] = struct{}{}
+		}
+	}
+	out.summary()
+	out.summary(fmt.Sprintf("ok: %d, failed: %d, missing: %d, errors: %d", //
+		counts[ManifestOK], counts[ManifestFailed], counts[ManifestMissing], counts[ManifestError]))
+
+	if *flagManifestImport && len(hashed) > 0 {
+		result, err := newIndexer(idx).IndexAll(ctx, walkFiles(ctx, hashed))
+		printIndexResult(result, err != nil)
+		if err != nil {
+			return err
+		}
+	}
+	if failed := counts[ManifestFailed] + counts[ManifestMissing] + counts[ManifestError]; failed > 0 {
+		return fmt.Errorf("manifest verification failed for %d files", failed)
+	}
+	return nil
+}
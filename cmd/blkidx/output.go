@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/phicode/blkidx"
+)
+
+var flagFormat = flag.String("format", "text",
+	"output format: text, json, jsonl, csv or null (nul terminated paths for xargs -0)")
+
+// the output of the current command
+var out *output
+
+// record is a single entry of the machine readable output.
+// fields which do not apply to a command are left empty.
+type record struct {
+	// the blob name or a path relative to the compared roots
+	Name string `json:"name"`
+
+	// the file system path, empty if the file is on a volume which is not mounted
+	Path    string     `json:"path,omitempty"`
+	Size    *int64     `json:"size,omitempty"`
+	Hash    string     `json:"hash,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+
+	// the records of a group of equal files share a group id, starting at 1
+	Group int `json:"group,omitempty"`
+
+	// the result of a check or comparison
+	Status string `json:"status,omitempty"`
+
+	// additional information: the other path of a moved file, the id of a volume
+	// or an error message
+	Detail string `json:"detail,omitempty"`
+}
+
+var recordColumns = []string{"name", "path", "size", "hash", "mod_time", "group", "status", "detail"}
+
+// blobRecord returns the record of a blob
+func blobRecord(b *Blob) *record {
+	r := &record{Name: b.Name, Size: &b.Size, Hash: hex.EncodeToString(b.Hash), ModTime: &b.ModTime}
+	r.Path, _ = volumes.Path(b.Name)
+	return r
+}
+
+// nameRecord returns the record of a blob name, its details are looked up in the index
+// unless the output is human readable text
+func nameRecord(ctx context.Context, idx Index, name string) *record {
+	if out.text() {
+		return &record{Name: name}
+	}
+	if b, err := idx.LookupByName(ctx, name); err == nil && b != nil {
+		return blobRecord(b)
+	}
+	r := &record{Name: name}
+	r.Path, _ = volumes.Path(name)
+	return r
+}
+
+// output writes either human readable text or records in a machine readable format.
+// human readable text is written unbuffered since it may be interleaved with prompts.
+type output struct {
+	format string
+	stdout io.Writer // human readable text
+	stderr io.Writer // human readable summaries
+	w      *bufio.Writer
+	csv    *csv.Writer
+	json   *json.Encoder
+	n      int   // records written
+	err    error // the first write error
+}
+
+func newOutput(w io.Writer, format string) (*output, error) {
+	o := &output{format: format, stdout: w, stderr: os.Stderr, w: bufio.NewWriter(w)}
+	switch format {
+	case "text", "null":
+	case "json":
+	case "jsonl":
+		o.json = json.NewEncoder(o.w)
+	case "csv":
+		o.csv = csv.NewWriter(o.w)
+	default:
+		return nil, fmt.Errorf("invalid output format %q", format)
+	}
+	return o, nil
+}
+
+func (o *output) text() bool { return o.format == "text" }
+
+// emit writes the record, or the text if the output is human readable.
+func (o *output) emit(r *record, text string) {
+	if o.text() {
+		fmt.Fprintln(o.stdout, text)
+		return
+	}
+	o.record(r)
+}
+
+// record writes the record if the output is machine readable.
+func (o *output) record(r *record) {
+	if o.text() || o.err != nil {
+		return
+	}
+	switch o.format {
+	case "null":
+		name := r.Path
+		if name == "" {
+			name = r.Name
+		}
+		_, o.err = o.w.WriteString(name + "\x00")
+	case "json":
+		sep := ",\n"
+		if o.n == 0 {
+			sep = "[\n"
+		}
+		var b []byte
+		if b, o.err = json.Marshal(r); o.err == nil {
+			o.w.WriteString(sep)
+			_, o.err = o.w.Write(b)
+		}
+	case "jsonl":
+		o.err = o.json.Encode(r)
+	case "csv":
+		if o.n == 0 {
+			o.csv.Write(recordColumns)
+		}
+		o.err = o.csv.Write(r.columns())
+	}
+	o.n++
+}
+
+// println writes human readable text which is omitted in machine readable formats.
+func (o *output) println(a ...interface{}) {
+	if o.text() {
+		fmt.Fprintln(o.stdout, a...)
+	}
+}
+
+// summary writes counts and totals to stderr if the output is human readable.
+func (o *output) summary(a ...interface{}) {
+	if o.text() {
+		fmt.Fprintln(o.stderr, a...)
+	}
+}
+
+// close terminates the output and returns the first write error.
+func (o *output) close() error {
+	if o.format == "json" {
+		if o.n == 0 {
+			o.w.WriteString("[]\n")
+		} else {
+			o.w.WriteString("\n]\n")
+		}
+	}
+	if o.csv != nil {
+		o.csv.Flush()
+		if err := o.csv.Error(); o.err == nil {
+			o.err = err
+		}
+	}
+	if err := o.w.Flush(); o.err == nil {
+		o.err = err
+	}
+	return o.err
+}
+
+func (r *record) columns() []string {
+	var size, modTime, group string
+	if r.Size != nil {
+		size = strconv.FormatInt(*r.Size, 10)
+	}
+	if r.ModTime != nil {
+		modTime = r.ModTime.Format(time.RFC3339Nano)
+	}
+	if r.Group > 0 {
+		group = strconv.Itoa(r.Group)
+	}
+	return []string{r.Name, r.Path, size, r.Hash, modTime, group, r.Status, r.Detail}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecords returns records whose names need quoting in csv
+func testRecords() []*record {
+	size := int64(42)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []*record{
+		{Name: "a,b", Path: "/mnt/a,b", Size: &size, Hash: "00ff", ModTime: &modTime, Group: 1},
+		{Name: `say "hi"`, Status: "changed"},
+		{Name: "line\nbreak", Detail: "x"},
+	}
+}
+
+// testOutput writes the records and summaries in the format and returns stdout and stderr.
+func testOutput(t *testing.T, format string, records []*record) (string, string) {
+	var stdout, stderr bytes.Buffer
+	o, err := newOutput(&stdout, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.stderr = &stderr
+	o.println("header")
+	for _, r := range records {
+		o.emit(r, "text "+r.Name)
+	}
+	o.summary("summary")
+	if err = o.close(); err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestOutputText(t *testing.T) {
+	stdout, stderr := testOutput(t, "text", testRecords())
+	if want := "header\ntext a,b\ntext say \"hi\"\ntext line\nbreak\n"; stdout != want {
+		t.Errorf("want stdout %q; got %q", want, stdout)
+	}
+	if stderr != "summary\n" {
+		t.Errorf("want the summary on stderr; got %q", stderr)
+	}
+}
+
+func TestOutputJSON(t *testing.T) {
+	records := testRecords()
+	stdout, stderr := testOutput(t, "json", records)
+	if !strings.HasPrefix(stdout, "[\n{") || !strings.HasSuffix(stdout, "}\n]\n") || strings.Count(stdout, "},\n{") != 2 {
+		t.Errorf("want a json array with a record per line; got %q", stdout)
+	}
+	var got []*record
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil || !reflect.DeepEqual(got, records) {
+		t.Errorf("want %v; got %v, %v", records, got, err)
+	}
+	if stderr != "" {
+		t.Errorf("want no summary; got %q", stderr)
+	}
+
+	if stdout, _ = testOutput(t, "json", nil); stdout != "[]\n" {
+		t.Errorf("want an empty array; got %q", stdout)
+	}
+}
+
+func TestOutputJSONLines(t *testing.T) {
+	records := testRecords()
+	stdout, stderr := testOutput(t, "jsonl", records)
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != len(records) {
+		t.Fatalf("want %d lines; got %q", len(records), stdout)
+	}
+	for i, line := range lines {
+		var got *record
+		if err := json.Unmarshal([]byte(line), &got); err != nil || !reflect.DeepEqual(got, records[i]) {
+			t.Errorf("line %d - want %v; got %v, %v", i, records[i], got, err)
+		}
+	}
+	if stderr != "" {
+		t.Errorf("want no summary; got %q", stderr)
+	}
+}
+
+func TestOutputCSV(t *testing.T) {
+	records := testRecords()
+	stdout, stderr := testOutput(t, "csv", records)
+	if want := "name,path,size,hash,mod_time,group,status,detail\n" +
+		"\"a,b\",\"/mnt/a,b\",42,00ff,2024-01-02T03:04:05Z,1,,\n" +
+		"\"say \"\"hi\"\"\",,,,,,changed,\n" +
+		"\"line\nbreak\",,,,,,,x\n"; stdout != want {
+		t.Errorf("want %q; got %q", want, stdout)
+	}
+	rows, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(records)+1 || !reflect.DeepEqual(rows[0], recordColumns) {
+		t.Fatalf("want a header and %d rows; got %q", len(records), rows)
+	}
+	for i, r := range records {
+		if got := rows[i+1]; !reflect.DeepEqual(got, r.columns()) {
+			t.Errorf("row %d - want %q; got %q", i, r.columns(), got)
+		}
+	}
+	if stderr != "" {
+		t.Errorf("want no summary; got %q", stderr)
+	}
+}
+
+func TestOutputNull(t *testing.T) {
+	// the path is preferred over the name
+	stdout, stderr := testOutput(t, "null", testRecords())
+	if want := "/mnt/a,b\x00say \"hi\"\x00line\nbreak\x00"; stdout != want {
+		t.Errorf("want %q; got %q", want, stdout)
+	}
+	if stderr != "" {
+		t.Errorf("want no summary; got %q", stderr)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/phicode/blkidx"
+)
+
+var (
+	flagGlob           = flag.String("glob", "", "query: pattern of the file name, or of the whole name if it contains a slash")
+	flagMinSize        = flag.String("min-size", "", "query: minimum size, e.g. 10M")
+	flagMaxSize        = flag.String("max-size", "", "query: files smaller than this size, e.g. 1G")
+	flagModifiedSince  = flag.String("modified-since", "", "query: files modified at or after a date, time or duration ago, e.g. 2024-01-31 or 7d")
+	flagModifiedBefore = flag.String("modified-before", "", "query: files modified before a date, time or duration ago")
+	flagIndexedSince   = flag.String("indexed-since", "", "query: files indexed at or after a date, time or duration ago")
+	flagIndexedBefore  = flag.String("indexed-before", "", "query: files indexed before a date, time or duration ago")
+	flagHash           = flag.String("hash", "", "query: prefix of the hex encoded hash")
+	flagAlgorithm      = flag.String("algorithm", "", "query: hash algorithm, e.g. sha1 or SHA-256")
+	flagBlockSize      = flag.String("block-size", "", "query: hash block size, e.g. 4M")
+	flagSort           = flag.String("sort", "name", "query: name, size, mtime or itime")
+	flagDesc           = flag.Bool("desc", false, "query: sort in descending order")
+	flagLimit          = flag.Int("limit", 0, "query: maximum number of files, 0 for no limit")
+)
+
+// query lists the indexed files below the targets which match the query flags.
+func query(ctx context.Context, idx Index, t *targets) error {
+	q, err := parseQuery(time.Now())
+	if err != nil {
+		return err
+	}
+	if t.explicit {
+		q.Under = t.names
+	}
+	blobs, err := idx.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		out.emit(blobRecord(b), fmt.Sprintf("%12d  %s  %s",
+			b.Size, b.ModTime.Local().Format("2006-01-02 15:04"), displayName(b.Name)))
+	}
+	out.summary()
+	out.summary("files listed:", len(blobs))
+	return nil
+}
+
+// parseQuery returns the query of the query flags, durations are relative to now.
+func parseQuery(now time.Time) (*Query, error) {
+	q := &Query{
+		Glob:       *flagGlob,
+		HashPrefix: *flagHash,
+		Descending: *flagDesc,
+		Limit:      *flagLimit,
+	}
+	var err error
+	if q.MinSize, err = parseSize(*flagMinSize); err != nil {
+		return nil, fmt.Errorf("-min-size: %v", err)
+	}
+	if q.MaxSize, err = parseSize(*flagMaxSize); err != nil {
+		return nil, fmt.Errorf("-max-size: %v", err)
+	}
+	blockSize, err := parseSize(*flagBlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("-block-size: %v", err)
+	}
+	q.HashBlockSize = int(blockSize)
+	for _, tf := range []struct {
+		name, value string
+		t           *time.Time
+	}{
+		{"-modified-since", *flagModifiedSince, &q.ModifiedSince},
+		{"-modified-before", *flagModifiedBefore, &q.ModifiedBefore},
+		{"-indexed-since", *flagIndexedSince, &q.IndexedSince},
+		{"-indexed-before", *flagIndexedBefore, &q.IndexedBefore},
+	} {
+		if *tf.t, err = parseTime(tf.value, now); err != nil {
+			return nil, fmt.Errorf("%s: %v", tf.name, err)
+		}
+	}
+	if *flagAlgorithm != "" {
+		if q.HashAlgorithm, err = ParseHashAlgorithm(*flagAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+	if q.Order, err = ParseQueryOrder(*flagSort); err != nil {
+		return nil, err
+	}
+	if q.Limit < 0 {
+		return nil, fmt.Errorf("invalid limit %d", q.Limit)
+	}
+	return q, q.Validate()
+}
+
+var sizeSuffixes = map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+// parseSize parses a number of bytes with an optional binary suffix K, M, G or T.
+// the empty string is 0.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	digits, mult := s, int64(1)
+	if m, found := sizeSuffixes[strings.ToUpper(s[len(s)-1:])[0]]; found {
+		digits, mult = s[:len(s)-1], m
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mult {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// parseTime parses a local date, an RFC 3339 time or a duration before now,
+// which may be given in days, e.g. 7d. the empty string is the zero time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if days, found := strings.CutSuffix(s, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date, time or duration %q", s)
+}
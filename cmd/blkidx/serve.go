@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/phicode/blkidx/web"
+
+	. "github.com/phicode/blkidx"
+)
+
+var (
+	flagListen     = flag.String("listen", "127.0.0.1:8080", "serve, index-server: address to listen on")
+	flagAllowIndex = flag.Bool("allow-index", false, "serve: allow index runs through the api below the given paths")
+)
+
+// serve serves the json api and the web ui until the context is done. index runs are
+// restricted to the targets.
+func serve(ctx context.Context, idx Index, t *targets) error {
+	s := &web.Server{
+		Index:   idx,
+		Volumes: volumes,
+		Context: ctx,
+		Log:     logger,
+	}
+	if *flagAllowIndex {
+		if err := t.requireOnline(); err != nil {
+			return err
+		}
+		s.IndexPaths = func(ctx context.Context, paths []string) (*IndexResult, error) {
+			return indexBelow(ctx, idx, t, paths)
+		}
+	}
+
+	l, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	logger.Info("serving", "url", "http://"+l.Addr().String()+"/", "index", *flagAllowIndex)
+	if err = srv.Serve(l); errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// indexBelow indexes the paths, which must be located below the targets.
+func indexBelow(ctx context.Context, idx Index, allowed *targets, paths []string) (*IndexResult, error) {
+	t, err := parseTargets(paths)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.requireOnline(); err != nil {
+		return nil, err
+	}
+	t.resolve()
+	for _, name := range t.names {
+		if !allowed.contains(name) {
+			return nil, fmt.Errorf("not below the served paths: %s", displayName(name))
+		}
+	}
+	return newIndexer(idx).IndexAll(ctx, walkFiles(ctx, t.paths))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	. "github.com/phicode/blkidx"
+)
+
+var flagTop = flag.Int("top", 10, "stats: number of extensions, duplicate groups and directories, 0 for all")
+
+// stats reports aggregates of the indexed files below the targets, or of all files.
+func stats(ctx context.Context, idx Index, t *targets) error {
+	if out.format == "null" {
+		return fmt.Errorf("stats does not support the null format")
+	}
+	var under Names
+	if t.explicit {
+		under = t.names
+	}
+	s, err := idx.Stats(ctx, under, *flagTop)
+	if err != nil {
+		return err
+	}
+
+	emitCount := func(status, name string, c StatsCount, text string) {
+		r := &record{Name: name, Size: &c.Bytes, Status: status, Detail: fmt.Sprintf("%d files", c.Files)}
+		out.emit(r, fmt.Sprintf("  %10d files  %14s  %s", c.Files, formatSize(c.Bytes), text))
+	}
+	out.println("totals:")
+	emitCount("total", "total", s.Total, "all files")
+	emitCount("duplicates", "duplicates", s.Duplicates, "duplicates")
+	redundant := s.RedundantBytes
+	out.emit(&record{Name: "redundant", Size: &redundant, Status: "redundant"},
+		"  removing all duplicates would save "+formatSize(redundant))
+
+	out.println()
+	out.println("sizes:")
+	for _, b := range s.Sizes {
+		name := fmt.Sprintf("%d-%d", b.Min, b.Max)
+		text := fmt.Sprintf("%s - %s", formatSize(b.Min), formatSize(b.Max))
+		if b.Max == 0 {
+			name = fmt.Sprintf("%d-", b.Min)
+			text = fmt.Sprintf(">= %s", formatSize(b.Min))
+		}
+		emitCount("size", name, b.StatsCount, text)
+	}
+
+	out.println()
+	out.println("extensions:")
+	for _, e := range s.Extensions {
+		text := e.Extension
+		if text == "" {
+			text = "(none)"
+		}
+		emitCount("extension", e.Extension, e.StatsCount, text)
+	}
+
+	if len(s.Groups) > 0 {
+		out.println()
+		out.println("largest duplicate groups:")
+	}
+	for group, equal := range s.Groups {
+		out.println(fmt.Sprintf("  %d x %s, %s redundant", len(equal.Names), formatSize(equal.Size),
+			formatSize(equal.Size*int64(len(equal.Names)-1))))
+		for _, name := range equal.Names {
+			r := &record{Name: name, Size: &equal.Size, Group: group + 1, Status: "group"}
+			r.Path, _ = volumes.Path(name)
+			out.emit(r, "    "+displayName(name))
+		}
+	}
+
+	if len(s.Dirs) > 0 {
+		out.println()
+		out.println("directories with the most duplicates:")
+	}
+	for _, d := range s.Dirs {
+		emitCount("dir", d.Dir, d.StatsCount, displayName(d.Dir))
+	}
+	return nil
+}
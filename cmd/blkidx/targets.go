@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phicode/blkidx/fs"
+
+	. "github.com/phicode/blkidx"
+)
+
+// targets are the paths which have been given on the command line.
+// a path is either a file system path or a name relative to a volume (vol:<volume>/<path>),
+// the latter also refer to volumes which are currently not mounted.
+type targets struct {
+	// true if paths were given, false if the working directory is used
+	explicit bool
+
+	// the blob names of all targets
+	names []string
+
+	// the file system paths of all targets which are currently accessible
+	paths fs.Paths
+
+	// the names of targets on volumes which are not mounted
+	offline []string
+}
+
+func parseTargets(args []string) (*targets, error) {
+	t := &targets{explicit: len(args) > 0, paths: make(fs.Paths)}
+	if len(args) == 0 {
+		wd, err := fs.WorkingDirectory()
+		if err != nil {
+			return nil, err
+		}
+		for path := range wd {
+			args = append(args, path)
+		}
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, VolumeNamePrefix) {
+			path, err := fs.CleanAbsolute(arg)
+			if err != nil {
+				return nil, err
+			}
+			t.paths[path] = struct{}{}
+			continue
+		}
+		name := strings.TrimRight(arg, "/")
+		if path, online := volumes.Path(name); online {
+			t.paths[path] = struct{}{}
+		} else {
+			t.names = append(t.names, name)
+			t.offline = append(t.offline, name)
+		}
+	}
+	return t, nil
+}
+
+// resolve maps the file system paths to blob names.
+// it must be called after volumes have been discovered.
+func (t *targets) resolve() {
+	for path := range t.paths {
+		t.names = append(t.names, volumes.Name(path))
+	}
+}
+
+// requireOnline fails if any of the targets is on a volume which is not mounted.
+// commands which inspect the file system cannot operate on such targets.
+func (t *targets) requireOnline() error {
+	if len(t.offline) > 0 {
+		return fmt.Errorf("volume not mounted: %s", strings.Join(t.offline, ", "))
+	}
+	return nil
+}
+
+// contains reports whether the blob name is any of the targets or is located below them.
+func (t *targets) contains(name string) bool {
+	for _, n := range t.names {
+		if NameIsUnder(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports whether any of the blob names is contained in the targets.
+func (t *targets) containsAny(names Names) bool {
+	for _, name := range names {
+		if t.contains(name) {
+			return true
+		}
+	}
+	return false
+}
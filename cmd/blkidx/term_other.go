@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package main
+
+import "errors"
+
+var errNoTerminal = errors.New("terminal not supported on this platform")
+
+func isTerminal(fd int) bool { return false }
+
+func makeRaw(fd int) (restore func() error, err error) { return nil, errNoTerminal }
+
+func termSize(fd int) (width, height int, err error) { return 0, 0, errNoTerminal }
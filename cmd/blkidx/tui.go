@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/phicode/blkidx"
+)
+
+var flagTUI = flag.Bool("tui", false, "dups, rm-dups: review duplicates in a full-screen terminal ui")
+
+const (
+	ansiClear        = "\x1b[H\x1b[2J"
+	ansiAltScreenOn  = "\x1b[?1049h\x1b[?25l"
+	ansiAltScreenOff = "\x1b[?25h\x1b[?1049l"
+	ansiReverse      = "\x1b[7m"
+	ansiReset        = "\x1b[0m"
+
+	tuiTimeFormat    = "2006-01-02 15:04"
+	tuiPreviewBytes  = 4096
+	tuiPreviewHexLen = 16
+)
+
+// reviewDuplicates shows the groups of duplicates in a full-screen terminal ui. with rm the
+// files which are marked for deletion are deleted as by rm-dups once the terminal is restored.
+func reviewDuplicates(ctx context.Context, idx Index, equalBlobs []EqualBlobs, rm bool) error {
+	if !out.text() {
+		return errors.New("-tui only supports the text format")
+	}
+	in, outFd := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !isTerminal(in) || !isTerminal(outFd) {
+		return errors.New("-tui needs a terminal")
+	}
+	u := newTUI(ctx, idx, equalBlobs, rm)
+
+	restore, err := makeRaw(in)
+	if err != nil {
+		return err
+	}
+	fmt.Print(ansiAltScreenOn)
+	execute, err := u.run(bufio.NewReader(os.Stdin), os.Stdout, outFd)
+	fmt.Print(ansiAltScreenOff)
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil || !execute {
+		return err
+	}
+
+	var savings int64
+	for _, r := range u.removals() {
+		n, err := removeDuplicates(ctx, idx, r.keep, r.remove)
+		savings += r.size * int64(n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "removed", formatSize(savings))
+			return err
+		}
+	}
+	out.summary()
+	out.summary("removed", formatSize(savings))
+	return nil
+}
+
+type tuiMark int
+
+const (
+	markNone tuiMark = iota
+	markKeep
+	markDelete
+)
+
+var tuiMarks = [...]string{markNone: "[ ]", markKeep: "[K]", markDelete: "[D]"}
+
+type tuiGroup struct {
+	equal EqualBlobs
+	marks []tuiMark
+
+	// the index entries of the files, looked up when the group is shown
+	blobs []*Blob
+}
+
+func (g *tuiGroup) wasted() int64 {
+	return g.equal.Size * int64(len(g.equal.Names)-1)
+}
+
+// selection returns the file which is kept as the reference for the confirmation, the first
+// file marked keep or otherwise the first unmarked file, and the files marked for deletion.
+func (g *tuiGroup) selection() (keep string, remove Names) {
+	keepIdx := -1
+	for i, m := range g.marks {
+		if m == markDelete {
+			remove = append(remove, g.equal.Names[i])
+		} else if keepIdx < 0 || (m == markKeep && g.marks[keepIdx] != markKeep) {
+			keepIdx = i
+		}
+	}
+	if keepIdx >= 0 {
+		keep = g.equal.Names[keepIdx]
+	}
+	return keep, remove
+}
+
+// tuiRemoval is a call of removeDuplicates as listed on the confirmation screen.
+type tuiRemoval struct {
+	keep   string
+	remove Names
+	size   int64 // of each file
+}
+
+// removals returns the files to delete of every group with files marked for deletion.
+func (u *tui) removals() (rv []tuiRemoval) {
+	for _, g := range u.groups {
+		if keep, remove := g.selection(); len(remove) > 0 {
+			rv = append(rv, tuiRemoval{keep: keep, remove: remove, size: g.equal.Size})
+		}
+	}
+	return rv
+}
+
+var tuiSorts = []struct {
+	name string
+	less func(a, b *tuiGroup) bool
+}{
+	{"wasted space", func(a, b *tuiGroup) bool { return a.wasted() > b.wasted() }},
+	{"file size", func(a, b *tuiGroup) bool { return a.equal.Size > b.equal.Size }},
+	{"copies", func(a, b *tuiGroup) bool { return len(a.equal.Names) > len(b.equal.Names) }},
+	{"name", func(a, b *tuiGroup) bool { return a.equal.Names[0] < b.equal.Names[0] }},
+}
+
+type tuiUndo struct {
+	group *tuiGroup
+	file  int
+	mark  tuiMark
+}
+
+type tui struct {
+	ctx context.Context
+	idx Index
+	rm  bool
+
+	groups      []*tuiGroup
+	sortBy      int
+	group, file int
+	undo        []tuiUndo
+
+	// the confirmation screen is shown
+	confirm bool
+	scroll  int
+
+	message       string
+	width, height int
+
+	previewName  string
+	previewLines []string
+}
+
+func newTUI(ctx context.Context, idx Index, equalBlobs []EqualBlobs, rm bool) *tui {
+	u := &tui{ctx: ctx, idx: idx, rm: rm}
+	for _, equal := range equalBlobs {
+		u.groups = append(u.groups, &tuiGroup{equal: equal, marks: make([]tuiMark, len(equal.Names))})
+	}
+	u.sort()
+	return u
+}
+
+// run shows the ui until it is left and reports whether the marked files are to be deleted.
+func (u *tui) run(r *bufio.Reader, w io.Writer, fd int) (bool, error) {
+	for {
+		u.width, u.height = 80, 24
+		if width, height, err := termSize(fd); err == nil && width > 0 && height > 0 {
+			u.width, u.height = width, height
+		}
+		if _, err := io.WriteString(w, ansiClear+strings.Join(u.render(), "\r\n")); err != nil {
+			return false, err
+		}
+		key, err := readKey(r)
+		if err != nil {
+			return false, err
+		}
+		u.message = ""
+		if quit, execute := u.handle(key); quit {
+			return execute, nil
+		}
+	}
+}
+
+// readKey reads a key press, special keys are returned by their name.
+func readKey(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch b {
+	case 0x1b:
+		if r.Buffered() == 0 {
+			return "esc", nil
+		}
+		if next, _ := r.ReadByte(); next != '[' && next != 'O' {
+			return "esc", nil
+		}
+		var seq []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			seq = append(seq, c)
+			if c >= 0x40 && c <= 0x7e {
+				break
+			}
+		}
+		return tuiKeys[string(seq)], nil
+	case '\r', '\n':
+		return "enter", nil
+	case ' ':
+		return "space", nil
+	case 3:
+		return "ctrl-c", nil
+	}
+	return string(b), nil
+}
+
+var tuiKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left",
+	"H": "home", "F": "end", "5~": "pgup", "6~": "pgdn",
+}
+
+// handle applies a key press and reports whether the ui is left.
+func (u *tui) handle(key string) (quit, execute bool) {
+	if key == "ctrl-c" {
+		return true, false
+	}
+	if u.confirm {
+		switch key {
+		case "y":
+			return true, true
+		case "n", "esc", "q":
+			u.confirm = false
+		case "up":
+			u.scroll = max(u.scroll-1, 0)
+		case "down":
+			u.scroll++
+		case "pgup":
+			u.scroll = max(u.scroll-u.height/2, 0)
+		case "pgdn":
+			u.scroll += u.height / 2
+		}
+		return false, false
+	}
+
+	g := u.groups[u.group]
+	switch key {
+	case "q", "esc":
+		return true, false
+	case "up":
+		u.file = max(u.file-1, 0)
+	case "down":
+		u.file = min(u.file+1, len(g.equal.Names)-1)
+	case "left", "pgup":
+		u.showGroup(u.group - 1)
+	case "right", "pgdn":
+		u.showGroup(u.group + 1)
+	case "home":
+		u.showGroup(0)
+	case "end":
+		u.showGroup(len(u.groups) - 1)
+	case "s":
+		u.sortBy = (u.sortBy + 1) % len(tuiSorts)
+		u.sort()
+	case "d", "k", "space", "u", "enter":
+		if !u.rm {
+			u.message = "read only, use rm-dups to delete files"
+			break
+		}
+		u.edit(key, g)
+	}
+	return false, false
+}
+
+func (u *tui) edit(key string, g *tuiGroup) {
+	switch key {
+	case "d":
+		u.mark(g, markDelete)
+	case "k":
+		u.mark(g, markKeep)
+	case "space":
+		if g.marks[u.file] == markDelete {
+			u.mark(g, markNone)
+		} else {
+			u.mark(g, markDelete)
+		}
+	case "u":
+		if len(u.undo) == 0 {
+			u.message = "nothing to undo"
+			return
+		}
+		last := u.undo[len(u.undo)-1]
+		u.undo = u.undo[:len(u.undo)-1]
+		last.group.marks[last.file] = last.mark
+		for i, g := range u.groups {
+			if g == last.group {
+				u.group, u.file = i, last.file
+			}
+		}
+	case "enter":
+		if len(u.removals()) > 0 {
+			u.confirm, u.scroll = true, 0
+			return
+		}
+		u.message = "no files are marked for deletion"
+	}
+}
+
+func (u *tui) mark(g *tuiGroup, m tuiMark) {
+	if m == markDelete {
+		kept := 0
+		for i, other := range g.marks {
+			if i != u.file && other != markDelete {
+				kept++
+			}
+		}
+		if kept == 0 {
+			u.message = "at least one copy must be kept"
+			return
+		}
+	}
+	if g.marks[u.file] != m {
+		u.undo = append(u.undo, tuiUndo{group: g, file: u.file, mark: g.marks[u.file]})
+		g.marks[u.file] = m
+	}
+	u.file = min(u.file+1, len(g.marks)-1)
+}
+
+func (u *tui) showGroup(i int) {
+	if i >= 0 && i < len(u.groups) && i != u.group {
+		u.group, u.file = i, 0
+	}
+}
+
+// sort sorts the groups and keeps the current group selected.
+func (u *tui) sort() {
+	var current *tuiGroup
+	if u.group < len(u.groups) {
+		current = u.groups[u.group]
+	}
+	less := tuiSorts[u.sortBy].less
+	sort.SliceStable(u.groups, func(i, j int) bool { return less(u.groups[i], u.groups[j]) })
+	for i, g := range u.groups {
+		if g == current {
+			u.group = i
+		}
+	}
+}
+
+// render returns the lines of the screen.
+func (u *tui) render() []string {
+	var lines []string
+	var help string
+	if u.confirm {
+		lines = u.renderConfirm()
+		help = "y delete  n back  ↑↓ scroll"
+	} else {
+		lines = u.renderGroup()
+		help = "↑↓ file  ←→ group  s sort  q quit"
+		if u.rm {
+			help = "↑↓ file  ←→ group  d delete  k keep  space toggle  u undo  s sort  enter confirm  q quit"
+		}
+	}
+	body := u.height - 2
+	if len(lines) > body {
+		lines = lines[:body]
+	}
+	for len(lines) < body {
+		lines = append(lines, "")
+	}
+	for i, line := range lines {
+		lines[i] = truncate(line, u.width)
+	}
+	return append(lines, truncate(u.message, u.width), ansiReverse+pad(help, u.width)+ansiReset)
+}
+
+func (u *tui) renderGroup() []string {
+	g := u.groups[u.group]
+	if g.blobs == nil {
+		g.blobs = make([]*Blob, len(g.equal.Names))
+		for i, name := range g.equal.Names {
+			g.blobs[i], _ = u.idx.LookupByName(u.ctx, name)
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("group %d/%d: %d copies of %s, %s wasted, sorted by %s", u.group+1, len(u.groups),
+			len(g.equal.Names), formatSize(g.equal.Size), formatSize(g.wasted()), tuiSorts[u.sortBy].name),
+		"",
+		fmt.Sprintf("      %-16s  %-16s  %s", "modified", "indexed", "name"),
+	}
+
+	// the files around the cursor, the rest of the screen shows the preview
+	rows := max((u.height-8)/2, 3)
+	first := min(max(u.file-rows/2, 0), max(len(g.equal.Names)-rows, 0))
+	for i := first; i < len(g.equal.Names) && i < first+rows; i++ {
+		cursor := " "
+		if i == u.file {
+			cursor = ">"
+		}
+		mtime, itime := "(not indexed)", ""
+		if b := g.blobs[i]; b != nil {
+			mtime, itime = b.ModTime.Local().Format(tuiTimeFormat), b.IndexTime.Local().Format(tuiTimeFormat)
+		}
+		prefix := fmt.Sprintf("%s %s %-16s  %-16s  ", cursor, tuiMarks[g.marks[i]], mtime, itime)
+		line := prefix + truncateLeft(displayName(g.equal.Names[i]), u.width-len(prefix))
+		if i == u.file {
+			line = ansiReverse + pad(line, u.width) + ansiReset
+		}
+		lines = append(lines, line)
+	}
+	if first+rows < len(g.equal.Names) {
+		lines = append(lines, fmt.Sprintf("  ... %d more", len(g.equal.Names)-first-rows))
+	}
+
+	name := g.equal.Names[u.file]
+	lines = append(lines, "", "preview of "+displayName(name)+":")
+	return append(lines, u.preview(name)...)
+}
+
+// preview returns the first lines of a text file or a hex dump of the start of a binary file.
+func (u *tui) preview(name string) []string {
+	if name == u.previewName {
+		return u.previewLines
+	}
+	u.previewName, u.previewLines = name, nil
+	path, online := volumes.Path(name)
+	if !online {
+		u.previewLines = []string{"  (volume not mounted)"}
+		return u.previewLines
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		u.previewLines = []string{"  " + err.Error()}
+		return u.previewLines
+	}
+	defer f.Close()
+	buf := make([]byte, tuiPreviewBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		u.previewLines = []string{"  " + err.Error()}
+		return u.previewLines
+	}
+	buf = buf[:n]
+
+	// a multi-byte character may be cut at the end of a full buffer
+	text := buf
+	for i := 0; n == tuiPreviewBytes && i < utf8.UTFMax-1; i++ {
+		if r, size := utf8.DecodeLastRune(text); r != utf8.RuneError || size != 1 {
+			break
+		}
+		text = text[:len(text)-1]
+	}
+	if utf8.Valid(text) && !bytes.ContainsRune(text, 0) {
+		for _, line := range strings.Split(string(text), "\n") {
+			u.previewLines = append(u.previewLines, "  "+printable(line))
+		}
+		return u.previewLines
+	}
+	for i := 0; i < len(buf); i += tuiPreviewHexLen {
+		u.previewLines = append(u.previewLines, fmt.Sprintf("  %08x  % x", i, buf[i:min(i+tuiPreviewHexLen, len(buf))]))
+	}
+	return u.previewLines
+}
+
+func (u *tui) renderConfirm() []string {
+	var lines []string
+	var files int
+	var size int64
+	for _, r := range u.removals() {
+		lines = append(lines, "keep    "+displayName(r.keep))
+		for _, name := range r.remove {
+			lines = append(lines, "delete  "+displayName(name))
+		}
+		lines = append(lines, "")
+		files += len(r.remove)
+		size += r.size * int64(len(r.remove))
+	}
+	u.scroll = min(u.scroll, max(len(lines)-1, 0))
+	header := []string{
+		fmt.Sprintf("delete %d files, %s? the files are compared to the kept copies first.", files, formatSize(size)),
+		"",
+	}
+	return append(header, lines[u.scroll:]...)
+}
+
+// printable replaces tabs and control characters.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r < ' ' || r == 0x7f:
+			return '.'
+		}
+		return r
+	}, s)
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if strings.HasPrefix(s, ansiReverse) || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:max(n, 0)])
+}
+
+// truncateLeft shortens s to at most n characters by replacing its beginning with "...".
+func truncateLeft(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string(r[len(r)-max(n, 0):])
+	}
+	return "..." + string(r[len(r)-n+3:])
+}
+
+// pad fills s with spaces to n characters.
+func pad(s string, n int) string {
+	if c := utf8.RuneCountInString(s); c < n {
+		return s + strings.Repeat(" ", n-c)
+	}
+	return truncate(s, n)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	. "github.com/phicode/blkidx"
+)
+
+func newTestTUI(rm bool) *tui {
+	u := newTUI(context.Background(), nil, []EqualBlobs{
+		{Names: Names{"/a/1", "/a/2", "/a/3"}, Size: 10},
+		{Names: Names{"/b/1", "/b/2"}, Size: 1},
+	}, rm)
+	u.width, u.height = 80, 24
+	return u
+}
+
+func (u *tui) keys(keys ...string) {
+	for _, key := range keys {
+		u.handle(key)
+	}
+}
+
+func TestTUIKeepsOneCopy(t *testing.T) {
+	u := newTestTUI(true)
+	u.keys("d", "d", "d")
+	if got, want := u.groups[0].marks, []tuiMark{markDelete, markDelete, markNone}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want marks %v; got %v", want, got)
+	}
+	if u.message == "" {
+		t.Error("want a message when the last copy is marked for deletion")
+	}
+
+	// toggling the last copy is refused as well
+	u.keys("space")
+	if u.groups[0].marks[2] != markNone {
+		t.Error("last copy marked for deletion by space")
+	}
+	keep, remove := u.groups[0].selection()
+	if keep != "/a/3" || !reflect.DeepEqual(remove, Names{"/a/1", "/a/2"}) {
+		t.Errorf("want /a/3 kept; got %q, %v", keep, remove)
+	}
+}
+
+func TestTUIUndo(t *testing.T) {
+	u := newTestTUI(true)
+	u.keys("k", "d", "up")
+	if got, want := u.groups[0].marks, []tuiMark{markKeep, markDelete, markNone}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want marks %v; got %v", want, got)
+	}
+	// space removes the delete mark, undo restores it
+	u.keys("space", "u")
+	if u.groups[0].marks[1] != markDelete || u.file != 1 {
+		t.Errorf("want the delete mark of file 1 restored; got %v at file %d", u.groups[0].marks, u.file)
+	}
+	u.keys("u")
+	if u.groups[0].marks[1] != markNone {
+		t.Errorf("want file 1 unmarked; got %v", u.groups[0].marks)
+	}
+	u.keys("u", "u")
+	if got, want := u.groups[0].marks, []tuiMark{markNone, markNone, markNone}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want marks %v; got %v", want, got)
+	}
+	if u.message == "" {
+		t.Error("want a message when there is nothing to undo")
+	}
+}
+
+func TestTUIReadOnly(t *testing.T) {
+	u := newTestTUI(false)
+	u.keys("d", "k", "enter")
+	if len(u.removals()) != 0 || u.confirm {
+		t.Errorf("files marked in read only mode: %v", u.groups[0].marks)
+	}
+}
+
+func TestTUIConfirm(t *testing.T) {
+	u := newTestTUI(true)
+	u.keys("enter")
+	if u.confirm {
+		t.Fatal("confirmation shown without files marked for deletion")
+	}
+	// keep /a/2 and delete /a/1 and /a/3, delete /b/2
+	u.keys("d", "k", "d", "right", "down", "d", "enter")
+	if !u.confirm {
+		t.Fatal("confirmation not shown")
+	}
+	want := []tuiRemoval{
+		{keep: "/a/2", remove: Names{"/a/1", "/a/3"}, size: 10},
+		{keep: "/b/1", remove: Names{"/b/2"}, size: 1},
+	}
+	if got := u.removals(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want removals %+v; got %+v", want, got)
+	}
+	wantLines := []string{
+		"delete 3 files, 21 bytes? the files are compared to the kept copies first.",
+		"",
+		"keep    /a/2",
+		"delete  /a/1",
+		"delete  /a/3",
+		"",
+		"keep    /b/1",
+		"delete  /b/2",
+		"",
+	}
+	if got := u.renderConfirm(); !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("want confirmation %q; got %q", wantLines, got)
+	}
+
+	u.keys("n")
+	if u.confirm {
+		t.Error("confirmation not left")
+	}
+	if quit, execute := u.handle("enter"); quit || execute {
+		t.Error("enter executed without confirmation")
+	}
+	if quit, execute := u.handle("y"); !quit || !execute {
+		t.Error("y did not execute")
+	}
+}
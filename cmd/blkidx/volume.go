@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	. "github.com/phicode/blkidx"
+)
+
+var flagVolumeMarker = flag.Bool("volume-marker", false,
+	"identify new volumes by a marker file even if they are mount points with a file system uuid")
+
+func volume(ctx context.Context, idx Index, args []string) (found bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch {
+	case args[0] == "add" && len(args) == 3:
+		return true, addVolume(ctx, idx, args[1], args[2])
+
+	case args[0] == "list" && len(args) == 1:
+		return true, listVolumes(ctx, idx)
+
+	case args[0] == "remove" && len(args) == 2:
+		return true, idx.RemoveVolume(ctx, args[1])
+	}
+	return false, nil
+}
+
+func addVolume(ctx context.Context, idx Index, name, root string) error {
+	v, err := NewVolume(name, root, *flagVolumeMarker)
+	if err != nil {
+		return err
+	}
+	renamed, err := RegisterVolume(ctx, idx, v)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("volume %q registered at %s with id %s\n", v.Name, v.Root, v.ID)
+	fmt.Fprintln(os.Stderr, "files moved to the volume:", renamed)
+	return nil
+}
+
+func listVolumes(ctx context.Context, idx Index) error {
+	vols, err := LoadVolumes(ctx, idx)
+	if err != nil {
+		return err
+	}
+	for _, v := range vols.Volumes() {
+		r := &record{Name: v.Name, Path: v.Root, Status: "offline", Detail: v.ID}
+		location := "offline, last seen at " + v.Root
+		if vols.Online(v.Name) {
+			r.Status = "online"
+			location = "mounted at " + v.Root
+		}
+		out.emit(r, fmt.Sprintf("%s\t%s\t%s", v.Name, v.ID, location))
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package blkidx
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ConfirmResult is the outcome of re-checking a group of duplicates on disk.
+type ConfirmResult struct {
+	// files which are missing from the index or the file system, or whose size or
+	// modification time no longer match their index entry
+	Stale Names
+
+	// files whose content differs from the copy which is kept
+	Mismatched Names
+
+	// files which are the copy which is kept under another path, e.g. through a symbolic
+	// link, a bind mount or a hard link. deleting them would delete the kept copy or
+	// free no space.
+	Same Names
+
+	// blobs on volumes which are not mounted
+	Offline Names
+
+	// entries of a directory which are not indexed regular files, e.g. new files or
+	// symbolic links, see ConfirmDirDuplicates
+	Unindexed Names
+}
+
+// OK reports whether all files have been confirmed to be exact duplicates.
+func (r *ConfirmResult) OK() bool {
+	return len(r.Stale) == 0 && len(r.Mismatched) == 0 && len(r.Same) == 0 &&
+		len(r.Offline) == 0 && len(r.Unindexed) == 0
+}
+
+func (r *ConfirmResult) merge(o *ConfirmResult) {
+	r.Stale = append(r.Stale, o.Stale...)
+	r.Mismatched = append(r.Mismatched, o.Mismatched...)
+	r.Same = append(r.Same, o.Same...)
+	r.Offline = append(r.Offline, o.Offline...)
+	r.Unindexed = append(r.Unindexed, o.Unindexed...)
+}
+
+// ConfirmDuplicates re-checks a group of blobs which the index reports as equal before
+// the files of the blobs in remove are deleted. The files of keep and of all blobs in
+// remove are stat-ed and checked against their index entries, then each file in remove
+// must be another file than keep and is compared byte by byte to keep. Blob names are resolved to files through vols.
+// The returned error indicates a failure to perform the checks, a failed check is only
+// reported through the result.
+func ConfirmDuplicates(ctx context.Context, idx Index, vols *VolumeSet, keep string, remove Names) (*ConfirmResult, error) {
+	result := new(ConfirmResult)
+
+	for _, name := range append(Names{keep}, remove...) {
+		if _, online := vols.Path(name); !online {
+			result.Offline = append(result.Offline, name)
+			continue
+		}
+		stale, err := isStale(ctx, idx, vols, name)
+		if err != nil {
+			return nil, err
+		}
+		if stale {
+			result.Stale = append(result.Stale, name)
+		}
+	}
+	if len(result.Stale) > 0 || len(result.Offline) > 0 {
+		return result, nil
+	}
+
+	keepPath, _ := vols.Path(keep)
+	keepInfo, err := os.Stat(keepPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range remove {
+		path, _ := vols.Path(name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if os.SameFile(keepInfo, info) {
+			result.Same = append(result.Same, name)
+			continue
+		}
+		equal, err := CompareFiles(ctx, keepPath, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal {
+			result.Mismatched = append(result.Mismatched, name)
+		}
+	}
+	return result, nil
+}
+
+// ConfirmDirDuplicates re-checks a directory which the index reports as a duplicate of keep
+// before the directory remove is deleted. Every indexed file below remove must have a copy under
+// the same relative name below keep, which is checked as by ConfirmDuplicates, and no other files
+// may exist below remove. The names of the indexed files below remove are returned.
+func ConfirmDirDuplicates(ctx context.Context, idx Index, vols *VolumeSet, keep, remove string) (*ConfirmResult, Names, error) {
+	result := new(ConfirmResult)
+	for _, dir := range []string{keep, remove} {
+		if _, online := vols.Path(dir); !online {
+			result.Offline = append(result.Offline, dir)
+		}
+	}
+	if len(result.Offline) > 0 {
+		return result, nil, nil
+	}
+	kept, err := idx.Query(ctx, &Query{Under: Names{keep}})
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err := idx.Query(ctx, &Query{Under: Names{remove}})
+	if err != nil {
+		return nil, nil, err
+	}
+	keepByPath := make(map[string]*Blob, len(kept))
+	for _, blob := range kept {
+		keepByPath[relativeName(blob.Name, keep)] = blob
+	}
+
+	var names Names
+	indexed := make(map[string]bool, len(removed))
+	for _, blob := range removed {
+		names = append(names, blob.Name)
+		path, _ := vols.Path(blob.Name)
+		indexed[path] = true
+		k := keepByPath[relativeName(blob.Name, remove)]
+		if k == nil || !k.EqualHash(blob) {
+			result.Mismatched = append(result.Mismatched, blob.Name)
+			continue
+		}
+		r, err := ConfirmDuplicates(ctx, idx, vols, k.Name, Names{blob.Name})
+		if err != nil {
+			return nil, nil, err
+		}
+		result.merge(r)
+	}
+
+	// symbolic links, devices, pipes and sockets are never indexed but would be deleted as well
+	removePath, _ := vols.Path(remove)
+	err = filepath.WalkDir(removePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() && (!d.Type().IsRegular() || !indexed[path]) {
+			result.Unindexed = append(result.Unindexed, vols.Name(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, names, nil
+}
+
+func isStale(ctx context.Context, idx Index, vols *VolumeSet, name string) (bool, error) {
+	blob, err := idx.LookupByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	path, _ := vols.Path(name)
+	if blob == nil {
+		return true, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return !info.Mode().IsRegular() || blob.HasChangedStamp(NewFileStamp(info), false), nil
+}
+
+const compareBufferSize = 1 << 20
+
+// CompareFiles reports whether two files have exactly the same content.
+func CompareFiles(ctx context.Context, a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	ia, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	ib, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if ia.Size() != ib.Size() {
+		return false, nil
+	}
+	if os.SameFile(ia, ib) {
+		return true, nil
+	}
+
+	ra := &contextReader{ctx: ctx, r: fa}
+	rb := &contextReader{ctx: ctx, r: fb}
+	bufa := make([]byte, compareBufferSize)
+	bufb := make([]byte, compareBufferSize)
+	for {
+		na, erra := io.ReadFull(ra, bufa)
+		nb, errb := io.ReadFull(rb, bufb)
+		if erra != nil && erra != io.EOF && erra != io.ErrUnexpectedEOF {
+			return false, erra
+		}
+		if errb != nil && errb != io.EOF && errb != io.ErrUnexpectedEOF {
+			return false, errb
+		}
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra != nil || errb != nil {
+			// at least one file ended, both must have ended at the same time
+			return erra != nil && errb != nil, nil
+		}
+	}
+}
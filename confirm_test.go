@@ -0,0 +1,218 @@
+package blkidx
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfirmDuplicates(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	idx := NewMemoryIndex()
+	a := writeIndexed(t, idx, filepath.Join(dir, "a"), "same")
+	b := writeIndexed(t, idx, filepath.Join(dir, "b"), "same")
+	c := writeIndexed(t, idx, filepath.Join(dir, "c"), "same")
+
+	result, err := ConfirmDuplicates(ctx, idx, nil, a, Names{b, c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() {
+		t.Errorf("want confirmed duplicates; got %+v", result)
+	}
+
+	// same size and modification time, different content
+	info, _ := os.Stat(c)
+	if err := os.WriteFile(c, []byte("diff"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(c, info.ModTime(), info.ModTime())
+	result, err = ConfirmDuplicates(ctx, idx, nil, a, Names{b, c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Stale) != 0 || len(result.Mismatched) != 1 || result.Mismatched[0] != c {
+		t.Errorf("want %q mismatched; got %+v", c, result)
+	}
+
+	// modified after indexing
+	if err := os.WriteFile(b, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(c)
+	result, err = ConfirmDuplicates(ctx, idx, nil, a, Names{b, c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Stale) != 2 || result.OK() {
+		t.Errorf("want 2 stale entries; got %+v", result)
+	}
+}
+
+func TestConfirmDirDuplicates(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	idx := NewMemoryIndex()
+	keep, remove := filepath.Join(dir, "keep"), filepath.Join(dir, "remove")
+	for _, d := range []string{keep, remove} {
+		writeIndexed(t, idx, filepath.Join(d, "a"), "a")
+		writeIndexed(t, idx, filepath.Join(d, "sub", "b"), "b")
+	}
+	writeIndexed(t, idx, filepath.Join(keep, "only-kept"), "k")
+
+	result, names, err := ConfirmDirDuplicates(ctx, idx, nil, keep, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() || len(names) != 2 {
+		t.Errorf("want confirmed duplicates with 2 files; got %+v, %q", result, names)
+	}
+
+	// files which are not indexed or have no copy in keep
+	unindexed := filepath.Join(remove, "sub", "new")
+	os.WriteFile(unindexed, []byte("new"), 0644)
+	onlyRemoved := writeIndexed(t, idx, filepath.Join(remove, "only-removed"), "r")
+	result, _, err = ConfirmDirDuplicates(ctx, idx, nil, keep, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Unindexed) != 1 || result.Unindexed[0] != unindexed ||
+		len(result.Mismatched) != 1 || result.Mismatched[0] != onlyRemoved {
+		t.Errorf("want %q unindexed and %q mismatched; got %+v", unindexed, onlyRemoved, result)
+	}
+}
+
+func TestConfirmDirDuplicatesSpecialFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	idx := NewMemoryIndex()
+	keep, remove := filepath.Join(dir, "keep"), filepath.Join(dir, "remove")
+	for _, d := range []string{keep, remove} {
+		writeIndexed(t, idx, filepath.Join(d, "a"), "a")
+	}
+	var want Names
+	link := filepath.Join(remove, "link")
+	if err := os.Symlink(filepath.Join(keep, "a"), link); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+	want = append(want, link)
+	sock := filepath.Join(remove, "sock")
+	if l, err := net.Listen("unix", sock); err == nil {
+		defer l.Close()
+		want = append(want, sock)
+	}
+	// an indexed file which was replaced by a symbolic link
+	replaced := filepath.Join(remove, "a")
+	os.Remove(replaced)
+	if err := os.Symlink(filepath.Join(keep, "a"), replaced); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, replaced)
+	want.Sort()
+
+	result, _, err := ConfirmDirDuplicates(ctx, idx, nil, keep, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := append(Names(nil), result.Unindexed...)
+	got.Sort()
+	if result.OK() || !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q unindexed; got %+v", want, result)
+	}
+}
+
+func TestCompareFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"", "", true},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "abcd", false},
+	} {
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		os.WriteFile(a, []byte(tc.a), 0644)
+		os.WriteFile(b, []byte(tc.b), 0644)
+		equal, err := CompareFiles(ctx, a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equal != tc.equal {
+			t.Errorf("%q and %q - want %v; got %v", tc.a, tc.b, tc.equal, equal)
+		}
+	}
+}
+
+func writeIndexed(t *testing.T, idx Index, name, content string) string {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a fixed modification time makes content changes undetectable by size and mtime
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	blob, err := IndexFile(ctx, name, IndexConfig{HashAlgorithm: DefaultHashAlgorithm, BlockSizes: DefaultHashBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Store(ctx, blob); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestConfirmDuplicatesSameFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	idx := NewMemoryIndex()
+	target := writeIndexed(t, idx, filepath.Join(dir, "real", "a"), "same")
+	if err := os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "link")); err != nil {
+		t.Skip(err)
+	}
+	// the same file through a symbolically linked parent directory
+	link := filepath.Join(dir, "link", "a")
+	blob, _ := idx.LookupByName(ctx, target)
+	linked := *blob
+	linked.Name = link
+	if err := idx.Store(ctx, &linked); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ConfirmDuplicates(ctx, idx, nil, target, Names{link})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK() || len(result.Same) != 1 || result.Same[0] != link {
+		t.Errorf("want %q reported as the same file; got %+v", link, result)
+	}
+
+	// another hard link to the kept file
+	hard := filepath.Join(dir, "hard")
+	if err := os.Link(target, hard); err != nil {
+		t.Skip(err)
+	}
+	linked.Name = hard
+	if err := idx.Store(ctx, &linked); err != nil {
+		t.Fatal(err)
+	}
+	result, err = ConfirmDuplicates(ctx, idx, nil, target, Names{hard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK() || len(result.Same) != 1 {
+		t.Errorf("want %q reported as the same file; got %+v", hard, result)
+	}
+}
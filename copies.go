@@ -0,0 +1,87 @@
+package blkidx
+
+import (
+	"context"
+	"sort"
+)
+
+// Copy is a blob of the index which has the same content as another file,
+// or which shares some of its hashed blocks.
+type Copy struct {
+	*Blob
+
+	// true if the full content is equal
+	Full bool
+
+	// the number of hashed blocks of the copy which are also blocks of the other file
+	SharedBlocks int
+}
+
+// FindCopies returns the blobs of the index which have the same content as blob.
+// A blob by the same name as blob is not a copy of itself.
+// If partial is set, blobs which share at least one hashed block with blob are returned
+// as well. Full copies are ordered by name and precede partial copies, which are
+// ordered by descending number of shared blocks.
+func FindCopies(ctx context.Context, idx Index, blob *Blob, partial bool) ([]Copy, error) {
+	full, err := idx.LookupByHash(ctx, blob.Hash)
+	if err != nil {
+		return nil, err
+	}
+	var rv []Copy
+	seen := make(map[string]bool, len(full)+1)
+	seen[blob.Name] = true
+	for _, b := range full {
+		if !seen[b.Name] {
+			seen[b.Name] = true
+			rv = append(rv, Copy{Blob: b, Full: true, SharedBlocks: len(b.HashedBlocks)})
+		}
+	}
+	if !partial || len(blob.HashedBlocks) == 0 {
+		return rv, nil
+	}
+
+	similar, err := idx.LookupByBlockHashes(ctx, blob.HashAlgorithm, blob.HashBlockSize, blob.HashedBlocks)
+	if err != nil {
+		return nil, err
+	}
+	set := newHashSet(blob.HashedBlocks)
+	var partials []Copy
+	for _, b := range similar {
+		if !seen[b.Name] {
+			seen[b.Name] = true
+			partials = append(partials, Copy{Blob: b, SharedBlocks: set.count(b.HashedBlocks)})
+		}
+	}
+	sort.SliceStable(partials, func(i, j int) bool { return partials[i].SharedBlocks > partials[j].SharedBlocks })
+	return append(rv, partials...), nil
+}
+
+type hashSet map[string]struct{}
+
+func newHashSet(hashes [][]byte) hashSet {
+	s := make(hashSet, len(hashes))
+	for _, h := range hashes {
+		s[string(h)] = struct{}{}
+	}
+	return s
+}
+
+func (s hashSet) containsAny(hashes [][]byte) bool {
+	for _, h := range hashes {
+		if _, found := s[string(h)]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns how many of hashes are in the set
+func (s hashSet) count(hashes [][]byte) int {
+	var n int
+	for _, h := range hashes {
+		if _, found := s[string(h)]; found {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+package blkidx
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindCopies(t *testing.T) {
+	ctx := context.Background()
+	for backend, idx := range testIndexes(t) {
+		t.Run(backend, func(t *testing.T) {
+			self := storeContent(t, idx, "/a/self", "aaaabbbbcccc")
+			storeContent(t, idx, "/b/copy", "aaaabbbbcccc")
+			storeContent(t, idx, "/a/copy", "aaaabbbbcccc")
+			storeContent(t, idx, "/c/one", "xxxxbbbbyyyy")
+			storeContent(t, idx, "/c/two", "aaaaxxxxcccc")
+			storeContent(t, idx, "/c/none", "xxxxyyyyzzzz")
+
+			copies, err := FindCopies(ctx, idx, self, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := copyNames(copies); got != "/a/copy /b/copy" {
+				t.Errorf("full copies - got %q", got)
+			}
+
+			copies, err = FindCopies(ctx, idx, self, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := copyNames(copies); got != "/a/copy /b/copy /c/two /c/one" {
+				t.Errorf("partial copies - got %q", got)
+			}
+			if c := copies[2]; c.Full || c.SharedBlocks != 2 {
+				t.Errorf("want 2 shared blocks; got %+v", c)
+			}
+		})
+	}
+}
+
+func storeContent(t *testing.T, idx Index, name, content string) *Blob {
+	blob := &Blob{
+		Name:          name,
+		IndexTime:     time.Now().UTC(),
+		ModTime:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		HashAlgorithm: DefaultHashAlgorithm,
+		HashBlockSize: 4,
+	}
+	var err error
+	blob.Hash, blob.HashedBlocks, blob.Size, err = HashAll(context.Background(),
+		strings.NewReader(content), blob.HashAlgorithm, blob.HashBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.Store(context.Background(), blob); err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func copyNames(copies []Copy) string {
+	var names []string
+	for _, c := range copies {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, " ")
+}
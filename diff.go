@@ -0,0 +1,151 @@
+package blkidx
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiffPair is a file which exists on both sides of a diff with equal content.
+// A and B are the paths relative to the compared roots, they differ if the file
+// has been moved or renamed.
+type DiffPair struct {
+	A, B string
+}
+
+// DiffResult is the difference between two trees of indexed files.
+// All paths are slash separated and relative to the compared roots.
+type DiffResult struct {
+	// files whose content exists on both sides
+	Both []DiffPair
+
+	// files which exist on both sides under the same path but with different content
+	Changed []string
+
+	// files which exist on both sides under the same path but have been hashed with
+	// different hash algorithms, so their content can not be compared
+	Incomparable []string
+
+	// files whose content only exists on one side
+	OnlyA, OnlyB []string
+}
+
+// Differences returns the number of files which are changed, incomparable or only on one side.
+// Moved files are not counted.
+func (r *DiffResult) Differences() int {
+	return len(r.Changed) + len(r.Incomparable) + len(r.OnlyA) + len(r.OnlyB)
+}
+
+// Equal reports whether both sides contain the same content under the same paths.
+func (r *DiffResult) Equal() bool {
+	if r.Differences() > 0 {
+		return false
+	}
+	for _, p := range r.Both {
+		if p.A != p.B {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff compares the blobs of index a below the name rootA with the blobs of index b
+// below the name rootB. Only the stored hashes are compared, no file is read.
+// Blobs are only equal if they have been hashed with the same hash algorithm.
+// a and b may be the same index.
+func Diff(ctx context.Context, a Index, rootA string, b Index, rootB string) (*DiffResult, error) {
+	sideA, err := loadDiffSide(ctx, a, rootA)
+	if err != nil {
+		return nil, err
+	}
+	sideB, err := loadDiffSide(ctx, b, rootB)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(DiffResult)
+	paired := make(map[string]bool) // paths of b which are part of a pair
+	for _, rel := range sideA.paths {
+		blobA := sideA.byPath[rel]
+		blobB, found := sideB.byPath[rel]
+		switch {
+		case found && blobA.HashAlgorithm != blobB.HashAlgorithm:
+			r.Incomparable = append(r.Incomparable, rel)
+			paired[rel] = true
+		case found && blobA.EqualHash(blobB):
+			r.Both = append(r.Both, DiffPair{A: rel, B: rel})
+			paired[rel] = true
+		case found:
+			r.Changed = append(r.Changed, rel)
+			paired[rel] = true
+		case len(sideB.byHash[diffHashKey(blobA)]) > 0:
+			relB := sideB.byHash[diffHashKey(blobA)][0]
+			r.Both = append(r.Both, DiffPair{A: rel, B: relB})
+			paired[relB] = true
+		default:
+			r.OnlyA = append(r.OnlyA, rel)
+		}
+	}
+	for _, rel := range sideB.paths {
+		if paired[rel] {
+			continue
+		}
+		blobB := sideB.byPath[rel]
+		if relsA := sideA.byHash[diffHashKey(blobB)]; len(relsA) > 0 {
+			r.Both = append(r.Both, DiffPair{A: relsA[0], B: rel})
+		} else {
+			r.OnlyB = append(r.OnlyB, rel)
+		}
+	}
+	return r, nil
+}
+
+type diffSide struct {
+	paths  []string            // sorted
+	byPath map[string]*Blob    // by relative path
+	byHash map[string][]string // relative paths by diffHashKey
+}
+
+// diffHashKey returns the key of the content of a blob, which includes the hash algorithm.
+func diffHashKey(b *Blob) string {
+	return string(binary.AppendUvarint(nil, uint64(b.HashAlgorithm))) + string(b.Hash)
+}
+
+func loadDiffSide(ctx context.Context, idx Index, root string) (*diffSide, error) {
+	blobs, err := idx.Query(ctx, &Query{Under: Names{root}})
+	if err != nil {
+		return nil, err
+	}
+	s := &diffSide{
+		byPath: make(map[string]*Blob),
+		byHash: make(map[string][]string),
+	}
+	for _, blob := range blobs {
+		rel := relativeName(blob.Name, root)
+		s.paths = append(s.paths, rel)
+		s.byPath[rel] = blob
+	}
+	sort.Strings(s.paths)
+	for _, rel := range s.paths {
+		key := diffHashKey(s.byPath[rel])
+		s.byHash[key] = append(s.byHash[key], rel)
+	}
+	return s, nil
+}
+
+// relativeName returns the slash separated path of the blob name relative to root,
+// which must be a parent of name or name itself.
+func relativeName(name, root string) string {
+	var rel string
+	if strings.HasPrefix(root, VolumeNamePrefix) {
+		rel = strings.TrimPrefix(name[len(root):], "/")
+	} else if r, err := filepath.Rel(root, name); err == nil {
+		rel = filepath.ToSlash(r)
+	}
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
@@ -0,0 +1,98 @@
+package blkidx
+
+import (
+	"context"
+	"crypto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	a := NewMemoryIndex()
+	storeContent(t, a, "/data/same", "same")
+	storeContent(t, a, "/data/dir/moved", "moved")
+	storeContent(t, a, "/data/changed", "old")
+	storeContent(t, a, "/data/only-a", "only a")
+	storeContent(t, a, "/database/other", "outside of the root")
+
+	b := NewMemoryIndex()
+	storeContent(t, b, "vol:backup/data/same", "same")
+	storeContent(t, b, "vol:backup/data/moved", "moved")
+	storeContent(t, b, "vol:backup/data/changed", "new")
+	storeContent(t, b, "vol:backup/data/only-b", "only b")
+	storeContent(t, b, "vol:backup/data/copy", "same")
+
+	r, err := Diff(ctx, a, "/data", b, "vol:backup/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DiffResult{
+		Both: []DiffPair{
+			{"dir/moved", "moved"},
+			{"same", "same"},
+			{"same", "copy"},
+		},
+		Changed: []string{"changed"},
+		OnlyA:   []string{"only-a"},
+		OnlyB:   []string{"only-b"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("want %+v; got %+v", want, r)
+	}
+	if r.Equal() {
+		t.Error("diff with differences is equal")
+	}
+
+	r, err = Diff(ctx, b, "vol:backup/data/same", b, "vol:backup/data/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Equal() || len(r.Both) != 1 {
+		t.Errorf("want equal files; got %+v", r)
+	}
+}
+
+func TestDiffHashAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	a := NewMemoryIndex()
+	storeContent(t, a, "/data/same", "same")
+	storeContent(t, a, "/data/moved", "moved")
+
+	b := NewMemoryIndex()
+	for name, content := range map[string]string{"/backup/same": "same", "/backup/dir/moved": "moved"} {
+		blob := &Blob{
+			Name:          name,
+			IndexTime:     time.Now().UTC(),
+			ModTime:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			HashAlgorithm: crypto.SHA256,
+			HashBlockSize: 4,
+		}
+		var err error
+		blob.Hash, blob.HashedBlocks, blob.Size, err = HashAll(ctx, strings.NewReader(content), blob.HashAlgorithm, blob.HashBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.Store(ctx, blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := Diff(ctx, a, "/data", b, "/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DiffResult{
+		Incomparable: []string{"same"},
+		OnlyA:        []string{"moved"},
+		OnlyB:        []string{"dir/moved"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("want %+v; got %+v", want, r)
+	}
+	if r.Differences() != 3 || r.Equal() {
+		t.Errorf("want 3 differences; got %d", r.Differences())
+	}
+}
@@ -0,0 +1,321 @@
+package blkidx
+
+import (
+	"context"
+	"crypto/sha256"
+	"sort"
+)
+
+// DirGroup is a group of directories with identical trees: they contain the same
+// names with the same content, recursively.
+type DirGroup struct {
+	Dirs Names
+
+	// the number of files and bytes of each directory
+	Files, Size int64
+}
+
+// SimilarDirs is a pair of directories whose trees share most of their content.
+type SimilarDirs struct {
+	A, B string
+
+	// the bytes of the content which exists in both trees, regardless of the names
+	Common int64
+
+	SizeA, SizeB int64
+
+	// 2 * Common / (SizeA + SizeB), 1 if both trees have the same content under different names
+	Similarity float64
+}
+
+// DirDuplicates are the duplicated directories of an index. Duplicates which are part of
+// duplicated parent directories are omitted.
+type DirDuplicates struct {
+	// largest first
+	Identical []DirGroup
+
+	// most similar first
+	Similar []SimilarDirs
+}
+
+// content which exists more often is ignored when looking for similar directories
+const dirMaxCandidateCopies = 64
+
+// FindDuplicateDirs finds directories with identical trees and, if minSimilarity is
+// greater than 0, pairs of directories which are at least minSimilarity similar.
+// Directories contain the indexed files below them. Empty files are part of identical
+// trees but do not make directories similar.
+func FindDuplicateDirs(ctx context.Context, idx Index, minSimilarity float64) (*DirDuplicates, error) {
+	t := newDirTree()
+	byHash := make(map[string][]*dirNode)
+	err := idx.ForEach(ctx, func(blob *Blob) error {
+		if n := t.addFile(blob); n != nil && blob.Size > 0 {
+			byHash[string(blob.Hash)] = append(byHash[string(blob.Hash)], n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range t.roots {
+		root.finish()
+	}
+
+	r := new(DirDuplicates)
+	groupOf := t.identical(r)
+	if minSimilarity > 0 {
+		t.similar(r, byHash, groupOf, minSimilarity)
+	}
+	return r, nil
+}
+
+type dirNode struct {
+	name   string
+	parent *dirNode
+	dirs   []*dirNode
+	files  []dirFile
+
+	count, size int64  // of the files of the tree
+	digest      string // of the names and contents of the tree
+
+	// the content of the tree by hash, computed on demand
+	contents map[string]dirContent
+}
+
+type dirFile struct {
+	base string
+	hash []byte
+	size int64
+}
+
+type dirContent struct {
+	n, size int64
+}
+
+type dirTree struct {
+	nodes map[string]*dirNode
+	roots []*dirNode
+}
+
+func newDirTree() *dirTree {
+	return &dirTree{nodes: make(map[string]*dirNode)}
+}
+
+// addFile adds the blob to the node of its directory, which is returned.
+func (t *dirTree) addFile(blob *Blob) *dirNode {
+	dir := parentDir(blob.Name)
+	if dir == "" {
+		return nil
+	}
+	n := t.node(dir)
+	n.files = append(n.files, dirFile{base: blob.Name[len(nameDir(blob.Name)):], hash: blob.Hash, size: blob.Size})
+	return n
+}
+
+func (t *dirTree) node(dir string) *dirNode {
+	if n := t.nodes[dir]; n != nil {
+		return n
+	}
+	n := &dirNode{name: dir}
+	t.nodes[dir] = n
+	if parent := parentDir(dir); parent != "" && parent != dir {
+		n.parent = t.node(parent)
+		n.parent.dirs = append(n.parent.dirs, n)
+	} else {
+		t.roots = append(t.roots, n)
+	}
+	return n
+}
+
+func (n *dirNode) base() string {
+	return n.name[len(nameDir(n.name)):]
+}
+
+// finish computes the sizes and digests of the tree.
+func (n *dirNode) finish() {
+	for _, d := range n.dirs {
+		d.finish()
+	}
+	sort.Slice(n.files, func(i, j int) bool { return n.files[i].base < n.files[j].base })
+	sort.Slice(n.dirs, func(i, j int) bool { return n.dirs[i].base() < n.dirs[j].base() })
+
+	h := sha256.New()
+	for _, f := range n.files {
+		h.Write([]byte("f" + f.base + "\x00"))
+		h.Write(f.hash)
+		n.count++
+		n.size += f.size
+	}
+	for _, d := range n.dirs {
+		h.Write([]byte("d" + d.base() + "\x00" + d.digest))
+		n.count += d.count
+		n.size += d.size
+	}
+	n.digest = string(h.Sum(nil))
+}
+
+// content returns the content of the tree by hash.
+func (n *dirNode) content() map[string]dirContent {
+	if n.contents != nil {
+		return n.contents
+	}
+	n.contents = make(map[string]dirContent)
+	for _, f := range n.files {
+		c := n.contents[string(f.hash)]
+		n.contents[string(f.hash)] = dirContent{n: c.n + 1, size: f.size}
+	}
+	for _, d := range n.dirs {
+		for h, dc := range d.content() {
+			c := n.contents[h]
+			n.contents[h] = dirContent{n: c.n + dc.n, size: dc.size}
+		}
+	}
+	return n.contents
+}
+
+func (n *dirNode) isAncestorOf(o *dirNode) bool {
+	for p := o.parent; p != nil; p = p.parent {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+// identical adds the groups of identical directories to r and returns the index
+// of the group of every directory which is part of one.
+func (t *dirTree) identical(r *DirDuplicates) map[*dirNode]int {
+	byDigest := make(map[string][]*dirNode)
+	for _, n := range t.nodes {
+		if n.size > 0 {
+			byDigest[n.digest] = append(byDigest[n.digest], n)
+		}
+	}
+	var groups [][]*dirNode
+	for _, nodes := range byDigest {
+		if len(nodes) > 1 {
+			sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+			groups = append(groups, nodes)
+		}
+	}
+	groupOf := make(map[*dirNode]int)
+	for i, nodes := range groups {
+		for _, n := range nodes {
+			groupOf[n] = i
+		}
+	}
+
+	for _, nodes := range groups {
+		if isNestedDirGroup(nodes, groupOf, groups) {
+			continue
+		}
+		g := DirGroup{Files: nodes[0].count, Size: nodes[0].size}
+		for _, n := range nodes {
+			g.Dirs = append(g.Dirs, n.name)
+		}
+		r.Identical = append(r.Identical, g)
+	}
+	sort.Slice(r.Identical, func(i, j int) bool {
+		a, b := r.Identical[i], r.Identical[j]
+		ra, rb := a.Size*int64(len(a.Dirs)-1), b.Size*int64(len(b.Dirs)-1)
+		return ra > rb || (ra == rb && a.Dirs[0] < b.Dirs[0])
+	})
+	return groupOf
+}
+
+// isNestedDirGroup reports whether the directories are the children of the
+// directories of another identical group, one per parent.
+func isNestedDirGroup(nodes []*dirNode, groupOf map[*dirNode]int, groups [][]*dirNode) bool {
+	if nodes[0].parent == nil {
+		return false
+	}
+	parentGroup, found := groupOf[nodes[0].parent]
+	if !found || len(groups[parentGroup]) != len(nodes) {
+		return false
+	}
+	for _, n := range nodes {
+		if g, found := groupOf[n.parent]; n.parent == nil || !found || g != parentGroup {
+			return false
+		}
+	}
+	return true
+}
+
+type dirPair struct {
+	a, b *dirNode
+}
+
+func newDirPair(a, b *dirNode) dirPair {
+	if b.name < a.name {
+		a, b = b, a
+	}
+	return dirPair{a, b}
+}
+
+// similar adds the pairs of similar directories to r. Candidates are the directories
+// which contain copies of the same content and their parents.
+func (t *dirTree) similar(r *DirDuplicates, byHash map[string][]*dirNode, groupOf map[*dirNode]int, minSimilarity float64) {
+	candidates := make(map[dirPair]bool)
+	for _, nodes := range byHash {
+		if len(nodes) > dirMaxCandidateCopies {
+			continue
+		}
+		for i, a := range nodes {
+			for _, b := range nodes[i+1:] {
+				for x, y := a, b; x != nil && y != nil && x != y && !x.isAncestorOf(y) && !y.isAncestorOf(x); {
+					p := newDirPair(x, y)
+					if candidates[p] {
+						break
+					}
+					candidates[p] = true
+					x, y = x.parent, y.parent
+				}
+			}
+		}
+	}
+
+	similar := make(map[dirPair]SimilarDirs)
+	for p := range candidates {
+		if p.a.digest == p.b.digest || p.a.size == 0 || p.b.size == 0 {
+			continue
+		}
+		ca, cb := p.a.content(), p.b.content()
+		if len(cb) < len(ca) {
+			ca, cb = cb, ca
+		}
+		var common int64
+		for h, c := range ca {
+			common += min(c.n, cb[h].n) * c.size
+		}
+		s := float64(2*common) / float64(p.a.size+p.b.size)
+		if s >= minSimilarity {
+			similar[p] = SimilarDirs{A: p.a.name, B: p.b.name, Common: common,
+				SizeA: p.a.size, SizeB: p.b.size, Similarity: s}
+		}
+	}
+
+	for p, s := range similar {
+		pa, pb := p.a.parent, p.b.parent
+		if pa != nil && pb != nil {
+			if _, found := similar[newDirPair(pa, pb)]; found {
+				continue
+			}
+			ga, founda := groupOf[pa]
+			gb, foundb := groupOf[pb]
+			if founda && foundb && ga == gb {
+				continue
+			}
+		}
+		r.Similar = append(r.Similar, s)
+	}
+	sort.Slice(r.Similar, func(i, j int) bool {
+		a, b := r.Similar[i], r.Similar[j]
+		if a.Similarity != b.Similarity {
+			return a.Similarity > b.Similarity
+		}
+		if a.Common != b.Common {
+			return a.Common > b.Common
+		}
+		return a.A < b.A || (a.A == b.A && a.B < b.B)
+	})
+}
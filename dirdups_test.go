@@ -0,0 +1,80 @@
+package blkidx
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFindDuplicateDirs(t *testing.T) {
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			// a photo folder with two copies, one of them in a backup with a different depth
+			for _, root := range []string{"/photos", "/backup/old/photos", "vol:usb/photos"} {
+				for i := 0; i < 5; i++ {
+					storeContent(t, idx, fmt.Sprintf("%s/2020/img%d.jpg", root, i), fmt.Sprintf("image %d", i))
+				}
+				storeContent(t, idx, root+"/2021/img.jpg", "image 2021")
+			}
+			storeContent(t, idx, "/backup/old/notes.txt", "notes")
+
+			// a copy with one file missing and one file renamed
+			for i := 0; i < 8; i++ {
+				storeContent(t, idx, fmt.Sprintf("/music/track%d", i), strings.Repeat("m", 10+i))
+			}
+			for i := 1; i < 7; i++ {
+				storeContent(t, idx, fmt.Sprintf("/music-copy/track%d", i), strings.Repeat("m", 10+i))
+			}
+			storeContent(t, idx, "/music-copy/renamed", strings.Repeat("m", 17))
+
+			// the same content under other names is similar but not identical
+			storeContent(t, idx, "/a/x", "x")
+			storeContent(t, idx, "/b/x", "x")
+			storeContent(t, idx, "/b/empty", "")
+
+			dd, err := FindDuplicateDirs(context.Background(), idx, 0.8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var identical []string
+			for _, g := range dd.Identical {
+				identical = append(identical, strings.Join(g.Dirs, " "))
+			}
+			want := []string{"/backup/old/photos /photos vol:usb/photos"}
+			if strings.Join(identical, "|") != strings.Join(want, "|") {
+				t.Errorf("identical - want %q; got %q", want, identical)
+			}
+			if g := dd.Identical[0]; g.Files != 6 || g.Size != 5*7+10 {
+				t.Errorf("photos - want 6 files, 45 bytes; got %d, %d", g.Files, g.Size)
+			}
+
+			var similar []string
+			for _, s := range dd.Similar {
+				similar = append(similar, s.A+" "+s.B)
+			}
+			want = []string{"/a /b", "/music /music-copy", "/backup/old vol:usb"}
+			if strings.Join(similar, "|") != strings.Join(want, "|") {
+				t.Fatalf("similar - want %q; got %q", want, similar)
+			}
+			if dd.Similar[0].Similarity != 1 {
+				t.Errorf("similar content - got %+v", dd.Similar[0])
+			}
+			s := dd.Similar[1]
+			if s.A != "/music" || s.B != "/music-copy" || s.SizeA != 108 || s.SizeB != 98 || s.Common != 98 {
+				t.Errorf("similar - got %+v", s)
+			}
+			if want := float64(2*98) / 206; s.Similarity != want {
+				t.Errorf("similarity - want %f; got %f", want, s.Similarity)
+			}
+
+			dd, err = FindDuplicateDirs(context.Background(), idx, 0.99)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dd.Similar) != 1 || dd.Similar[0].A != "/a" {
+				t.Errorf("similar - want /a and /b; got %+v", dd.Similar)
+			}
+		})
+	}
+}
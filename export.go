@@ -0,0 +1,574 @@
+package blkidx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Record is a single entry of an exported index, either a blob or a volume.
+type Record struct {
+	Blob   *Blob
+	Volume *Volume
+}
+
+// RecordWriter writes the records of an export.
+type RecordWriter interface {
+	Write(r Record) error
+
+	// writes all buffered records to the underlying writer
+	Flush() error
+}
+
+// RecordReader reads the records of an export.
+type RecordReader interface {
+	// returns the next record or io.EOF after the last record.
+	Read() (Record, error)
+}
+
+// Export writes all volumes and blobs of the index. Blobs are streamed,
+// the index does not need to fit into memory. The number of exported blobs is returned.
+func Export(ctx context.Context, idx Index, w RecordWriter) (int, error) {
+	volumes, err := idx.Volumes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range volumes {
+		if err = w.Write(Record{Volume: v}); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	err = idx.ForEach(ctx, func(b *Blob) error {
+		if err := w.Write(Record{Blob: b}); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, w.Flush()
+}
+
+// ImportPolicy decides which blob is kept if an imported blob conflicts with an existing one.
+type ImportPolicy int
+
+const (
+	// keep the existing blob
+	ImportSkip ImportPolicy = iota
+	// replace the existing blob
+	ImportReplace
+	// keep the blob which has been indexed last
+	ImportNewer
+)
+
+var importPolicyNames = []string{"skip", "replace", "newer"}
+
+func (p ImportPolicy) String() string {
+	if p >= 0 && int(p) < len(importPolicyNames) {
+		return importPolicyNames[p]
+	}
+	return fmt.Sprintf("ImportPolicy(%d)", int(p))
+}
+
+func ParseImportPolicy(s string) (ImportPolicy, error) {
+	for i, name := range importPolicyNames {
+		if s == name {
+			return ImportPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid import policy %q", s)
+}
+
+// ImportConflict is an imported blob or volume which differs from an existing one by the same name.
+type ImportConflict struct {
+	Name string
+
+	// true if Name is the name of a volume
+	Volume bool
+
+	// true if the existing entry has been replaced
+	Replaced bool
+}
+
+type ImportResult struct {
+	// new blobs
+	Added int
+
+	// blobs which are equal to existing blobs
+	Unchanged int
+
+	// conflicting blobs which have replaced or have been skipped in favor of an existing blob
+	Replaced, Skipped int
+
+	// new volumes
+	Volumes int
+
+	Conflicts []ImportConflict
+}
+
+// Import merges the records of r into the index. Imported blobs which do not exist are stored
+// with their version. An existing blob with the same hash, size and modification time is left
+// unchanged, otherwise the conflict is resolved according to policy and reported in the result.
+// A replaced blob is stored with the next version of the existing blob.
+func Import(ctx context.Context, idx Index, r RecordReader, policy ImportPolicy) (*ImportResult, error) {
+	result := new(ImportResult)
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		rec, err := r.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		switch {
+		case rec.Volume != nil:
+			err = importVolume(ctx, idx, rec.Volume, policy, result)
+		case rec.Blob != nil:
+			err = importBlob(ctx, idx, rec.Blob, policy, result)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+func importVolume(ctx context.Context, idx Index, v *Volume, policy ImportPolicy, result *ImportResult) error {
+	volumes, err := idx.Volumes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range volumes {
+		if e.Name != v.Name {
+			continue
+		}
+		if e.ID == v.ID {
+			// the root of the existing volume is where it is found on this machine
+			return nil
+		}
+		// volumes have no index time, only replace keeps the imported volume
+		replace := policy == ImportReplace
+		result.Conflicts = append(result.Conflicts, ImportConflict{Name: v.Name, Volume: true, Replaced: replace})
+		if !replace {
+			return nil
+		}
+		return idx.StoreVolume(ctx, v)
+	}
+	result.Volumes++
+	return idx.StoreVolume(ctx, v)
+}
+
+func importBlob(ctx context.Context, idx Index, b *Blob, policy ImportPolicy, result *ImportResult) error {
+	existing, err := idx.LookupByName(ctx, b.Name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		result.Added++
+		return idx.Store(ctx, b)
+	}
+	if existing.EqualHash(b) && !existing.HasChanged(b.Size, b.ModTime) {
+		result.Unchanged++
+		return nil
+	}
+	replace := policy == ImportReplace || (policy == ImportNewer && b.IndexTime.After(existing.IndexTime))
+	result.Conflicts = append(result.Conflicts, ImportConflict{Name: b.Name, Replaced: replace})
+	if !replace {
+		result.Skipped++
+		return nil
+	}
+	replacement := *b
+	replacement.Version = existing.Version + 1
+	result.Replaced++
+	return idx.Store(ctx, &replacement)
+}
+
+// NewRecordReader returns a reader of the binary format if r starts with its header,
+// otherwise a reader of the JSON Lines format.
+func NewRecordReader(r io.Reader) (RecordReader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(binaryHeader))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(header, []byte(binaryHeader)) {
+		br.Discard(len(binaryHeader))
+		return &binaryReader{r: br}, nil
+	}
+	return newJSONLReader(br), nil
+}
+
+// JSON Lines format, one record per line:
+// {"type":"volume","name":"usb","id":"uuid:...","root":"/mnt/usb"}
+// {"type":"blob","name":"/a","version":1,...,"hash":"<hex>","blocks":["<hex>",...]}
+type jsonRecord struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+
+	// volume
+	ID   string `json:"id,omitempty"`
+	Root string `json:"root,omitempty"`
+
+	// blob
+	Version       uint64     `json:"version,omitempty"`
+	IndexTime     *time.Time `json:"index_time,omitempty"`
+	Size          int64      `json:"size,omitempty"`
+	ModTime       *time.Time `json:"mod_time,omitempty"`
+	ChangeTime    *time.Time `json:"change_time,omitempty"`
+	Inode         uint64     `json:"inode,omitempty"`
+	ChangeAttr    uint64     `json:"change_attr,omitempty"`
+	HashAlgorithm string     `json:"hash_algorithm,omitempty"`
+	Hash          string     `json:"hash,omitempty"`
+	HashBlockSize int        `json:"block_size,omitempty"`
+	HashedBlocks  []string   `json:"blocks,omitempty"`
+}
+
+const (
+	jsonTypeBlob   = "blob"
+	jsonTypeVolume = "volume"
+
+	// the longest accepted line, large enough for the block hashes of multi terabyte files
+	jsonMaxLine = 64 << 20
+)
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewJSONLWriter(w io.Writer) RecordWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonlWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (w *jsonlWriter) Write(r Record) error {
+	var jr jsonRecord
+	switch {
+	case r.Volume != nil:
+		jr = jsonRecord{Type: jsonTypeVolume, Name: r.Volume.Name, ID: r.Volume.ID, Root: r.Volume.Root}
+	case r.Blob != nil:
+		b := r.Blob
+		jr = jsonRecord{
+			Type:          jsonTypeBlob,
+			Name:          b.Name,
+			Version:       b.Version,
+			IndexTime:     &b.IndexTime,
+			Size:          b.Size,
+			ModTime:       &b.ModTime,
+			Inode:         b.Inode,
+			ChangeAttr:    b.ChangeAttr,
+			HashAlgorithm: b.HashAlgorithm.String(),
+			Hash:          hex.EncodeToString(b.Hash),
+			HashBlockSize: b.HashBlockSize,
+		}
+		if !b.ChangeTime.IsZero() {
+			jr.ChangeTime = &b.ChangeTime
+		}
+		for _, block := range b.HashedBlocks {
+			jr.HashedBlocks = append(jr.HashedBlocks, hex.EncodeToString(block))
+		}
+	default:
+		return errors.New("empty record")
+	}
+	return w.enc.Encode(&jr)
+}
+
+func (w *jsonlWriter) Flush() error { return w.w.Flush() }
+
+type jsonlReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, jsonMaxLine)
+	return &jsonlReader{s: s}
+}
+
+func (r *jsonlReader) Read() (Record, error) {
+	for r.s.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rec, err := decodeJSONRecord(line)
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %v", r.line, err)
+		}
+		return rec, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+func decodeJSONRecord(line []byte) (Record, error) {
+	var jr jsonRecord
+	if err := json.Unmarshal(line, &jr); err != nil {
+		return Record{}, err
+	}
+	switch jr.Type {
+	case jsonTypeVolume:
+		v := &Volume{Name: jr.Name, ID: jr.ID, Root: jr.Root}
+		return Record{Volume: v}, v.Validate()
+
+	case jsonTypeBlob:
+		b := &Blob{
+			Name:          jr.Name,
+			Version:       jr.Version,
+			Size:          jr.Size,
+			Inode:         jr.Inode,
+			ChangeAttr:    jr.ChangeAttr,
+			HashBlockSize: jr.HashBlockSize,
+		}
+		if jr.IndexTime != nil {
+			b.IndexTime = jr.IndexTime.UTC()
+		}
+		if jr.ModTime != nil {
+			b.ModTime = jr.ModTime.UTC()
+		}
+		if jr.ChangeTime != nil {
+			b.ChangeTime = jr.ChangeTime.UTC()
+		}
+		var err error
+		if b.HashAlgorithm, err = ParseHashAlgorithm(jr.HashAlgorithm); err != nil {
+			return Record{}, err
+		}
+		if b.Hash, err = hex.DecodeString(jr.Hash); err != nil {
+			return Record{}, err
+		}
+		for _, block := range jr.HashedBlocks {
+			h, err := hex.DecodeString(block)
+			if err != nil {
+				return Record{}, err
+			}
+			b.HashedBlocks = append(b.HashedBlocks, h)
+		}
+		return Record{Blob: b}, b.Validate()
+	}
+	return Record{}, fmt.Errorf("invalid record type %q", jr.Type)
+}
+
+// ParseHashAlgorithm returns the hash algorithm by its name, e.g. SHA-256, or its lower case
+// manifest name, e.g. sha256.
+func ParseHashAlgorithm(name string) (crypto.Hash, error) {
+	for h := crypto.MD4; h <= crypto.BLAKE2b_512; h++ {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	if h, found := manifestHashes[name]; found {
+		return h, nil
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %q", name)
+}
+
+// Binary format: the header followed by records, each starting with its type.
+// Integers are varint encoded, strings and byte slices are prefixed by their length
+// and times are stored as seconds and nanoseconds since the unix epoch.
+const (
+	binaryHeader = "BLKIDX\x00\x01"
+
+	binaryTypeBlob   = 1
+	binaryTypeVolume = 2
+
+	// the longest accepted string or byte slice
+	binaryMaxLen = 64 << 10
+
+	// the maximum accepted number of hashed blocks
+	binaryMaxBlocks = 1 << 24
+)
+
+type binaryWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func NewBinaryWriter(w io.Writer) (RecordWriter, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(binaryHeader); err != nil {
+		return nil, err
+	}
+	return &binaryWriter{w: bw}, nil
+}
+
+func (w *binaryWriter) Write(r Record) error {
+	buf, err := appendRecord(w.buf[:0], r)
+	if err != nil {
+		return err
+	}
+	w.buf = buf
+	_, err = w.w.Write(buf)
+	return err
+}
+
+// appendRecord appends the binary encoding of the record to buf.
+func appendRecord(buf []byte, r Record) ([]byte, error) {
+	switch {
+	case r.Volume != nil:
+		buf = append(buf, binaryTypeVolume)
+		buf = appendBytes(buf, []byte(r.Volume.Name))
+		buf = appendBytes(buf, []byte(r.Volume.ID))
+		buf = appendBytes(buf, []byte(r.Volume.Root))
+	case r.Blob != nil:
+		b := r.Blob
+		buf = append(buf, binaryTypeBlob)
+		buf = appendBytes(buf, []byte(b.Name))
+		buf = binary.AppendUvarint(buf, b.Version)
+		buf = appendTime(buf, b.IndexTime)
+		buf = binary.AppendVarint(buf, b.Size)
+		buf = appendTime(buf, b.ModTime)
+		buf = appendTime(buf, b.ChangeTime)
+		buf = binary.AppendUvarint(buf, b.Inode)
+		buf = binary.AppendUvarint(buf, b.ChangeAttr)
+		buf = binary.AppendUvarint(buf, uint64(b.HashAlgorithm))
+		buf = appendBytes(buf, b.Hash)
+		buf = binary.AppendUvarint(buf, uint64(b.HashBlockSize))
+		buf = binary.AppendUvarint(buf, uint64(len(b.HashedBlocks)))
+		for _, block := range b.HashedBlocks {
+			buf = appendBytes(buf, block)
+		}
+	default:
+		return buf, errors.New("empty record")
+	}
+	return buf, nil
+}
+
+func (w *binaryWriter) Flush() error { return w.w.Flush() }
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// the zero time is stored as zero seconds and an invalid nanosecond value
+func appendTime(buf []byte, t time.Time) []byte {
+	if t.IsZero() {
+		buf = binary.AppendVarint(buf, 0)
+		return binary.AppendUvarint(buf, 1e9)
+	}
+	buf = binary.AppendVarint(buf, t.Unix())
+	return binary.AppendUvarint(buf, uint64(t.Nanosecond()))
+}
+
+type binaryReader struct {
+	r   byteReader
+	err error // the first error while decoding a record
+}
+
+// byteReader is the input of a binaryReader.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func (r *binaryReader) Read() (Record, error) {
+	typ, err := r.r.ReadByte()
+	if err != nil {
+		return Record{}, err // io.EOF between records
+	}
+	r.err = nil
+	switch typ {
+	case binaryTypeVolume:
+		v := &Volume{Name: r.string(), ID: r.string(), Root: r.string()}
+		if r.err != nil {
+			return Record{}, r.err
+		}
+		return Record{Volume: v}, v.Validate()
+
+	case binaryTypeBlob:
+		b := &Blob{
+			Name:          r.string(),
+			Version:       r.uvarint(),
+			IndexTime:     r.time(),
+			Size:          r.varint(),
+			ModTime:       r.time(),
+			ChangeTime:    r.time(),
+			Inode:         r.uvarint(),
+			ChangeAttr:    r.uvarint(),
+			HashAlgorithm: crypto.Hash(r.uvarint()),
+			Hash:          r.bytes(),
+			HashBlockSize: int(r.uvarint()),
+		}
+		n := r.uvarint()
+		if n > binaryMaxBlocks && r.err == nil {
+			r.err = fmt.Errorf("too many hashed blocks: %d", n)
+		}
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			b.HashedBlocks = append(b.HashedBlocks, r.bytes())
+		}
+		if r.err != nil {
+			return Record{}, r.err
+		}
+		return Record{Blob: b}, b.Validate()
+	}
+	return Record{}, fmt.Errorf("invalid record type %d", typ)
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+	}
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(r.r)
+	r.fail(err)
+	return x
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(r.r)
+	r.fail(err)
+	return x
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > binaryMaxLen {
+		r.fail(fmt.Errorf("invalid length %d", n))
+		return nil
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r.r, b)
+	r.fail(err)
+	return b
+}
+
+func (r *binaryReader) string() string { return string(r.bytes()) }
+
+func (r *binaryReader) time() time.Time {
+	sec, nsec := r.varint(), r.uvarint()
+	if r.err != nil || nsec >= 1e9 {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec)).UTC()
+}
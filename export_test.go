@@ -0,0 +1,120 @@
+package blkidx
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryIndex()
+	if err := src.StoreVolume(ctx, &Volume{Name: "usb", ID: "marker:1234", Root: "/mnt/usb"}); err != nil {
+		t.Fatal(err)
+	}
+	storeContent(t, src, "/a", "")
+	b := storeContent(t, src, "vol:usb/b", "some content in several blocks")
+	updated := *b
+	updated.Version = 7
+	updated.ChangeTime = time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	updated.Inode = 1 << 40
+	updated.ChangeAttr = 42
+	src.Remove(ctx, Names{b.Name})
+	if err := src.Store(ctx, &updated); err != nil {
+		t.Fatal(err)
+	}
+
+	writers := map[string]func(*bytes.Buffer) RecordWriter{
+		"jsonl": func(buf *bytes.Buffer) RecordWriter { return NewJSONLWriter(buf) },
+		"binary": func(buf *bytes.Buffer) RecordWriter {
+			w, err := NewBinaryWriter(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return w
+		},
+	}
+	for format, newWriter := range writers {
+		for backend, dst := range testIndexes(t) {
+			t.Run(format+"/"+backend, func(t *testing.T) {
+				var buf bytes.Buffer
+				n, err := Export(ctx, src, newWriter(&buf))
+				if err != nil || n != 2 {
+					t.Fatalf("want (2, nil); got (%d, %v)", n, err)
+				}
+				r, err := NewRecordReader(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result, err := Import(ctx, dst, r, ImportSkip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Added != 2 || result.Volumes != 1 || len(result.Conflicts) != 0 {
+					t.Errorf("unexpected import result: %+v", result)
+				}
+				// all blob fields are part of the json lines format
+				if want, got := exportJSONL(t, src), exportJSONL(t, dst); want != got {
+					t.Errorf("blobs differ\nwant %s\ngot  %s", want, got)
+				}
+				if vs, _ := dst.Volumes(ctx); len(vs) != 1 || vs[0].Root != "/mnt/usb" {
+					t.Errorf("volume not imported: %+v", vs)
+				}
+			})
+		}
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		policy   ImportPolicy
+		replaced bool
+	}{
+		{ImportSkip, false},
+		{ImportReplace, true},
+		{ImportNewer, true},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			src := NewMemoryIndex()
+			storeContent(t, src, "/same", "same")
+			imported := storeContent(t, src, "/conflict", "imported")
+
+			dst := NewMemoryIndex()
+			storeContent(t, dst, "/same", "same")
+			existing := storeContent(t, dst, "/conflict", "existing")
+			existing.IndexTime = imported.IndexTime.Add(-time.Hour)
+
+			var buf bytes.Buffer
+			if _, err := Export(ctx, src, NewJSONLWriter(&buf)); err != nil {
+				t.Fatal(err)
+			}
+			r, _ := NewRecordReader(&buf)
+			result, err := Import(ctx, dst, r, tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []ImportConflict{{Name: "/conflict", Replaced: tc.replaced}}
+			if result.Unchanged != 1 || !reflect.DeepEqual(result.Conflicts, want) {
+				t.Errorf("unexpected import result: %+v", result)
+			}
+			blob, _ := dst.LookupByName(ctx, "/conflict")
+			if got := blob.EqualHash(imported); got != tc.replaced {
+				t.Errorf("want replaced %v; got %v", tc.replaced, got)
+			}
+			if tc.replaced && blob.Version != existing.Version+1 {
+				t.Errorf("want version %d; got %d", existing.Version+1, blob.Version)
+			}
+		})
+	}
+}
+
+func exportJSONL(t *testing.T, idx Index) string {
+	var buf bytes.Buffer
+	if _, err := Export(context.Background(), idx, NewJSONLWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
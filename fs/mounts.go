@@ -0,0 +1,16 @@
+package fs
+
+import (
+	"errors"
+)
+
+// returned by FilesystemUUID if the file system of a directory has no UUID
+// or the platform does not provide it
+var ErrNoUUID = errors.New("no file system uuid found")
+
+type Mount struct {
+	// the directory on which the file system is mounted
+	Dir string
+	// the mounted device or remote location, as reported by the system
+	Source string
+}
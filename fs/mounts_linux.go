@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const byUUIDDir = "/dev/disk/by-uuid"
+
+// MountPoints lists all mounted file systems.
+func MountPoints() ([]Mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []Mount
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		m := Mount{Dir: unescapeMountField(fields[4])}
+		for i := 5; i+2 < len(fields); i++ {
+			if fields[i] == "-" {
+				m.Source = unescapeMountField(fields[i+2])
+				break
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, s.Err()
+}
+
+// mountinfo escapes space, tab, newline and backslash as octal sequences
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// FilesystemUUID returns the uuid of the block device on which dir is stored.
+func FilesystemUUID(dir string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ErrNoUUID
+	}
+	entries, err := os.ReadDir(byUUIDDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNoUUID
+		}
+		return "", err
+	}
+	for _, entry := range entries {
+		dev, err := os.Stat(filepath.Join(byUUIDDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if dst, ok := dev.Sys().(*syscall.Stat_t); ok && dst.Rdev == st.Dev {
+			return entry.Name(), nil
+		}
+	}
+	return "", ErrNoUUID
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fs
+
+// MountPoints lists all mounted file systems.
+// Mount points are only available on linux.
+func MountPoints() ([]Mount, error) {
+	return nil, nil
+}
+
+// FilesystemUUID returns the uuid of the block device on which dir is stored.
+// File system uuids are only available on linux.
+func FilesystemUUID(dir string) (string, error) {
+	return "", ErrNoUUID
+}
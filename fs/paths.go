@@ -3,6 +3,7 @@ package fs
 import (
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Paths map[string]struct{}
@@ -46,3 +47,20 @@ func CleanAbsolute(path string) (string, error) {
 	}
 	return filepath.Clean(path), nil
 }
+
+// IsUnder reports whether the clean path is dir itself or is located below the clean dir.
+// Unlike a plain prefix test /data/foobar is not under /data/foo.
+func IsUnder(path, dir string) bool {
+	return IsUnderSep(path, dir, filepath.Separator)
+}
+
+// IsUnderSep is like IsUnder for paths whose elements are separated by sep.
+func IsUnderSep(path, dir string, sep byte) bool {
+	if !strings.HasPrefix(path, dir) {
+		return false
+	}
+	if len(path) == len(dir) || strings.HasSuffix(dir, string(sep)) {
+		return true
+	}
+	return path[len(dir)] == sep
+}
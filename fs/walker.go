@@ -1,56 +1,213 @@
 package fs
 
 import (
+	"context"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
+// number of directory entries read from a directory in one go.
+// large directories are read and reported in batches of this size.
+const readDirBatch = 1024
+
+var DefaultWalkConcurrency = 4
+
+// PathElem is either a regular file or an error.
+// The path of an error is set if the error can be attributed to a path.
 type PathElem struct {
 	Err  error
 	Path string
 	Info os.FileInfo
 }
 
-func WalkFiles(paths Paths) <-chan *PathElem {
-	c := make(chan *PathElem)
-	fn := makeWalkFilesFunc(c)
+// Walker reports all regular files below a set of paths.
+// Directories are read concurrently by up to Concurrency goroutines.
+// Symbolic links are not followed.
+type Walker struct {
+	// number of concurrent directory readers
+	Concurrency int
+}
+
+func WalkFiles(ctx context.Context, paths Paths) <-chan *PathElem {
+	w := &Walker{Concurrency: DefaultWalkConcurrency}
+	return w.Walk(ctx, paths)
+}
+
+// Walk starts walking all paths and returns a channel on which all regular files
+// and all errors are reported. The channel is closed once all paths have been walked
+// or the context has been cancelled.
+func (w *Walker) Walk(ctx context.Context, paths Paths) <-chan *PathElem {
+	concurrency := w.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	c := make(chan *PathElem, concurrency)
+	state := &walkState{ctx: ctx, out: c}
+	state.cond = sync.NewCond(&state.mu)
+
 	go func() {
+		defer close(c)
 		for path, _ := range paths {
-			if err := filepath.Walk(path, fn); err != nil && err != io.EOF {
-				c <- &PathElem{Err: err}
-			}
+			state.walkRoot(path)
+		}
+		var wg sync.WaitGroup
+		for x := 0; x < concurrency; x++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				state.reader()
+			}()
 		}
-		close(c)
+		wg.Wait()
 	}()
 	return c
 }
 
-func makeWalkFilesFunc(c chan *PathElem) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			c <- &PathElem{Err: err}
-			return nil
+type walkState struct {
+	ctx context.Context
+	out chan<- *PathElem
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// directories which still need to be read
+	queue []string
+	// number of directories which are either queued or being read
+	pending int
+}
+
+func (s *walkState) walkRoot(path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		s.send(&PathElem{Err: err, Path: path})
+		return
+	}
+	switch {
+	case info.IsDir():
+		s.push(path)
+	case info.Mode().IsRegular():
+		s.send(&PathElem{Path: path, Info: info})
+	}
+}
+
+func (s *walkState) reader() {
+	for {
+		dir, ok := s.next()
+		if !ok {
+			return
 		}
-		if !info.Mode().IsRegular() {
-			return nil
+		if s.ctx.Err() == nil {
+			s.readDir(dir)
 		}
-		c <- &PathElem{
-			Path: path,
-			Info: info,
+		s.done()
+	}
+}
+
+func (s *walkState) readDir(dir string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		s.send(&PathElem{Err: err, Path: dir})
+		return
+	}
+	defer f.Close()
+
+	for {
+		entries, err := f.ReadDir(readDirBatch)
+		for _, entry := range entries {
+			if !s.entry(dir, entry) {
+				return
+			}
 		}
-		return nil
+		if err != nil {
+			if err != io.EOF {
+				s.send(&PathElem{Err: err, Path: dir})
+			}
+			return
+		}
+	}
+}
+
+// entry handles a single directory entry, the type of which is known without an lstat
+// call on most platforms. only regular files need to be stat-ed for their size and mtime.
+func (s *walkState) entry(dir string, entry os.DirEntry) bool {
+	path := filepath.Join(dir, entry.Name())
+	switch {
+	case entry.IsDir():
+		s.push(path)
+		return true
+	case entry.Type().IsRegular():
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed since the directory has been read
+				return true
+			}
+			return s.send(&PathElem{Err: err, Path: path})
+		}
+		return s.send(&PathElem{Path: path, Info: info})
+	}
+	return true
+}
+
+// send reports a path element. false is returned if the walk has been cancelled.
+func (s *walkState) send(pe *PathElem) bool {
+	select {
+	case s.out <- pe:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *walkState) push(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queue = append(s.queue, dir)
+	s.pending++
+	s.cond.Signal()
+}
+
+// next waits for a queued directory. false is returned once all directories have been read.
+func (s *walkState) next() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) == 0 && s.pending > 0 {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return "", false
+	}
+	// depth first keeps the queue short
+	last := len(s.queue) - 1
+	dir := s.queue[last]
+	s.queue = s.queue[:last]
+	return dir, true
+}
+
+func (s *walkState) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending--
+	if s.pending == 0 {
+		s.cond.Broadcast()
 	}
 }
 
-func AggregateLogErrors(c <-chan *PathElem, l *log.Logger) Paths {
+// AggregateLogErrors collects the paths of all files received from c.
+// errors are logged to l if it is not nil.
+func AggregateLogErrors(c <-chan *PathElem, l *slog.Logger) Paths {
 	paths := make(Paths)
 
 	for pe := range c {
 		if pe.Err != nil {
 			if l != nil {
-				l.Printf("ERROR: %v", pe.Err)
+				l.Error("walk failed", slog.String("path", pe.Path), slog.String("error", pe.Err.Error()))
 			}
 			continue
 		}
@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkerFindsAllFiles(t *testing.T) {
+	root := t.TempDir()
+	want := make(map[string]struct{})
+	for _, name := range []string{"a", "b/c", "b/d/e", "b/d/f", "g/h/i/j"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		writeFile(t, path)
+		want[path] = struct{}{}
+	}
+	if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for concurrency := 0; concurrency <= 4; concurrency++ {
+		w := &Walker{Concurrency: concurrency}
+		got := make(map[string]struct{})
+		for pe := range w.Walk(context.Background(), Paths{root: {}}) {
+			if pe.Err != nil {
+				t.Fatal(pe.Err)
+			}
+			if !pe.Info.Mode().IsRegular() {
+				t.Errorf("not a regular file: %q", pe.Path)
+			}
+			got[pe.Path] = struct{}{}
+		}
+		if len(got) != len(want) {
+			t.Errorf("concurrency %d - want %d files; got %d", concurrency, len(want), len(got))
+		}
+		for path := range want {
+			if _, found := got[path]; !found {
+				t.Errorf("concurrency %d - missing file %q", concurrency, path)
+			}
+		}
+	}
+}
+
+func TestWalkerCancel(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a/1", "a/2", "b/1", "b/2", "c/1"} {
+		writeFile(t, filepath.Join(root, filepath.FromSlash(name)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Walker{Concurrency: 2}
+	c := w.Walk(ctx, Paths{root: {}})
+	<-c
+	cancel()
+	for range c {
+		// the channel must be closed after cancellation
+	}
+}
+
+func TestWalkerReportsErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	var errs int
+	for pe := range WalkFiles(context.Background(), Paths{missing: {}}) {
+		if pe.Err != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("want 1 error; got %d", errs)
+	}
+}
+
+func writeFile(t *testing.T, path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
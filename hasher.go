@@ -52,6 +52,7 @@ func (h *hasher) Write(p []byte) (n int, err error) {
 
 		h.block.Write(p[:h.blockRem])
 		p = p[h.blockRem:]
+		h.blockRem = 0
 		h.finishBlock()
 	}
 	return
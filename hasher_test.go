@@ -54,6 +54,33 @@ func TestHasherOneBlock(t *testing.T) {
 	}
 }
 
+func TestHasherLargeWrite(t *testing.T) {
+	alg := crypto.SHA256
+	small := NewHasher(alg, 16)
+	writeAllBytes(t, small)
+	wantAll, wantBlocks := small.Finish()
+
+	var data [256]byte
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// a single write which spans all blocks
+	large := NewHasher(alg, 16)
+	large.Write(data[:])
+	all, blocks := large.Finish()
+	if !bytes.Equal(all, wantAll) {
+		t.Errorf("all differs: %x - %x", all, wantAll)
+	}
+	if len(blocks) != len(wantBlocks) {
+		t.Fatalf("blocks - want %d; got %d", len(wantBlocks), len(blocks))
+	}
+	for i := range blocks {
+		if !bytes.Equal(blocks[i], wantBlocks[i]) {
+			t.Errorf("block %d differs: %x - %x", i, blocks[i], wantBlocks[i])
+		}
+	}
+}
+
 func writeAllBytes(t *testing.T, w io.Writer) {
 	var b [1]byte
 	var p []byte = b[:]
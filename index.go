@@ -1,35 +1,143 @@
 package blkidx
 
 import (
+	"context"
+	"crypto"
 	"fmt"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+
+	"github.com/phicode/blkidx/fs"
 )
 
 type Index interface {
 	// stores a blob by its name.
-	// if the version field is zero and no such blob exists it will be stored.
+	// if no such blob exists it will be stored, regardless of its version.
 	// existing blobs will be overwritten if the new version is excalty one higher than the existing one.
 	// otherwise a OptimisticLockingError will be returned.
-	Store(blob *Blob) error
+	Store(ctx context.Context, blob *Blob) error
 
 	// blob lookup by name. if no blob by a certain name exists "nil, nil" is returned.
 	// the error return value is indicative of problems with the underlying storage strategy.
-	LookupByName(name string) (*Blob, error)
+	LookupByName(ctx context.Context, name string) (*Blob, error)
+
+	// all blobs whose content has the given hash, ordered by name.
+	LookupByHash(ctx context.Context, hash []byte) ([]*Blob, error)
+
+	// all blobs which have been hashed with the same algorithm and block size and
+	// which share at least one of the given block hashes, ordered by name.
+	LookupByBlockHashes(ctx context.Context, alg crypto.Hash, blockSize int, hashes [][]byte) ([]*Blob, error)
+
+	// all blobs selected by the query in the order of the query.
+	Query(ctx context.Context, q *Query) ([]*Blob, error)
+
+	// all groups of blobs with the same hash, see ForEachEqualHashes.
+	FindEqualHashes(ctx context.Context) ([]EqualBlobs, error)
+
+	// calls fn for every group of non-empty blobs with the same hash of which at least one blob is
+	// any of the names of under or is located below them, or for every group if under is empty.
+	// groups contain all of their names, ordered by name, and are ordered by hash.
+	// the iteration stops at the first error returned by fn, which is returned. fn must not modify the index.
+	ForEachEqualHashes(ctx context.Context, under Names, fn func(EqualBlobs) error) error
+
+	// aggregates of all blobs located below any of the names, or of all blobs if no names are given.
+	// at most top extensions, duplicate groups and directories are returned, all if top is 0.
+	Stats(ctx context.Context, under Names, top int) (*Stats, error)
+
+	// the names of all blobs, ordered by name.
+	AllNames(ctx context.Context) (Names, error)
+
+	// calls fn with the name of every blob which is any of the names of under or is located below
+	// them (see NameIsUnder), or of every blob if under is empty, ordered by name.
+	// the iteration stops at the first error returned by fn, which is returned. fn must not modify the index.
+	ForEachName(ctx context.Context, under Names, fn func(name string) error) error
+
+	// calls fn for every blob, ordered by name. the iteration stops at the first error
+	// returned by fn, which is returned. fn must not modify the index.
+	ForEach(ctx context.Context, fn func(*Blob) error) error
 
-	FindEqualHashes() ([]EqualBlobs, error)
+	Remove(ctx context.Context, names Names) error
 
-	AllNames() (Names, error)
+	// removes all blobs which are any of the names of under or are located below them and
+	// returns how many were removed. nothing is removed if under is empty.
+	RemoveUnder(ctx context.Context, under Names) (int, error)
 
-	Remove(names Names) error
+	Count(ctx context.Context) (int, error)
 
-	Count() (int, error)
+	// stores a volume by its name, an existing volume by the same name is replaced.
+	StoreVolume(ctx context.Context, volume *Volume) error
+
+	// all volumes, ordered by name.
+	Volumes(ctx context.Context) ([]*Volume, error)
+
+	// removes a volume. the blobs of the volume are not removed.
+	RemoveVolume(ctx context.Context, name string) error
 }
 
 type Names []string
 
 func (n Names) Sort() { sort.Strings([]string(n)) }
 
+// NameIsUnder reports whether the blob name is dir or is located below dir, see fs.IsUnder.
+// Both absolute paths and names relative to a volume are supported.
+func NameIsUnder(name, dir string) bool {
+	if strings.HasPrefix(dir, VolumeNamePrefix) {
+		return fs.IsUnderSep(name, dir, '/')
+	}
+	return fs.IsUnder(name, dir)
+}
+
+// NameIsUnderAny reports whether the blob name is any of dirs or is located below any of them.
+func NameIsUnderAny(name string, dirs Names) bool {
+	for _, dir := range dirs {
+		if NameIsUnder(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// NamesUnder returns the names of the blobs which are any of the names of under or are
+// located below them, ordered by name.
+func NamesUnder(ctx context.Context, idx Index, under Names) (rv Names, err error) {
+	if len(under) == 0 {
+		return nil, nil
+	}
+	err = idx.ForEachName(ctx, under, func(name string) error {
+		rv = append(rv, name)
+		return nil
+	})
+	return
+}
+
+// FindEqualHashesUnder returns the groups of blobs with the same hash of which at least one
+// blob is any of the names of under or is located below them, see Index.ForEachEqualHashes.
+func FindEqualHashesUnder(ctx context.Context, idx Index, under Names) (rv []EqualBlobs, err error) {
+	if len(under) == 0 {
+		return nil, nil
+	}
+	err = idx.ForEachEqualHashes(ctx, under, func(equal EqualBlobs) error {
+		rv = append(rv, equal)
+		return nil
+	})
+	return
+}
+
+// nameRange returns the range [lo, hi) of all names which are located below dir.
+func nameRange(dir string) (lo, hi string) {
+	var sep byte = filepath.Separator
+	if strings.HasPrefix(dir, VolumeNamePrefix) {
+		sep = '/'
+	}
+	lo = dir
+	if !strings.HasSuffix(dir, string(sep)) {
+		lo += string(sep)
+	}
+	return lo, lo[:len(lo)-1] + string(sep+1)
+}
+
 type OptimisticLockingError struct {
 	Name          string
 	FailedVersion uint64
@@ -50,44 +158,121 @@ type LockedIndex struct {
 
 var _ Index = (*LockedIndex)(nil)
 
-func (i *LockedIndex) Store(blob *Blob) error {
+func (i *LockedIndex) Store(ctx context.Context, blob *Blob) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.Store(ctx, blob)
+}
+
+func (i *LockedIndex) LookupByName(ctx context.Context, name string) (*Blob, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.LookupByName(ctx, name)
+}
+
+func (i *LockedIndex) LookupByHash(ctx context.Context, hash []byte) ([]*Blob, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.LookupByHash(ctx, hash)
+}
+
+func (i *LockedIndex) LookupByBlockHashes(ctx context.Context, alg crypto.Hash, blockSize int, hashes [][]byte) ([]*Blob, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.LookupByBlockHashes(ctx, alg, blockSize, hashes)
+}
+
+func (i *LockedIndex) Query(ctx context.Context, q *Query) ([]*Blob, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.Query(ctx, q)
+}
+
+func (i *LockedIndex) Stats(ctx context.Context, under Names, top int) (*Stats, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.Stats(ctx, under, top)
+}
+
+func (i *LockedIndex) FindEqualHashes(ctx context.Context) ([]EqualBlobs, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.FindEqualHashes(ctx)
+}
+
+func (i *LockedIndex) ForEachEqualHashes(ctx context.Context, under Names, fn func(EqualBlobs) error) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.ForEachEqualHashes(ctx, under, fn)
+}
+
+func (i *LockedIndex) AllNames(ctx context.Context) (Names, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.AllNames(ctx)
+}
+
+func (i *LockedIndex) ForEachName(ctx context.Context, under Names, fn func(string) error) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.ForEachName(ctx, under, fn)
+}
+
+func (i *LockedIndex) ForEach(ctx context.Context, fn func(*Blob) error) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.Backend.ForEach(ctx, fn)
+}
+
+func (i *LockedIndex) Remove(ctx context.Context, names Names) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.Backend.Store(blob)
+	return i.Backend.Remove(ctx, names)
 }
 
-func (i *LockedIndex) LookupByName(name string) (*Blob, error) {
+func (i *LockedIndex) RemoveUnder(ctx context.Context, under Names) (int, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.Backend.LookupByName(name)
+	return i.Backend.RemoveUnder(ctx, under)
 }
 
-func (i *LockedIndex) FindEqualHashes() ([]EqualBlobs, error) {
+func (i *LockedIndex) Count(ctx context.Context) (int, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.Backend.FindEqualHashes()
+	return i.Backend.Count(ctx)
 }
 
-func (i *LockedIndex) AllNames() (Names, error) {
+func (i *LockedIndex) StoreVolume(ctx context.Context, volume *Volume) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.Backend.AllNames()
+	return i.Backend.StoreVolume(ctx, volume)
 }
 
-func (i *LockedIndex) Remove(names Names) error {
+func (i *LockedIndex) Volumes(ctx context.Context) ([]*Volume, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.Backend.Remove(names)
+	return i.Backend.Volumes(ctx)
 }
 
-func (i *LockedIndex) Count() (int, error) {
+func (i *LockedIndex) RemoveVolume(ctx context.Context, name string) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.Backend.Count()
+	return i.Backend.RemoveVolume(ctx, name)
 }
@@ -0,0 +1,484 @@
+package blkidx
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of a bolt index. Blobs and volumes are stored in the binary export format.
+// The keys of the hash and block buckets start with the length of the hash as uvarint
+// and the hash, so that the names of a hash are found by a prefix scan:
+//
+//	blobs:   name -> blob
+//	hashes:  len(hash), hash, name -> size of the blob as uvarint
+//	blocks:  hash algorithm, block size, len(block hash), block hash, name -> empty
+//	volumes: name -> volume
+//	meta:    "version" -> the version of the layout as uvarint
+var (
+	boltBlobs   = []byte("blobs")
+	boltHashes  = []byte("hashes")
+	boltBlocks  = []byte("blocks")
+	boltVolumes = []byte("volumes")
+	boltMeta    = []byte("meta")
+
+	boltMetaVersion = []byte("version")
+)
+
+const boltVersion = 1
+
+type boltIndex struct {
+	db *bolt.DB
+}
+
+var _ Index = (*boltIndex)(nil)
+
+// NewBoltIndex returns an index which is stored in a bbolt database, an embedded key value
+// store which is written in go. The buckets of the index are created if they do not exist.
+func NewBoltIndex(ctx context.Context, db *bolt.DB) (Index, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBlobs, boltHashes, boltBlocks, boltVolumes, boltMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(boltMeta)
+		if v := meta.Get(boltMetaVersion); v != nil {
+			if version, _ := binary.Uvarint(v); version != boltVersion {
+				return fmt.Errorf("unsupported version %d of the bolt index", version)
+			}
+			return nil
+		}
+		return meta.Put(boltMetaVersion, binary.AppendUvarint(nil, boltVersion))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltIndex{db: db}, nil
+}
+
+func boltHashKey(hash []byte, name string) []byte {
+	key := binary.AppendUvarint(nil, uint64(len(hash)))
+	key = append(key, hash...)
+	return append(key, name...)
+}
+
+// boltSplitHashKey returns the hash and the name of a key of the hash bucket.
+func boltSplitHashKey(key []byte) ([]byte, string) {
+	n, l := binary.Uvarint(key)
+	end := l + int(n)
+	return key[l:end], string(key[end:])
+}
+
+func boltBlockKey(alg crypto.Hash, blockSize int, block []byte, name string) []byte {
+	key := binary.AppendUvarint(nil, uint64(alg))
+	key = binary.AppendUvarint(key, uint64(blockSize))
+	key = binary.AppendUvarint(key, uint64(len(block)))
+	key = append(key, block...)
+	return append(key, name...)
+}
+
+func decodeBoltBlob(v []byte) (*Blob, error) {
+	rec, err := (&binaryReader{r: bytes.NewReader(v)}).Read()
+	if err == nil && rec.Blob == nil {
+		err = errors.New("invalid blob record")
+	}
+	return rec.Blob, err
+}
+
+// boltPut stores the blob and its hashes.
+func boltPut(tx *bolt.Tx, blob *Blob) error {
+	value, err := appendRecord(nil, Record{Blob: blob})
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(boltBlobs).Put([]byte(blob.Name), value); err != nil {
+		return err
+	}
+	size := binary.AppendUvarint(nil, uint64(blob.Size))
+	if err = tx.Bucket(boltHashes).Put(boltHashKey(blob.Hash, blob.Name), size); err != nil {
+		return err
+	}
+	blocks := tx.Bucket(boltBlocks)
+	for _, block := range blob.HashedBlocks {
+		if err = blocks.Put(boltBlockKey(blob.HashAlgorithm, blob.HashBlockSize, block, blob.Name), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltDelete removes the blob and its hashes.
+func boltDelete(tx *bolt.Tx, blob *Blob) error {
+	if err := tx.Bucket(boltBlobs).Delete([]byte(blob.Name)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltHashes).Delete(boltHashKey(blob.Hash, blob.Name)); err != nil {
+		return err
+	}
+	blocks := tx.Bucket(boltBlocks)
+	for _, block := range blob.HashedBlocks {
+		if err := blocks.Delete(boltBlockKey(blob.HashAlgorithm, blob.HashBlockSize, block, blob.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltGet(tx *bolt.Tx, name string) (*Blob, error) {
+	v := tx.Bucket(boltBlobs).Get([]byte(name))
+	if v == nil {
+		return nil, nil
+	}
+	return decodeBoltBlob(v)
+}
+
+// boltNamesUnder returns the names which are any of the names of under or are located below them, in order.
+func boltNamesUnder(ctx context.Context, tx *bolt.Tx, under Names) (Names, error) {
+	blobs := tx.Bucket(boltBlobs)
+	var rv Names
+	for _, dir := range under {
+		if blobs.Get([]byte(dir)) != nil {
+			rv = append(rv, dir)
+		}
+		lo, hi := nameRange(dir)
+		c := blobs.Cursor()
+		for k, _ := c.Seek([]byte(lo)); k != nil && string(k) < hi; k, _ = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			rv = append(rv, string(k))
+		}
+	}
+	if len(under) > 1 {
+		// the ranges of the names of under may overlap
+		rv.Sort()
+		rv = slices.Compact(rv)
+	}
+	return rv, nil
+}
+
+// boltEachUnder calls fn for every blob which is any of the names of under or is located below
+// them, or for every blob if under is empty, ordered by name.
+func boltEachUnder(ctx context.Context, tx *bolt.Tx, under Names, fn func(*Blob) error) error {
+	if len(under) == 0 {
+		c := tx.Bucket(boltBlobs).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			blob, err := decodeBoltBlob(v)
+			if err != nil {
+				return fmt.Errorf("invalid blob %q: %w", k, err)
+			}
+			if err = fn(blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	names, err := boltNamesUnder(ctx, tx, under)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		blob, err := boltGet(tx, name)
+		if err != nil {
+			return fmt.Errorf("invalid blob %q: %w", name, err)
+		}
+		if err = fn(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltIndex) Store(ctx context.Context, blob *Blob) error {
+	if err := blob.Validate(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		existing, err := boltGet(tx, blob.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if err = existing.CheckOptimisticLock(blob); err != nil {
+				return err
+			}
+			if err = boltDelete(tx, existing); err != nil {
+				return err
+			}
+		}
+		return boltPut(tx, blob)
+	})
+}
+
+func (b *boltIndex) LookupByName(ctx context.Context, name string) (blob *Blob, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		blob, err = boltGet(tx, name)
+		return err
+	})
+	return
+}
+
+func (b *boltIndex) LookupByHash(ctx context.Context, hash []byte) (rv []*Blob, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		prefix := boltHashKey(hash, "")
+		c := tx.Bucket(boltHashes).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			_, name := boltSplitHashKey(k)
+			blob, err := boltGet(tx, name)
+			if err != nil {
+				return err
+			}
+			if blob != nil {
+				rv = append(rv, blob)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (b *boltIndex) LookupByBlockHashes(ctx context.Context, alg crypto.Hash, blockSize int, hashes [][]byte) (rv []*Blob, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		var names Names
+		c := tx.Bucket(boltBlocks).Cursor()
+		for _, hash := range hashes {
+			prefix := boltBlockKey(alg, blockSize, hash, "")
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				names = append(names, string(k[len(prefix):]))
+			}
+		}
+		names.Sort()
+		for _, name := range slices.Compact(names) {
+			blob, err := boltGet(tx, name)
+			if err != nil {
+				return err
+			}
+			if blob != nil {
+				rv = append(rv, blob)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (b *boltIndex) Query(ctx context.Context, q *Query) ([]*Blob, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var rv []*Blob
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltEachUnder(ctx, tx, q.Under, func(blob *Blob) error {
+			if q.Match(blob) {
+				rv = append(rv, blob)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.sortAndLimit(rv), nil
+}
+
+func (b *boltIndex) Stats(ctx context.Context, under Names, top int) (*Stats, error) {
+	sb := newStatsBuilder(under)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltEachUnder(ctx, tx, under, func(blob *Blob) error {
+			sb.add(blob)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sb.finish(top), nil
+}
+
+func (b *boltIndex) FindEqualHashes(ctx context.Context) (rv []EqualBlobs, err error) {
+	err = b.ForEachEqualHashes(ctx, nil, func(equal EqualBlobs) error {
+		rv = append(rv, equal)
+		return nil
+	})
+	return
+}
+
+func (b *boltIndex) ForEachEqualHashes(ctx context.Context, under Names, fn func(EqualBlobs) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		// the hashes of the blobs under, nil for all hashes
+		var hashes map[string]bool
+		if len(under) > 0 {
+			hashes = make(map[string]bool)
+			err := boltEachUnder(ctx, tx, under, func(blob *Blob) error {
+				hashes[string(blob.Hash)] = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		var hash []byte
+		var equal EqualBlobs
+		emit := func() error {
+			if len(equal.Names) < 2 || equal.Size == 0 || (hashes != nil && !hashes[string(hash)]) {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(equal)
+		}
+		c := tx.Bucket(boltHashes).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			h, name := boltSplitHashKey(k)
+			if !bytes.Equal(h, hash) {
+				if err := emit(); err != nil {
+					return err
+				}
+				hash = append(hash[:0], h...)
+				equal = EqualBlobs{}
+			}
+			size, _ := binary.Uvarint(v)
+			equal.AppendRaw(name, int64(size))
+		}
+		return emit()
+	})
+}
+
+func (b *boltIndex) AllNames(ctx context.Context) (rv Names, err error) {
+	err = b.ForEachName(ctx, nil, func(name string) error {
+		rv = append(rv, name)
+		return nil
+	})
+	return
+}
+
+func (b *boltIndex) ForEachName(ctx context.Context, under Names, fn func(string) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		if len(under) == 0 {
+			c := tx.Bucket(boltBlobs).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := fn(string(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		names, err := boltNamesUnder(ctx, tx, under)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltIndex) ForEach(ctx context.Context, fn func(*Blob) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return boltEachUnder(ctx, tx, nil, fn)
+	})
+}
+
+func (b *boltIndex) Remove(ctx context.Context, names Names) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		_, err := boltRemove(tx, names)
+		return err
+	})
+}
+
+func (b *boltIndex) RemoveUnder(ctx context.Context, under Names) (n int, err error) {
+	if len(under) == 0 {
+		return 0, nil
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		names, err := boltNamesUnder(ctx, tx, under)
+		if err != nil {
+			return err
+		}
+		n, err = boltRemove(tx, names)
+		return err
+	})
+	return
+}
+
+// boltRemove removes the blobs and returns how many existed.
+func boltRemove(tx *bolt.Tx, names Names) (int, error) {
+	var n int
+	for _, name := range names {
+		blob, err := boltGet(tx, name)
+		if err != nil {
+			return n, err
+		}
+		if blob == nil {
+			continue
+		}
+		if err = boltDelete(tx, blob); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (b *boltIndex) Count(ctx context.Context) (n int, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltBlobs).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+func (b *boltIndex) StoreVolume(ctx context.Context, volume *Volume) error {
+	if err := volume.Validate(); err != nil {
+		return err
+	}
+	value, err := appendRecord(nil, Record{Volume: volume})
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVolumes).Put([]byte(volume.Name), value)
+	})
+}
+
+func (b *boltIndex) Volumes(ctx context.Context) (rv []*Volume, err error) {
+	rv = []*Volume{}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVolumes).ForEach(func(k, v []byte) error {
+			rec, err := (&binaryReader{r: bytes.NewReader(v)}).Read()
+			if err == nil && rec.Volume == nil {
+				err = errors.New("invalid volume record")
+			}
+			if err != nil {
+				return fmt.Errorf("invalid volume %q: %w", k, err)
+			}
+			rv = append(rv, rec.Volume)
+			return nil
+		})
+	})
+	return
+}
+
+func (b *boltIndex) RemoveVolume(ctx context.Context, name string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVolumes).Delete([]byte(name))
+	})
+}
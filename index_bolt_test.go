@@ -0,0 +1,94 @@
+package blkidx
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openBolt(t *testing.T, file string) (Index, *bolt.DB) {
+	db, err := bolt.Open(file, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewBoltIndex(context.Background(), db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return idx, db
+}
+
+func blobNames(blobs []*Blob) string {
+	var names []string
+	for _, b := range blobs {
+		names = append(names, b.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestBoltIndexLookups(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "index.bolt")
+	idx, db := openBolt(t, file)
+
+	a := storeContent(t, idx, "/a", "same content")
+	storeContent(t, idx, "/b", "same content")
+	c := storeContent(t, idx, "/c", "same cont...")
+
+	blobs, err := idx.LookupByHash(ctx, a.Hash)
+	if err != nil || blobNames(blobs) != "/a /b" {
+		t.Errorf("by hash - got %q, %v", blobNames(blobs), err)
+	}
+	// the first two blocks of "same cont..." are shared with "same content"
+	blobs, err = idx.LookupByBlockHashes(ctx, c.HashAlgorithm, c.HashBlockSize, c.HashedBlocks)
+	if err != nil || blobNames(blobs) != "/a /b /c" {
+		t.Errorf("by block hashes - got %q, %v", blobNames(blobs), err)
+	}
+
+	// an update replaces the hashes of the previous version
+	update := storeContent(t, NewMemoryIndex(), "/a", "other")
+	update.Version = a.Version + 1
+	if err = idx.Store(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, err = idx.LookupByHash(ctx, a.Hash); err != nil || blobNames(blobs) != "/b" {
+		t.Errorf("by old hash after update - got %q, %v", blobNames(blobs), err)
+	}
+	if blobs, err = idx.LookupByHash(ctx, update.Hash); err != nil || blobNames(blobs) != "/a" {
+		t.Errorf("by new hash after update - got %q, %v", blobNames(blobs), err)
+	}
+	if err = idx.Remove(ctx, Names{"/b"}); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err = idx.LookupByBlockHashes(ctx, c.HashAlgorithm, c.HashBlockSize, c.HashedBlocks)
+	if err != nil || blobNames(blobs) != "/c" {
+		t.Errorf("by block hashes after remove - got %q, %v", blobNames(blobs), err)
+	}
+
+	if err = idx.StoreVolume(ctx, &Volume{Name: "usb", ID: "marker:1", Root: "/mnt/usb"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	idx, db = openBolt(t, file)
+	defer db.Close()
+	if n, err := idx.Count(ctx); n != 2 || err != nil {
+		t.Errorf("count after reopen - want 2; got %d, %v", n, err)
+	}
+	stats, err := idx.Stats(ctx, nil, 0)
+	if err != nil || stats.Total.Files != 2 || stats.Total.Bytes != update.Size+c.Size {
+		t.Errorf("stats - got %+v, %v", stats, err)
+	}
+	blobs, err = idx.Query(ctx, &Query{Under: Names{"/a"}})
+	if err != nil || blobNames(blobs) != "/a" {
+		t.Errorf("query - got %q, %v", blobNames(blobs), err)
+	}
+	volumes, err := idx.Volumes(ctx)
+	if err != nil || len(volumes) != 1 || volumes[0].Root != "/mnt/usb" {
+		t.Errorf("volumes - got %v, %v", volumes, err)
+	}
+}
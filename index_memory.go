@@ -2,24 +2,30 @@ package blkidx
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"slices"
 	"sort"
 	"sync"
 )
 
 type memoryIndex struct {
-	rwmu  sync.RWMutex
-	blobs map[string]*Blob
+	rwmu    sync.RWMutex
+	blobs   map[string]*Blob
+	names   Names // the names of all blobs, sorted
+	volumes map[string]Volume
 }
 
 var _ Index = (*memoryIndex)(nil)
 
 func NewMemoryIndex() Index {
 	return &memoryIndex{
-		blobs: make(map[string]*Blob, 1024),
+		blobs:   make(map[string]*Blob, 1024),
+		volumes: make(map[string]Volume),
 	}
 }
 
-func (m *memoryIndex) Store(blob *Blob) error {
+func (m *memoryIndex) Store(ctx context.Context, blob *Blob) error {
 	if err := blob.Validate(); err != nil {
 		return err
 	}
@@ -31,86 +37,298 @@ func (m *memoryIndex) Store(blob *Blob) error {
 			return err
 		}
 	}
+	m.put(blob)
+	return nil
+}
 
+// put stores the blob without checking its version. the write lock must be held.
+func (m *memoryIndex) put(blob *Blob) {
+	if _, found := m.blobs[blob.Name]; !found {
+		i := sort.SearchStrings(m.names, blob.Name)
+		m.names = append(m.names, "")
+		copy(m.names[i+1:], m.names[i:])
+		m.names[i] = blob.Name
+	}
 	m.blobs[blob.Name] = blob
-	return nil
 }
 
-func (m *memoryIndex) LookupByName(name string) (*Blob, error) {
+// namesUnder returns the names which are any of the names of under or are located below them,
+// or all names if under is empty, in order. the read lock must be held.
+func (m *memoryIndex) namesUnder(under Names) Names {
+	if len(under) == 0 {
+		return append(Names(nil), m.names...)
+	}
+	var rv Names
+	for _, dir := range under {
+		if i := sort.SearchStrings(m.names, dir); i < len(m.names) && m.names[i] == dir {
+			rv = append(rv, dir)
+		}
+		lo, hi := nameRange(dir)
+		rv = append(rv, m.names[sort.SearchStrings(m.names, lo):sort.SearchStrings(m.names, hi)]...)
+	}
+	if len(under) > 1 {
+		// the ranges of the names of under may overlap
+		rv.Sort()
+		rv = slices.Compact(rv)
+	}
+	return rv
+}
+
+// eachUnder calls fn for every blob which is any of the names of under or is located below them,
+// or for every blob if under is empty. the read lock must be held.
+func (m *memoryIndex) eachUnder(under Names, fn func(*Blob)) {
+	if len(under) == 0 {
+		for _, blob := range m.blobs {
+			fn(blob)
+		}
+		return
+	}
+	for _, name := range m.namesUnder(under) {
+		fn(m.blobs[name])
+	}
+}
+
+func (m *memoryIndex) LookupByName(ctx context.Context, name string) (*Blob, error) {
 	m.rwmu.RLock()
 	defer m.rwmu.RUnlock()
 
 	return m.blobs[name], nil
 }
 
-func (m *memoryIndex) FindEqualHashes() (rv []EqualBlobs, err error) {
+func (m *memoryIndex) LookupByHash(ctx context.Context, hash []byte) ([]*Blob, error) {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	var rv []*Blob
+	for _, blob := range m.blobs {
+		if bytes.Equal(blob.Hash, hash) {
+			rv = append(rv, blob)
+		}
+	}
+	sort.Sort(byName(rv))
+	return rv, nil
+}
+
+func (m *memoryIndex) LookupByBlockHashes(ctx context.Context, alg crypto.Hash, blockSize int, hashes [][]byte) ([]*Blob, error) {
 	m.rwmu.RLock()
 	defer m.rwmu.RUnlock()
 
-	if len(m.blobs) <= 1 {
-		return nil, nil
+	var rv []*Blob
+	set := newHashSet(hashes)
+	for _, blob := range m.blobs {
+		if blob.HashAlgorithm == alg && blob.HashBlockSize == blockSize && set.containsAny(blob.HashedBlocks) {
+			rv = append(rv, blob)
+		}
+	}
+	sort.Sort(byName(rv))
+	return rv, nil
+}
+
+func (m *memoryIndex) Query(ctx context.Context, q *Query) ([]*Blob, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
 	}
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	var rv []*Blob
+	m.eachUnder(q.Under, func(blob *Blob) {
+		if q.Match(blob) {
+			rv = append(rv, blob)
+		}
+	})
+	return q.sortAndLimit(rv), nil
+}
 
-	// TODO: measure/profile and maybe implement a proper algorithm
-	var all []*Blob = make([]*Blob, 0, len(m.blobs))
+func (m *memoryIndex) Stats(ctx context.Context, under Names, top int) (*Stats, error) {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	b := newStatsBuilder(under)
+	m.eachUnder(under, b.add)
+	return b.finish(top), nil
+}
+
+func (m *memoryIndex) FindEqualHashes(ctx context.Context) (rv []EqualBlobs, err error) {
+	err = m.ForEachEqualHashes(ctx, nil, func(equal EqualBlobs) error {
+		rv = append(rv, equal)
+		return nil
+	})
+	return
+}
 
+func (m *memoryIndex) ForEachEqualHashes(ctx context.Context, under Names, fn func(EqualBlobs) error) error {
+	m.rwmu.RLock()
+	// the hashes of the blobs under, nil for all hashes
+	var hashes map[string]bool
+	if len(under) > 0 {
+		hashes = make(map[string]bool)
+		m.eachUnder(under, func(blob *Blob) { hashes[string(blob.Hash)] = true })
+	}
+	var all []*Blob
 	for _, blob := range m.blobs {
-		if blob.Size > 0 {
+		if blob.Size > 0 && (hashes == nil || hashes[string(blob.Hash)]) {
 			all = append(all, blob)
 		}
 	}
+	m.rwmu.RUnlock()
 
 	sort.Sort(byHash(all))
-
-	i := 0
-	for i+1 < len(all) {
-		var equal EqualBlobs
-		if all[i].EqualHash(all[i+1]) {
-			equal.Append(all[i])
-			equal.Append(all[i+1])
-			i++
-			for i+1 < len(all) && all[i].EqualHash(all[i+1]) {
-				equal.Append(all[i+1])
-				i++
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[i].EqualHash(all[j]) {
+			j++
+		}
+		if j-i > 1 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var equal EqualBlobs
+			for _, blob := range all[i:j] {
+				equal.Append(blob)
+			}
+			if err := fn(equal); err != nil {
+				return err
 			}
-			rv = append(rv, equal)
 		}
+		i = j
 	}
+	return nil
+}
+
+func (m *memoryIndex) AllNames(ctx context.Context) (rv Names, err error) {
+	err = m.ForEachName(ctx, nil, func(name string) error {
+		rv = append(rv, name)
+		return nil
+	})
 	return
 }
 
-func (m *memoryIndex) AllNames() (Names, error) {
+func (m *memoryIndex) ForEachName(ctx context.Context, under Names, fn func(string) error) error {
 	m.rwmu.RLock()
-	defer m.rwmu.RUnlock()
+	names := m.namesUnder(under)
+	m.rwmu.RUnlock()
 
-	var rv Names = make(Names, 0, len(m.blobs))
-	for name, _ := range m.blobs {
-		rv = append(rv, name)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(name); err != nil {
+			return err
+		}
 	}
-	return rv, nil
+	return nil
+}
+
+func (m *memoryIndex) ForEach(ctx context.Context, fn func(*Blob) error) error {
+	m.rwmu.RLock()
+	all := make([]*Blob, 0, len(m.blobs))
+	for _, blob := range m.blobs {
+		all = append(all, blob)
+	}
+	m.rwmu.RUnlock()
+
+	sort.Sort(byName(all))
+	for _, blob := range all {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryIndex) Remove(ctx context.Context, names Names) error {
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+
+	m.remove(names)
+	return nil
 }
 
-func (m *memoryIndex) Remove(names Names) error {
+func (m *memoryIndex) RemoveUnder(ctx context.Context, under Names) (int, error) {
+	if len(under) == 0 {
+		return 0, nil
+	}
 	m.rwmu.Lock()
 	defer m.rwmu.Unlock()
 
+	return m.remove(m.namesUnder(under)), nil
+}
+
+// remove removes the blobs and returns how many existed. the write lock must be held.
+func (m *memoryIndex) remove(names Names) int {
+	var n int
 	for _, name := range names {
-		delete(m.blobs, name)
+		if _, found := m.blobs[name]; found {
+			delete(m.blobs, name)
+			n++
+		}
 	}
-	return nil
+	if n > 0 {
+		m.names = slices.DeleteFunc(m.names, func(name string) bool { return m.blobs[name] == nil })
+	}
+	return n
 }
 
-func (m *memoryIndex) Count() (int, error) {
+func (m *memoryIndex) Count(ctx context.Context) (int, error) {
 	m.rwmu.RLock()
 	defer m.rwmu.RUnlock()
 
 	return len(m.blobs), nil
 }
 
+func (m *memoryIndex) StoreVolume(ctx context.Context, volume *Volume) error {
+	if err := volume.Validate(); err != nil {
+		return err
+	}
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+
+	m.volumes[volume.Name] = *volume
+	return nil
+}
+
+func (m *memoryIndex) Volumes(ctx context.Context) ([]*Volume, error) {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	rv := make([]*Volume, 0, len(m.volumes))
+	for _, v := range m.volumes {
+		v := v
+		rv = append(rv, &v)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv, nil
+}
+
+func (m *memoryIndex) RemoveVolume(ctx context.Context, name string) error {
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+
+	delete(m.volumes, name)
+	return nil
+}
+
 type byHash []*Blob
 
 var _ sort.Interface = (*byHash)(nil)
 
-func (s byHash) Len() int           { return len(s) }
-func (s byHash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s byHash) Less(i, j int) bool { return bytes.Compare(s[i].Hash, s[j].Hash) <= 0 }
+func (s byHash) Len() int      { return len(s) }
+func (s byHash) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byHash) Less(i, j int) bool {
+	if c := bytes.Compare(s[i].Hash, s[j].Hash); c != 0 {
+		return c < 0
+	}
+	return s[i].Name < s[j].Name
+}
+
+type byName []*Blob
+
+var _ sort.Interface = (*byName)(nil)
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -1,15 +1,21 @@
 package blkidx
 
 import (
+	"context"
+	"crypto"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/base64"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 type sqlIndex struct {
 	db *sql.DB
+	d  *SqlDialect
 
 	insertStmt      *sql.Stmt
 	updateStmt      *sql.Stmt
@@ -18,44 +24,77 @@ type sqlIndex struct {
 	allNamesStmt    *sql.Stmt
 	removeStmt      *sql.Stmt
 	countStmt       *sql.Stmt
+
+	lookupByHashStmt *sql.Stmt
+	allStmt          *sql.Stmt
+	existsStmt       *sql.Stmt
+	insertBlockStmt  *sql.Stmt
+	removeBlocksStmt *sql.Stmt
 }
 
 var _ Index = (*sqlIndex)(nil)
 
-func NewSqlIndex(db *sql.DB) (Index, error) {
+// NewSqlIndex returns an index which is stored in a SQLite database, see NewSqlIndexWithDialect.
+func NewSqlIndex(ctx context.Context, db *sql.DB) (Index, error) {
+	return NewSqlIndexWithDialect(ctx, db, SqliteDialect)
+}
+
+// NewSqlIndexWithDialect returns an index which is stored in a database of the dialect.
+// The schema is created or upgraded to the latest version.
+func NewSqlIndexWithDialect(ctx context.Context, db *sql.DB, d *SqlDialect) (Index, error) {
 	var err error
 
-	if err = initOrUpgradeDb(db); err != nil {
+	if err = initOrUpgradeDb(ctx, db, d); err != nil {
 		return nil, err
 	}
 
-	idx := &sqlIndex{db: db}
+	idx := &sqlIndex{db: db, d: d}
 
-	idx.insertStmt, err = db.Prepare(sqlIndex_insert)
+	idx.insertStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_insert))
+	if err != nil {
+		return nil, err
+	}
+	idx.updateStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_update))
 	if err != nil {
 		return nil, err
 	}
-	idx.updateStmt, err = db.Prepare(sqlIndex_update)
+	idx.lookupStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_lookup))
 	if err != nil {
 		return nil, err
 	}
-	idx.lookupStmt, err = db.Prepare(sqlIndex_lookup)
+	idx.lookupByHashStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_lookupByHash))
 	if err != nil {
 		return nil, err
 	}
-	idx.equalHashesStmt, err = db.Prepare(sqlIndex_equalHashes)
+	idx.insertBlockStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_insertBlock))
 	if err != nil {
 		return nil, err
 	}
-	idx.allNamesStmt, err = db.Prepare(sqlIndex_allNames)
+	idx.removeBlocksStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_removeBlocks))
 	if err != nil {
 		return nil, err
 	}
-	idx.removeStmt, err = db.Prepare(sqlIndex_remove)
+	idx.allStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_all))
 	if err != nil {
 		return nil, err
 	}
-	idx.countStmt, err = db.Prepare(sqlIndex_count)
+	idx.existsStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_exists))
+	if err != nil {
+		return nil, err
+	}
+	idx.equalHashesStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_equalHashes))
+	if err != nil {
+		return nil, err
+	}
+	idx.allNamesStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_allNames))
+	if err != nil {
+		return nil, err
+	}
+	idx.removeStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_remove))
+	if err != nil {
+		return nil, err
+	}
+	idx.countStmt, err = db.PrepareContext(ctx, d.rebind(sqlIndex_count))
 	if err != nil {
 		return nil, err
 	}
@@ -63,12 +102,12 @@ func NewSqlIndex(db *sql.DB) (Index, error) {
 	return idx, nil
 }
 
-func (s *sqlIndex) Store(blob *Blob) error {
+func (s *sqlIndex) Store(ctx context.Context, blob *Blob) error {
 	if err := blob.Validate(); err != nil {
 		return err
 	}
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -76,17 +115,29 @@ func (s *sqlIndex) Store(blob *Blob) error {
 	var res sql.Result
 	var sqlErr error
 	var action string
-	if blob.Version == 0 {
+	insert := blob.Version == 0
+	if !insert {
+		// like the memory index a blob which does not exist is stored with any version
+		var count int
+		if err = tx.StmtContext(ctx, s.existsStmt).QueryRowContext(ctx, blob.Name).Scan(&count); err != nil {
+			tx.Rollback()
+			return err
+		}
+		insert = count == 0
+	}
+	if insert {
 		action = "insert"
-		res, sqlErr = tx.Stmt(s.insertStmt).Exec(blob.Name, blob.Version, blob.IndexTime,
-			blob.Size, blob.ModTime, blob.HashAlgorithm,
-			sqlSB(blob.Hash), blob.HashBlockSize, sqlSSB(blob.HashedBlocks))
+		res, sqlErr = tx.StmtContext(ctx, s.insertStmt).ExecContext(ctx, blob.Name, blob.Version, blob.IndexTime.UTC(),
+			blob.Size, blob.ModTime.UTC(), blob.HashAlgorithm,
+			s.d.hashArg(blob.Hash), blob.HashBlockSize, s.d.blocksArg(blob.HashedBlocks),
+			sqlOptTime(blob.ChangeTime.UTC()), int64(blob.Inode), int64(blob.ChangeAttr))
 
 	} else {
 		action = "update"
-		res, sqlErr = tx.Stmt(s.updateStmt).Exec(blob.IndexTime,
-			blob.Size, blob.ModTime, blob.HashAlgorithm,
-			sqlSB(blob.Hash), blob.HashBlockSize, sqlSSB(blob.HashedBlocks),
+		res, sqlErr = tx.StmtContext(ctx, s.updateStmt).ExecContext(ctx, blob.IndexTime.UTC(),
+			blob.Size, blob.ModTime.UTC(), blob.HashAlgorithm,
+			s.d.hashArg(blob.Hash), blob.HashBlockSize, s.d.blocksArg(blob.HashedBlocks),
+			sqlOptTime(blob.ChangeTime.UTC()), int64(blob.Inode), int64(blob.ChangeAttr),
 			blob.Name, blob.Version-1)
 	}
 	if sqlErr != nil {
@@ -100,47 +151,445 @@ func (s *sqlIndex) Store(blob *Blob) error {
 			FailedVersion: blob.Version,
 		}
 	}
+	if err = s.storeBlocks(ctx, tx, blob); err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
-func (s *sqlIndex) LookupByName(name string) (*Blob, error) {
-	b := new(Blob)
-	tx, err := s.db.Begin()
+// storeBlocks replaces the rows of t_blocks of a blob.
+func (s *sqlIndex) storeBlocks(ctx context.Context, tx *sql.Tx, blob *Blob) error {
+	if _, err := tx.StmtContext(ctx, s.removeBlocksStmt).ExecContext(ctx, blob.Name); err != nil {
+		return err
+	}
+	stmt := tx.StmtContext(ctx, s.insertBlockStmt)
+	for _, block := range blob.HashedBlocks {
+		if _, err := stmt.ExecContext(ctx, blob.HashAlgorithm, blob.HashBlockSize, s.d.hashArg(block), blob.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlIndex) LookupByName(ctx context.Context, name string) (*Blob, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	row := tx.Stmt(s.lookupStmt).QueryRow(name)
-	var hash sqlSB
-	var hashBlocks sqlSSB
-	err = row.Scan(&b.Name, &b.Version, &b.IndexTime,
-		&b.Size, &b.ModTime, &b.HashAlgorithm,
-		&hash, &b.HashBlockSize, &hashBlocks)
-
+	row := tx.StmtContext(ctx, s.lookupStmt).QueryRowContext(ctx, name)
+	b, err := s.scanBlob(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
+	return b, nil
+}
+
+func (s *sqlIndex) LookupByHash(ctx context.Context, hash []byte) ([]*Blob, error) {
+	return s.queryBlobs(ctx, s.lookupByHashStmt, s.d.hashArg(hash))
+}
+
+// the maximum number of hashes per query of LookupByBlockHashes, which stays below
+// the limits of the number of parameters of the database systems.
+const sqlIndex_blockBatch = 500
+
+func (s *sqlIndex) LookupByBlockHashes(ctx context.Context, alg crypto.Hash, blockSize int, hashes [][]byte) ([]*Blob, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// a blob matches the hashes of several batches at most once
+	found := make(map[string]*Blob)
+	for len(hashes) > 0 {
+		batch := hashes[:min(len(hashes), sqlIndex_blockBatch)]
+		hashes = hashes[len(batch):]
+		args := []interface{}{alg, blockSize}
+		for _, hash := range batch {
+			args = append(args, s.d.hashArg(hash))
+		}
+		query := fmt.Sprintf(sqlIndex_lookupByBlocks, strings.TrimPrefix(strings.Repeat(",?", len(batch)), ","))
+		err = s.each(ctx, tx, func(rows *sql.Rows) error {
+			b, err := s.scanBlob(rows)
+			if err != nil {
+				return err
+			}
+			found[b.Name] = b
+			return nil
+		}, query, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rv := make([]*Blob, 0, len(found))
+	for _, b := range found {
+		rv = append(rv, b)
+	}
+	sort.Sort(byName(rv))
+	return rv, nil
+}
+
+// queryBlobs returns all blobs of a query which selects sqlIndex_fields.
+func (s *sqlIndex) queryBlobs(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (rv []*Blob, err error) {
+	err = s.forEachBlob(ctx, stmt, func(b *Blob) error {
+		rv = append(rv, b)
+		return nil
+	}, args...)
+	return rv, err
+}
+
+// forEachBlob calls fn for each blob of a query which selects sqlIndex_fields.
+func (s *sqlIndex) forEachBlob(ctx context.Context, stmt *sql.Stmt, fn func(*Blob) error, args ...interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.StmtContext(ctx, stmt).QueryContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		b, err := s.scanBlob(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanBlob scans a row of sqlIndex_fields
+func (s *sqlIndex) scanBlob(row interface{ Scan(...interface{}) error }) (*Blob, error) {
+	b := new(Blob)
+	var hash, hashBlocks []byte
+	var changeTime sqlOptTime
+	var inode, changeAttr int64
+	err := row.Scan(&b.Name, &b.Version, &b.IndexTime,
+		&b.Size, &b.ModTime, &b.HashAlgorithm,
+		&hash, &b.HashBlockSize, &hashBlocks,
+		&changeTime, &inode, &changeAttr)
+	if err != nil {
+		return nil, err
+	}
+	if b.Hash, err = s.d.scanHash(hash); err != nil {
+		return nil, err
+	}
+	if b.HashedBlocks, err = s.d.scanBlocks(hashBlocks); err != nil {
+		return nil, err
+	}
 	b.IndexTime = b.IndexTime.UTC()
 	b.ModTime = b.ModTime.UTC()
-	b.Hash = []byte(hash)
-	b.HashedBlocks = [][]byte(hashBlocks)
+	b.ChangeTime = time.Time(changeTime).UTC()
+	b.Inode = uint64(inode)
+	b.ChangeAttr = uint64(changeAttr)
 	return b, nil
 }
 
-func (s *sqlIndex) FindEqualHashes() (rv []EqualBlobs, err error) {
-	tx, err := s.db.Begin()
+// Query selects blobs by ranges of the indexed columns. Globs and the exact hash prefix
+// are matched in go, in which case the limit is applied while reading the rows.
+func (s *sqlIndex) Query(ctx context.Context, q *Query) (rv []*Blob, err error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	query, args := sqlQuery(s.d, q)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() && (q.Limit == 0 || len(rv) < q.Limit) {
+		b, err := s.scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		if q.Match(b) {
+			rv = append(rv, b)
+		}
+	}
+	return rv, rows.Err()
+}
+
+// sqlQuery returns the statement and arguments of a query in the dialect.
+func sqlQuery(d *SqlDialect, q *Query) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	cond := func(c string, a ...interface{}) {
+		where = append(where, c)
+		args = append(args, a...)
+	}
+
+	if under, underArgs := sqlUnder(q.Under); under != "" {
+		cond(under, underArgs...)
+	}
+	if q.MinSize > 0 {
+		cond("size >= ?", q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		cond("size < ?", q.MaxSize)
+	}
+	if !q.ModifiedSince.IsZero() {
+		cond("mod_time >= ?", q.ModifiedSince.UTC())
+	}
+	if !q.ModifiedBefore.IsZero() {
+		cond("mod_time < ?", q.ModifiedBefore.UTC())
+	}
+	if !q.IndexedSince.IsZero() {
+		cond("index_time >= ?", q.IndexedSince.UTC())
+	}
+	if !q.IndexedBefore.IsZero() {
+		cond("index_time < ?", q.IndexedBefore.UTC())
+	}
+	if prefix, _ := q.hashPrefix(); len(prefix) > 0 {
+		if lo, hi, ok := d.hashRange(prefix); ok {
+			cond("hash >= ? AND hash < ?", lo, hi)
+		}
+	}
+	if q.HashAlgorithm != 0 {
+		cond("hash_algorithm = ?", q.HashAlgorithm)
+	}
+	if q.HashBlockSize != 0 {
+		cond("hash_block_size = ?", q.HashBlockSize)
+	}
+
+	stmt := `SELECT ` + sqlIndex_fields + ` FROM t_blobs`
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	dir := ""
+	if q.Descending {
+		dir = " DESC"
+	}
+	if column := sqlQuery_order[q.Order]; column != "name" {
+		stmt += " ORDER BY " + column + dir + ", name" + dir
+	} else {
+		stmt += " ORDER BY name" + dir
+	}
+	if q.Limit > 0 && q.exact() {
+		stmt += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	return d.rebind(stmt), args
+}
+
+var sqlQuery_order = map[QueryOrder]string{
+	OrderByName:      "name",
+	OrderBySize:      "size",
+	OrderByModTime:   "mod_time",
+	OrderByIndexTime: "index_time",
+}
+
+// sqlUnder returns the condition which selects the names located below any of the names of under,
+// it is empty if there are no names.
+func sqlUnder(under Names) (string, []interface{}) {
+	if len(under) == 0 {
+		return "", nil
+	}
+	var conds []string
+	var args []interface{}
+	for _, dir := range under {
+		lo, hi := nameRange(dir)
+		conds = append(conds, "name = ? OR (name >= ? AND name < ?)")
+		args = append(args, dir, lo, hi)
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// hashRange returns the range [lo, hi) of the base64 encoded hashes starting with prefix.
+// ok is false if the prefix is too short to restrict the range.
+func hashRange(prefix []byte) (lo, hi string, ok bool) {
+	prefix = prefix[:len(prefix)/3*3] // complete base64 groups only
+	if len(prefix) == 0 {
+		return "", "", false
+	}
+	lo = base64.StdEncoding.EncodeToString(prefix)
+	return lo, lo[:len(lo)-1] + string(lo[len(lo)-1]+1), true
+}
+
+// Stats aggregates in the database, only the duplicates of the largest groups
+// and the counts per directory are read.
+func (s *sqlIndex) Stats(ctx context.Context, under Names, top int) (*Stats, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
-	rows, err := tx.Stmt(s.equalHashesStmt).Query()
+	underCond, args := sqlUnder(under)
+	where := func(conds ...string) string {
+		if underCond != "" {
+			conds = append([]string{underCond}, conds...)
+		}
+		if len(conds) == 0 {
+			return ""
+		}
+		return " WHERE " + strings.Join(conds, " AND ")
+	}
+	limit := ""
+	if top > 0 {
+		limit = fmt.Sprintf(" LIMIT %d", top)
+	}
+	dups := `WITH dup AS (
+		SELECT hash, COUNT(*) AS n, MAX(size) AS size, MIN(name) AS first
+		FROM t_blobs` + where("size > 0") + `
+		GROUP BY hash HAVING COUNT(*) > 1) `
+
+	st := newStats()
+	err = s.each(ctx, tx, func(rows *sql.Rows) error {
+		var bucket int
+		var c StatsCount
+		if err := rows.Scan(&bucket, &c.Files, &c.Bytes); err != nil {
+			return err
+		}
+		st.Total.add(c.Files, c.Bytes)
+		st.Sizes[bucket].add(c.Files, c.Bytes)
+		return nil
+	}, `SELECT `+sqlStats_bucket()+` AS bucket, COUNT(*), SUM(size) FROM t_blobs`+where()+` GROUP BY bucket`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.each(ctx, tx, func(rows *sql.Rows) error {
+		var e ExtensionStats
+		if err := rows.Scan(&e.Extension, &e.Files, &e.Bytes); err != nil {
+			return err
+		}
+		st.Extensions = append(st.Extensions, e)
+		return nil
+	}, `SELECT `+s.d.statsExt()+` AS ext, COUNT(*), SUM(size) FROM t_blobs`+where()+`
+		GROUP BY ext ORDER BY SUM(size) DESC, ext`+limit, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, s.d.rebind(dups+`SELECT
+		COALESCE(SUM(n), 0), COALESCE(SUM(n * size), 0), COALESCE(SUM((n - 1) * size), 0)
+		FROM dup`), args...).Scan(&st.Duplicates.Files, &st.Duplicates.Bytes, &st.RedundantBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes [][]byte
+	err = s.each(ctx, tx, func(rows *sql.Rows) error {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return err
+		}
+		h, err := s.d.scanHash(value)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h)
+		return nil
+	}, dups+`SELECT hash FROM dup ORDER BY (n - 1) * size DESC, first`+limit, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		var equal EqualBlobs
+		err = s.each(ctx, tx, func(rows *sql.Rows) error {
+			var name string
+			var size int64
+			if err := rows.Scan(&name, &size); err != nil {
+				return err
+			}
+			equal.AppendRaw(name, size)
+			return nil
+		}, `SELECT name, size FROM t_blobs`+where("hash = ?"), append(args, s.d.hashArg(h))...)
+		if err != nil {
+			return nil, err
+		}
+		st.Groups = append(st.Groups, equal)
+	}
+
+	dirs := make(map[string]*StatsCount)
+	err = s.each(ctx, tx, func(rows *sql.Rows) error {
+		var dir string
+		var c StatsCount
+		if err := rows.Scan(&dir, &c.Files, &c.Bytes); err != nil {
+			return err
+		}
+		addDirStats(dirs, dir, under, c.Files, c.Bytes)
+		return nil
+	}, dups+`SELECT dir, COUNT(*), SUM(size) FROM (
+		SELECT `+sqlStats_dir+` AS dir, size FROM t_blobs`+where("hash IN (SELECT hash FROM dup)")+`) AS d
+		GROUP BY dir`, append(args, args...)...)
 	if err != nil {
 		return nil, err
 	}
+	st.finish(dirs, top)
+	return st, nil
+}
+
+// each calls fn for every row of the query.
+func (s *sqlIndex) each(ctx context.Context, tx *sql.Tx, fn func(rows *sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := tx.QueryContext(ctx, s.d.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sqlStats_bucket returns the expression of the index of the size bucket of a blob.
+func sqlStats_bucket() string {
+	e := "CASE"
+	for i, max := range StatsSizeBuckets {
+		e += fmt.Sprintf(" WHEN size < %d THEN %d", max, i)
+	}
+	return e + fmt.Sprintf(" ELSE %d END", len(StatsSizeBuckets))
+}
+
+var (
+	// the directory part of a name including its trailing separator, see nameDir
+	sqlStats_dir = `rtrim(name, replace(replace(name, '/', ''), '` + string(filepath.Separator) + `', ''))`
+
+	sqlStats_base = `substr(name, length(` + sqlStats_dir + `) + 1)`
+)
+
+func (s *sqlIndex) FindEqualHashes(ctx context.Context) (rv []EqualBlobs, err error) {
+	err = s.ForEachEqualHashes(ctx, nil, func(equal EqualBlobs) error {
+		rv = append(rv, equal)
+		return nil
+	})
+	return
+}
+
+func (s *sqlIndex) ForEachEqualHashes(ctx context.Context, under Names, fn func(EqualBlobs) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := s.rowsUnder(ctx, tx, s.equalHashesStmt, sqlIndex_equalHashesUnder, under)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
 	var currentHash string
@@ -148,58 +597,86 @@ func (s *sqlIndex) FindEqualHashes() (rv []EqualBlobs, err error) {
 	for rows.Next() {
 		var h, n string
 		var size int64
-		err = rows.Scan(&h, &n, &size)
-		if err != nil {
-			return nil, err
+		if err = rows.Scan(&h, &n, &size); err != nil {
+			return err
 		}
-		if currentHash == "" || currentHash == h {
-			equal.AppendRaw(n, size)
-		} else {
-			rv = append(rv, equal)
+		if h != currentHash && len(equal.Names) > 0 {
+			if err = fn(equal); err != nil {
+				return err
+			}
 			equal = EqualBlobs{} // reset
-			equal.AppendRaw(n, size)
 		}
+		equal.AppendRaw(n, size)
 		currentHash = h
 	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
 	if len(equal.Names) > 0 {
-		rv = append(rv, equal)
+		return fn(equal)
 	}
+	return nil
+}
+
+func (s *sqlIndex) AllNames(ctx context.Context) (rv Names, err error) {
+	err = s.ForEachName(ctx, nil, func(name string) error {
+		rv = append(rv, name)
+		return nil
+	})
 	return
 }
 
-func (s *sqlIndex) AllNames() (rv Names, err error) {
-	tx, err := s.db.Begin()
+func (s *sqlIndex) ForEachName(ctx context.Context, under Names, fn func(string) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer tx.Rollback()
 
-	rows, err := tx.Stmt(s.allNamesStmt).Query()
+	rows, err := s.rowsUnder(ctx, tx, s.allNamesStmt, sqlIndex_namesUnder, under)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var n string
-		err = rows.Scan(&n)
-		if err != nil {
-			return nil, err
+		if err = rows.Scan(&n); err != nil {
+			return err
+		}
+		if err = fn(n); err != nil {
+			return err
 		}
-		rv = append(rv, n)
 	}
-	return
+	return rows.Err()
 }
 
-func (s *sqlIndex) Remove(names Names) (err error) {
-	tx, err := s.db.Begin()
+// rowsUnder runs the prepared statement stmt if under is empty, otherwise query,
+// in which %s is replaced by the condition of under (see sqlUnder).
+func (s *sqlIndex) rowsUnder(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, query string, under Names) (*sql.Rows, error) {
+	cond, args := sqlUnder(under)
+	if cond == "" {
+		return tx.StmtContext(ctx, stmt).QueryContext(ctx)
+	}
+	return tx.QueryContext(ctx, s.d.rebind(fmt.Sprintf(query, cond)), args...)
+}
+
+func (s *sqlIndex) ForEach(ctx context.Context, fn func(*Blob) error) error {
+	return s.forEachBlob(ctx, s.allStmt, fn)
+}
+
+func (s *sqlIndex) Remove(ctx context.Context, names Names) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	stmt := tx.Stmt(s.removeStmt)
+	stmt := tx.StmtContext(ctx, s.removeStmt)
+	blocksStmt := tx.StmtContext(ctx, s.removeBlocksStmt)
 	for _, name := range names {
-		_, err = stmt.Exec(name)
+		if _, err = stmt.ExecContext(ctx, name); err == nil {
+			_, err = blocksStmt.ExecContext(ctx, name)
+		}
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -209,15 +686,40 @@ func (s *sqlIndex) Remove(names Names) (err error) {
 	return nil
 }
 
-func (s *sqlIndex) Count() (int, error) {
-	tx, err := s.db.Begin()
+func (s *sqlIndex) RemoveUnder(ctx context.Context, under Names) (int, error) {
+	cond, args := sqlUnder(under)
+	if cond == "" {
+		return 0, nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, s.d.rebind("DELETE FROM t_blocks WHERE "+cond), args...); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM t_blobs WHERE "+cond), args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+func (s *sqlIndex) Count(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
 	defer tx.Rollback()
 
 	var count int
-	row := tx.Stmt(s.countStmt).QueryRow()
+	row := tx.StmtContext(ctx, s.countStmt).QueryRowContext(ctx)
 	err = row.Scan(&count)
 	if err != nil {
 		return 0, err
@@ -225,9 +727,48 @@ func (s *sqlIndex) Count() (int, error) {
 	return count, nil
 }
 
-const (
-	sqlIndex_version = 1
+func (s *sqlIndex) StoreVolume(ctx context.Context, volume *Volume) error {
+	if err := volume.Validate(); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, s.d.rebind(sqlIndex_removeVolume), volume.Name); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, s.d.rebind(sqlIndex_insertVolume), volume.Name, volume.ID, volume.Root); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+func (s *sqlIndex) Volumes(ctx context.Context) (rv []*Volume, err error) {
+	rows, err := s.db.QueryContext(ctx, sqlIndex_volumes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v := new(Volume)
+		if err = rows.Scan(&v.Name, &v.ID, &v.Root); err != nil {
+			return nil, err
+		}
+		rv = append(rv, v)
+	}
+	return rv, rows.Err()
+}
+
+func (s *sqlIndex) RemoveVolume(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(sqlIndex_removeVolume), name)
+	return err
+}
+
+const (
 	sqlIndex_init = `
 	CREATE TABLE IF NOT EXISTS t_blobs (
 		name               TEXT     NOT NULL PRIMARY KEY,
@@ -244,9 +785,10 @@ const (
 	sqlIndex_fields = `
 	name, version, index_time,
 	size, mod_time, hash_algorithm,
-	hash, hash_block_size, hashed_blocks`
+	hash, hash_block_size, hashed_blocks,
+	change_time, inode, change_attr`
 
-	sqlIndex_insert = `INSERT INTO t_blobs (` + sqlIndex_fields + `) values (?,?,?,?,?,?,?,?,?)`
+	sqlIndex_insert = `INSERT INTO t_blobs (` + sqlIndex_fields + `) values (?,?,?,?,?,?,?,?,?,?,?,?)`
 
 	sqlIndex_update = `UPDATE t_blobs SET
 		index_time      = ?,
@@ -255,58 +797,212 @@ const (
 		hash_algorithm  = ?,
 		hash            = ?,
 		hash_block_size = ?,
-		hashed_blocks   = ?
+		hashed_blocks   = ?,
+		change_time     = ?,
+		inode           = ?,
+		change_attr     = ?
 		WHERE
 		name = ? AND version = ?`
 
 	sqlIndex_lookup = `SELECT ` + sqlIndex_fields + ` FROM t_blobs WHERE name=?`
 
+	sqlIndex_lookupByHash = `SELECT ` + sqlIndex_fields + ` FROM t_blobs WHERE hash=? ORDER BY name`
+
+	// the blobs with any of the block hashes %s, a list of placeholders
+	sqlIndex_lookupByBlocks = `SELECT ` + sqlIndex_fields + ` FROM t_blobs
+	WHERE name IN (
+		SELECT name
+		FROM t_blocks
+		WHERE hash_algorithm=? AND hash_block_size=? AND block_hash IN (%s)
+	)`
+
+	// a blob may contain the same block more than once
+	sqlIndex_insertBlock = `INSERT INTO t_blocks (hash_algorithm, hash_block_size, block_hash, name)
+	VALUES (?,?,?,?) ON CONFLICT DO NOTHING`
+
+	sqlIndex_removeBlocks = `DELETE FROM t_blocks WHERE name = ?`
+
 	sqlIndex_equalHashes = `
 	SELECT hash, name, size
 	FROM t_blobs
-	WHERE hash IN (
+	WHERE size > 0 AND hash IN (
 		SELECT hash
 		FROM t_blobs
 		WHERE SIZE > 0
 		GROUP BY hash HAVING COUNT(*) > 1
 	)
-	ORDER BY hash`
+	ORDER BY hash, name`
 
-	sqlIndex_allNames = `SELECT name FROM t_blobs`
+	// the groups with at least one name which satisfies the condition %s
+	sqlIndex_equalHashesUnder = `
+	SELECT hash, name, size
+	FROM t_blobs
+	WHERE size > 0 AND hash IN (
+		SELECT hash
+		FROM t_blobs
+		WHERE SIZE > 0
+		GROUP BY hash HAVING COUNT(*) > 1
+	) AND hash IN (
+		SELECT hash
+		FROM t_blobs
+		WHERE size > 0 AND %s
+	)
+	ORDER BY hash, name`
+
+	sqlIndex_allNames = `SELECT name FROM t_blobs ORDER BY name`
+
+	sqlIndex_namesUnder = `SELECT name FROM t_blobs WHERE %s ORDER BY name`
+
+	sqlIndex_all = `SELECT ` + sqlIndex_fields + ` FROM t_blobs ORDER BY name`
+
+	sqlIndex_exists = `SELECT COUNT(*) FROM t_blobs WHERE name=?`
 
 	sqlIndex_remove = `DELETE FROM t_blobs WHERE name = ?`
 
 	sqlIndex_count = `SELECT COUNT(*) FROM t_blobs`
+
+	sqlIndex_removeVolume = `DELETE FROM t_volumes WHERE name = ?`
+
+	sqlIndex_insertVolume = `INSERT INTO t_volumes (name, id, root) VALUES (?,?,?)`
+
+	sqlIndex_volumes = `SELECT name, id, root FROM t_volumes ORDER BY name`
+)
+
+// the statements which upgrade the schema of sqlite from version i+1 to version i+2.
+// the initial schema (sqlIndex_init) is version 1. the schema of postgres (postgres_init)
+// starts at version 5, later migrations must be added to both dialects.
+var sqlIndex_migrations = [][]string{
+	// 2: file identity for paranoid change detection
+	{
+		`ALTER TABLE t_blobs ADD COLUMN change_time DATETIME`,
+		`ALTER TABLE t_blobs ADD COLUMN inode INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE t_blobs ADD COLUMN change_attr INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 3: volumes
+	{
+		`CREATE TABLE t_volumes (
+			name TEXT NOT NULL PRIMARY KEY,
+			id   TEXT NOT NULL,
+			root TEXT NOT NULL
+		)`,
+	},
+	// 4: lookup by content
+	{
+		`CREATE INDEX i_blobs_hash ON t_blobs (hash)`,
+	},
+	// 5: queries
+	{
+		`CREATE INDEX i_blobs_size ON t_blobs (size)`,
+		`CREATE INDEX i_blobs_mod_time ON t_blobs (mod_time)`,
+		`CREATE INDEX i_blobs_index_time ON t_blobs (index_time)`,
+	},
+	// 6: lookup by block hashes
+	{
+		`CREATE TABLE t_blocks (
+			hash_algorithm  INTEGER NOT NULL,
+			hash_block_size INTEGER NOT NULL,
+			block_hash      TEXT    NOT NULL,
+			name            TEXT    NOT NULL,
+			PRIMARY KEY (hash_algorithm, hash_block_size, block_hash, name)
+		)`,
+		`CREATE INDEX i_blocks_name ON t_blocks (name)`,
+		// splits the comma separated hashed blocks of the existing blobs
+		`WITH RECURSIVE split (hash_algorithm, hash_block_size, block_hash, name, rest) AS (
+			SELECT hash_algorithm, hash_block_size, '', name, hashed_blocks || ',' FROM t_blobs
+			UNION ALL
+			SELECT hash_algorithm, hash_block_size, substr(rest, 1, instr(rest, ',') - 1), name,
+				substr(rest, instr(rest, ',') + 1)
+			FROM split WHERE rest <> ''
+		)
+		INSERT OR IGNORE INTO t_blocks (hash_algorithm, hash_block_size, block_hash, name)
+		SELECT hash_algorithm, hash_block_size, block_hash, name FROM split WHERE block_hash <> ''`,
+	},
+}
+
+const (
+	sqlIndex_initSchema = `CREATE TABLE IF NOT EXISTS t_schema (version INTEGER NOT NULL)`
+
+	sqlIndex_schemaVersion = `SELECT version FROM t_schema`
 )
 
-func initOrUpgradeDb(db *sql.DB) error {
-	_, err := db.Exec(sqlIndex_init)
+func initOrUpgradeDb(ctx context.Context, db *sql.DB, d *SqlDialect) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	for _, stmt := range d.init {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, sqlIndex_initSchema); err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, sqlIndex_schemaVersion).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		// new databases, and sqlite databases which predate schema versioning, are at the initial version
+		version = d.initialVersion
+		if _, err = tx.ExecContext(ctx, d.rebind(`INSERT INTO t_schema (version) VALUES (?)`), version); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	latest := d.latestVersion()
+	if version > latest {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, latest)
+	}
+	for ; version < latest; version++ {
+		for _, stmt := range d.migrations[version-1] {
+			if _, err = tx.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("schema upgrade to version %d failed: %v", version+1, err)
+			}
+		}
+	}
+	if _, err = tx.ExecContext(ctx, d.rebind(`UPDATE t_schema SET version = ?`), latest); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// sql driver compatible time which is NULL if it is zero
+type sqlOptTime time.Time
+
 // sql driver compatible slice of bytes
 type sqlSB []byte
 
 // sql driver compatible slice of slice of bytes
 type sqlSSB [][]byte
 
-var _ sql.Scanner = (*sqlSB)(nil)
+var _ sql.Scanner = (*sqlOptTime)(nil)
+var _ driver.Valuer = sqlOptTime{}
 var _ driver.Value = (*sqlSB)(nil)
 var _ sql.Scanner = (*sqlSSB)(nil)
 var _ driver.Value = (*sqlSSB)(nil)
 
+func (t sqlOptTime) Value() (driver.Value, error) {
+	if time.Time(t).IsZero() {
+		return nil, nil
+	}
+	return time.Time(t), nil
+}
+func (t *sqlOptTime) Scan(value interface{}) error {
+	var nt sql.NullTime
+	if err := nt.Scan(value); err != nil {
+		return err
+	}
+	*t = sqlOptTime(nt.Time)
+	return nil
+}
 func (b sqlSB) Value() (driver.Value, error) {
 	return base64.StdEncoding.EncodeToString([]byte(b)), nil
 }
-func (b *sqlSB) Scan(value interface{}) error {
-	var err error
-	var v []byte = value.([]byte)
-	*b, err = decodeSlice(v)
-	return err
-}
 func (b sqlSSB) Value() (driver.Value, error) {
 	var s []string
 	for _, sb := range b {
@@ -315,7 +1011,14 @@ func (b sqlSSB) Value() (driver.Value, error) {
 	return strings.Join(s, ","), nil
 }
 func (b *sqlSSB) Scan(value interface{}) error {
-	xs := strings.Split(string(value.([]byte)), ",")
+	v, err := scanText(value)
+	if err != nil {
+		return err
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	xs := strings.Split(string(v), ",")
 	for _, x := range xs {
 		y, err := decodeSlice([]byte(x))
 		if err != nil {
@@ -326,6 +1029,17 @@ func (b *sqlSSB) Scan(value interface{}) error {
 	return nil
 }
 
+// drivers return text columns either as string or as []byte
+func scanText(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("unsupported text value type %T", value)
+}
+
 func decodeSlice(b64 []byte) ([]byte, error) {
 	dst := make([]byte, base64.StdEncoding.DecodedLen(len(b64)))
 	n, err := base64.StdEncoding.Decode(dst, b64)
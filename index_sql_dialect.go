@@ -0,0 +1,234 @@
+package blkidx
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SqlDialect adapts the statements and column types of the sql index to a database system.
+// The statements are written for SQLite and translated by the dialect.
+type SqlDialect struct {
+	// the name of the database system
+	Name string
+
+	numberedParams bool   // placeholders are $1, $2, ... instead of ?
+	binaryHashes   bool   // hashes are stored as bytea and bytea[] instead of base64 text
+	strpos         string // the function which returns the position of a substring
+
+	// the statements which create the schema of initialVersion
+	init           []string
+	initialVersion int
+
+	// the statements which upgrade the schema from version i+1 to version i+2.
+	// the entries below initialVersion are never run.
+	migrations [][]string
+}
+
+var (
+	// SqliteDialect is the dialect of SQLite, e.g. of the driver github.com/mattn/go-sqlite3.
+	SqliteDialect = &SqlDialect{
+		Name:           "sqlite",
+		strpos:         "instr",
+		init:           []string{sqlIndex_init},
+		initialVersion: 1,
+		migrations:     sqlIndex_migrations,
+	}
+
+	// PostgresDialect is the dialect of PostgreSQL, e.g. of the driver github.com/lib/pq.
+	// Names are compared by their bytes (collation "C"), like in the other indexes.
+	PostgresDialect = &SqlDialect{
+		Name:           "postgres",
+		numberedParams: true,
+		binaryHashes:   true,
+		strpos:         "strpos",
+		init:           postgres_init,
+		initialVersion: 5,
+		migrations:     postgres_migrations,
+	}
+)
+
+// SqlDialectOf returns the dialect of a database/sql driver by the name under which it is
+// registered, "sqlite3" (github.com/mattn/go-sqlite3) or "postgres" (github.com/lib/pq).
+// Other drivers of the same database systems are registered under names which are not
+// accepted, since the name is passed on to sql.Open.
+func SqlDialectOf(driver string) (*SqlDialect, error) {
+	switch driver {
+	case "sqlite3":
+		return SqliteDialect, nil
+	case "postgres":
+		return PostgresDialect, nil
+	}
+	return nil, fmt.Errorf("unsupported sql driver %q", driver)
+}
+
+// the schema of version 5
+var postgres_init = []string{
+	`CREATE TABLE IF NOT EXISTS t_blobs (
+		name            TEXT COLLATE "C" NOT NULL PRIMARY KEY,
+		version         BIGINT      NOT NULL,
+		index_time      TIMESTAMPTZ NOT NULL,
+		size            BIGINT      NOT NULL,
+		mod_time        TIMESTAMPTZ NOT NULL,
+		hash_algorithm  INTEGER     NOT NULL,
+		hash            BYTEA       NOT NULL,
+		hash_block_size INTEGER     NOT NULL,
+		hashed_blocks   BYTEA[]     NOT NULL,
+		change_time     TIMESTAMPTZ,
+		inode           BIGINT      NOT NULL DEFAULT 0,
+		change_attr     BIGINT      NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS t_volumes (
+		name TEXT COLLATE "C" NOT NULL PRIMARY KEY,
+		id   TEXT NOT NULL,
+		root TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS i_blobs_hash ON t_blobs (hash)`,
+	`CREATE INDEX IF NOT EXISTS i_blobs_size ON t_blobs (size)`,
+	`CREATE INDEX IF NOT EXISTS i_blobs_mod_time ON t_blobs (mod_time)`,
+	`CREATE INDEX IF NOT EXISTS i_blobs_index_time ON t_blobs (index_time)`,
+}
+
+// the statements which upgrade the schema of postgres, see sqlIndex_migrations
+var postgres_migrations = [][]string{
+	// 2 to 5 are part of postgres_init
+	nil, nil, nil, nil,
+	// 6: lookup by block hashes
+	{
+		`CREATE TABLE t_blocks (
+			hash_algorithm  INTEGER NOT NULL,
+			hash_block_size INTEGER NOT NULL,
+			block_hash      BYTEA   NOT NULL,
+			name            TEXT COLLATE "C" NOT NULL,
+			PRIMARY KEY (hash_algorithm, hash_block_size, block_hash, name)
+		)`,
+		`CREATE INDEX i_blocks_name ON t_blocks (name)`,
+		`INSERT INTO t_blocks (hash_algorithm, hash_block_size, block_hash, name)
+		SELECT DISTINCT hash_algorithm, hash_block_size, block_hash, name
+		FROM t_blobs, unnest(hashed_blocks) AS block_hash`,
+	},
+}
+
+// rebind replaces the ? placeholders of a statement with the placeholders of the dialect.
+// statements must not contain ? in literals.
+func (d *SqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	var n int
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			b.WriteByte(query[i])
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// the latest version of the schema
+func (d *SqlDialect) latestVersion() int {
+	return len(d.migrations) + 1
+}
+
+// hashArg returns the argument of a hash column.
+func (d *SqlDialect) hashArg(hash []byte) interface{} {
+	if d.binaryHashes {
+		return hash
+	}
+	return sqlSB(hash)
+}
+
+// blocksArg returns the argument of the hashed blocks column.
+func (d *SqlDialect) blocksArg(blocks [][]byte) interface{} {
+	if d.binaryHashes {
+		return sqlByteaArray(blocks)
+	}
+	return sqlSSB(blocks)
+}
+
+// scanHash decodes the value of a hash column.
+func (d *SqlDialect) scanHash(value []byte) ([]byte, error) {
+	if d.binaryHashes {
+		return value, nil
+	}
+	return decodeSlice(value)
+}
+
+// scanBlocks decodes the value of the hashed blocks column.
+func (d *SqlDialect) scanBlocks(value []byte) (rv [][]byte, err error) {
+	if d.binaryHashes {
+		return parseByteaArray(value)
+	}
+	err = (*sqlSSB)(&rv).Scan(value)
+	return
+}
+
+// hashRange returns the arguments of the range [lo, hi) of the hashes starting with prefix.
+// ok is false if the prefix does not restrict the range.
+func (d *SqlDialect) hashRange(prefix []byte) (lo, hi interface{}, ok bool) {
+	if !d.binaryHashes {
+		lo, hi, ok := hashRange(prefix)
+		return lo, hi, ok
+	}
+	// the prefix incremented as a number, trailing 0xff bytes carry over
+	end := bytes.TrimRight(prefix, "\xff")
+	if len(end) == 0 {
+		return nil, nil, false
+	}
+	end = append([]byte(nil), end...)
+	end[len(end)-1]++
+	return prefix, end, true
+}
+
+// statsExt returns the expression of the extension of a name, see nameExt.
+func (d *SqlDialect) statsExt() string {
+	return `CASE WHEN ` + d.strpos + `(` + sqlStats_base + `, '.') > 0
+		THEN lower(substr(` + sqlStats_base + `, length(rtrim(` + sqlStats_base + `, replace(` + sqlStats_base + `, '.', '')))))
+		ELSE '' END`
+}
+
+// sql driver compatible array of bytea in the text format of postgres: {"\\x0102","\\x0304"}
+type sqlByteaArray [][]byte
+
+func (a sqlByteaArray) Value() (driver.Value, error) {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, x := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`"\\x`)
+		b.WriteString(hex.EncodeToString(x))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+func parseByteaArray(value []byte) ([][]byte, error) {
+	s := string(value)
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("invalid bytea array %.20q", s)
+	}
+	s = s[1 : len(s)-1]
+	if s == "" {
+		return nil, nil
+	}
+	var rv [][]byte
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimPrefix(strings.Trim(x, `"`), `\\x`)
+		b, err := hex.DecodeString(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytea array element: %v", err)
+		}
+		rv = append(rv, b)
+	}
+	return rv, nil
+}
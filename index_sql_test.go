@@ -0,0 +1,146 @@
+package blkidx
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// sqlite drivers return TEXT columns either as string or as []byte
+func TestSqlScanText(t *testing.T) {
+	blocks := [][]byte{{0x01, 0x02}, {0xfb, 0xff}}
+	text, _ := sqlSSB(blocks).Value()
+	for _, value := range []interface{}{text, []byte(text.(string))} {
+		var b sqlSSB
+		if err := b.Scan(value); err != nil || fmt.Sprint(b) != fmt.Sprint(blocks) {
+			t.Errorf("%T: want %v; got %v, %v", value, blocks, b, err)
+		}
+	}
+	var b sqlSSB
+	if err := b.Scan(42); err == nil {
+		t.Error("want an error for an integer value")
+	}
+}
+
+func TestSqlDialectOf(t *testing.T) {
+	for driver, want := range map[string]*SqlDialect{"sqlite3": SqliteDialect, "postgres": PostgresDialect} {
+		if got, err := SqlDialectOf(driver); got != want || err != nil {
+			t.Errorf("%s - want %s; got %v, %v", driver, want.Name, got, err)
+		}
+	}
+	// names of drivers which are not registered by the command line
+	for _, driver := range []string{"sqlite", "pgx", "mysql"} {
+		if _, err := SqlDialectOf(driver); err == nil {
+			t.Errorf("%s - want an error", driver)
+		}
+	}
+}
+
+func TestSqlDialectRebind(t *testing.T) {
+	query := `SELECT name FROM t_blobs WHERE name = ? OR (name >= ? AND name < ?) LIMIT ?`
+	if got := SqliteDialect.rebind(query); got != query {
+		t.Errorf("sqlite - want the query unchanged; got %q", got)
+	}
+	want := `SELECT name FROM t_blobs WHERE name = $1 OR (name >= $2 AND name < $3) LIMIT $4`
+	if got := PostgresDialect.rebind(query); got != want {
+		t.Errorf("postgres - want %q; got %q", want, got)
+	}
+}
+
+func TestSqlDialectBlocks(t *testing.T) {
+	for _, d := range []*SqlDialect{SqliteDialect, PostgresDialect} {
+		for _, blocks := range [][][]byte{nil, {{0x01, 0x02}}, {{0x00, 0xff}, {0xab, 0xcd, 0xef}}} {
+			v, err := d.blocksArg(blocks).(driver.Valuer).Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.scanBlocks([]byte(v.(string)))
+			if err != nil || fmt.Sprint(got) != fmt.Sprint(blocks) {
+				t.Errorf("%s: want %v; got %v, %v from %q", d.Name, blocks, got, err, v)
+			}
+		}
+	}
+	if got, _ := PostgresDialect.blocksArg([][]byte{{0x01, 0xab}}).(driver.Valuer).Value(); got != `{"\\x01ab"}` {
+		t.Errorf("want the text format of postgres arrays; got %q", got)
+	}
+}
+
+func TestSqlDialectHashRange(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, lo, hi []byte
+	}{
+		{[]byte{0x12}, []byte{0x12}, []byte{0x13}},
+		{[]byte{0x12, 0xff, 0xff}, []byte{0x12, 0xff, 0xff}, []byte{0x13}},
+		{[]byte{0xff}, nil, nil},
+	} {
+		lo, hi, ok := PostgresDialect.hashRange(tc.prefix)
+		if tc.lo == nil {
+			if ok {
+				t.Errorf("%x: want no range; got [%x, %x)", tc.prefix, lo, hi)
+			}
+			continue
+		}
+		if !ok || !bytes.Equal(lo.([]byte), tc.lo) || !bytes.Equal(hi.([]byte), tc.hi) {
+			t.Errorf("%x: want [%x, %x); got [%x, %x), %v", tc.prefix, tc.lo, tc.hi, lo, hi, ok)
+		}
+	}
+}
+
+func TestSqlIndexLookupByBlockHashes(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "index.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	idx, err := NewSqlIndex(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := storeContent(t, idx, "/a", "same content")
+	storeContent(t, idx, "/b", "same content")
+	storeContent(t, idx, "/d/e", "same content")
+	c := storeContent(t, idx, "/c", "same cont...")
+	lookup := func(idx Index, want string) {
+		t.Helper()
+		blobs, err := idx.LookupByBlockHashes(ctx, c.HashAlgorithm, c.HashBlockSize, c.HashedBlocks)
+		if err != nil || blobNames(blobs) != want {
+			t.Errorf("want %q; got %q, %v", want, blobNames(blobs), err)
+		}
+	}
+	lookup(idx, "/a /b /c /d/e")
+
+	// databases of schema version 5 have no table of the block hashes
+	if _, err = db.ExecContext(ctx, `DROP TABLE t_blocks`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.ExecContext(ctx, `UPDATE t_schema SET version = 5`); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err = NewSqlIndex(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	lookup(idx, "/a /b /c /d/e")
+
+	update := storeContent(t, NewMemoryIndex(), "/a", "other")
+	update.Version = a.Version + 1
+	if err = idx.Store(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.Remove(ctx, Names{"/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = idx.RemoveUnder(ctx, Names{"/d"}); err != nil {
+		t.Fatal(err)
+	}
+	lookup(idx, "/c")
+	var rows int
+	if err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM t_blocks WHERE name <> '/a' AND name <> '/c'`).Scan(&rows); err != nil || rows != 0 {
+		t.Errorf("want the block hashes of removed blobs removed; got %d, %v", rows, err)
+	}
+}
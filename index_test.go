@@ -0,0 +1,244 @@
+package blkidx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testIndexes returns an empty index of every backend by name. the postgres backend is only
+// tested if BLKIDX_TEST_POSTGRES is set to the url of a database, whose tables are dropped.
+func testIndexes(t *testing.T) map[string]Index {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "index.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sqlIdx, err := NewSqlIndex(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walIdx, err := OpenWalIndex(context.Background(), filepath.Join(t.TempDir(), "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { walIdx.Close() })
+	boltDb, err := bolt.Open(filepath.Join(t.TempDir(), "index.bolt"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { boltDb.Close() })
+	boltIdx, err := NewBoltIndex(context.Background(), boltDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := map[string]Index{
+		"memory": NewMemoryIndex(),
+		"sql":    sqlIdx,
+		"wal":    walIdx,
+		"bolt":   boltIdx,
+	}
+	if url := os.Getenv("BLKIDX_TEST_POSTGRES"); url != "" {
+		indexes["postgres"] = testPostgresIndex(t, url)
+	}
+	return indexes
+}
+
+func testPostgresIndex(t *testing.T, url string) Index {
+	ctx := context.Background()
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err = db.ExecContext(ctx, `DROP TABLE IF EXISTS t_blobs, t_blocks, t_volumes, t_schema`); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewSqlIndexWithDialect(ctx, db, PostgresDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestNameIsUnder(t *testing.T) {
+	for _, tc := range []struct {
+		name, dir string
+		under     bool
+	}{
+		{"/data/foo", "/data/foo", true},
+		{"/data/foo/a", "/data/foo", true},
+		{"/data/foo/a", "/data/foo/", true},
+		{"/data/foobar", "/data/foo", false},
+		{"/data/fo", "/data/foo", false},
+		{"/data/foo/a", "/", true},
+		{"vol:usb/a", "vol:usb", true},
+		{"vol:usb-a/a", "vol:usb", false},
+		{"vol:usb/a/b", "vol:usb/a", true},
+	} {
+		if got := NameIsUnder(tc.name, tc.dir); got != tc.under {
+			t.Errorf("NameIsUnder(%q, %q) - want %v; got %v", tc.name, tc.dir, tc.under, got)
+		}
+	}
+}
+
+func TestFindEqualHashes(t *testing.T) {
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			storeContent(t, idx, "/a", "abc")
+			storeContent(t, idx, "/b", "unique")
+			storeContent(t, idx, "/c", "abc")
+			storeContent(t, idx, "/d", "other")
+			storeContent(t, idx, "/e", "other")
+			storeContent(t, idx, "/f", "")
+			storeContent(t, idx, "/g", "")
+
+			equal, err := idx.FindEqualHashes(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var groups []string
+			for _, e := range equal {
+				names := append(Names(nil), e.Names...)
+				sort.Strings(names)
+				groups = append(groups, strings.Join(names, " "))
+			}
+			sort.Strings(groups)
+			if got, want := strings.Join(groups, "|"), "/a /c|/d /e"; got != want {
+				t.Errorf("want %q; got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestForEachName(t *testing.T) {
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, n := range []string{"/data/foo/b", "/data/foo/a", "/data/foobar", "/data/foo", "/other", "vol:usb/x"} {
+				storeContent(t, idx, n, n)
+			}
+			for _, tc := range []struct {
+				under Names
+				want  string
+			}{
+				{nil, "/data/foo /data/foo/a /data/foo/b /data/foobar /other vol:usb/x"},
+				{Names{"/data/foo"}, "/data/foo /data/foo/a /data/foo/b"},
+				{Names{"/data/foo/"}, "/data/foo/a /data/foo/b"},
+				{Names{"/other", "vol:usb"}, "/other vol:usb/x"},
+				{Names{"/missing"}, ""},
+			} {
+				var names []string
+				err := idx.ForEachName(context.Background(), tc.under, func(name string) error {
+					names = append(names, name)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := strings.Join(names, " "); got != tc.want {
+					t.Errorf("under %q - want %q; got %q", tc.under, tc.want, got)
+				}
+			}
+
+			stop := errors.New("stop")
+			var n int
+			err := idx.ForEachName(context.Background(), nil, func(string) error {
+				n++
+				return stop
+			})
+			if err != stop || n != 1 {
+				t.Errorf("want the error of fn after one call; got %v after %d", err, n)
+			}
+		})
+	}
+}
+
+func TestForEachEqualHashes(t *testing.T) {
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			storeContent(t, idx, "/b/1", "abc")
+			storeContent(t, idx, "/a/1", "abc")
+			storeContent(t, idx, "/c/1", "abc")
+			storeContent(t, idx, "/a/2", "other")
+			storeContent(t, idx, "/c/2", "other")
+			storeContent(t, idx, "/b/3", "unique")
+			storeContent(t, idx, "/b/4", "")
+			storeContent(t, idx, "/c/4", "")
+
+			for _, tc := range []struct {
+				under Names
+				want  []string
+			}{
+				{nil, []string{"/a/1 /b/1 /c/1", "/a/2 /c/2"}},
+				{Names{"/b"}, []string{"/a/1 /b/1 /c/1"}},
+				{Names{"/a", "/c/2"}, []string{"/a/1 /b/1 /c/1", "/a/2 /c/2"}},
+				{Names{"/b/3"}, nil},
+			} {
+				var groups []string
+				err := idx.ForEachEqualHashes(context.Background(), tc.under, func(equal EqualBlobs) error {
+					groups = append(groups, strings.Join(equal.Names, " "))
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				// groups are ordered by hash
+				sort.Strings(groups)
+				if got, want := strings.Join(groups, "|"), strings.Join(tc.want, "|"); got != want {
+					t.Errorf("under %q - want %q; got %q", tc.under, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveUnder(t *testing.T) {
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, n := range []string{"/data/foo", "/data/foo/a", "/data/foo/b/c", "/data/foobar", "/data/fo", "vol:usb/x", "vol:usb-2/x"} {
+				storeContent(t, idx, n, n)
+			}
+
+			if n, err := idx.RemoveUnder(ctx, nil); n != 0 || err != nil {
+				t.Errorf("empty under - want nothing removed; got %d, %v", n, err)
+			}
+			n, err := idx.RemoveUnder(ctx, Names{"/data/foo", "/data/foo/b", "vol:usb"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 4 {
+				t.Errorf("want 4 removed; got %d", n)
+			}
+			names, err := idx.AllNames(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(names, " "), "/data/fo /data/foobar vol:usb-2/x"; got != want {
+				t.Errorf("want %q; got %q", want, got)
+			}
+
+			// names which are stored again are found again
+			storeContent(t, idx, "/data/foo/z", "z")
+			names, err = NamesUnder(ctx, idx, Names{"/data"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(names, " "), "/data/fo /data/foo/z /data/foobar"; got != want {
+				t.Errorf("want %q; got %q", want, got)
+			}
+			if names, err = NamesUnder(ctx, idx, nil); names != nil || err != nil {
+				t.Errorf("NamesUnder without names - want nil; got %v, %v", names, err)
+			}
+		})
+	}
+}
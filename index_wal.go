@@ -0,0 +1,451 @@
+package blkidx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Files of a WalIndex directory. The snapshot is a binary export of the index. The log
+// consists of records, each prefixed by the length of its content as uvarint and the
+// CRC-32C of its content as four bytes in little endian order. A record holds a blob
+// or a volume as encoded by the binary export format, or one of the removals below
+// followed by a list of names.
+const (
+	walSnapshotFile = "snapshot"
+	walLogFile      = "log"
+
+	walTypeRemove       = 3
+	walTypeRemoveUnder  = 4
+	walTypeRemoveVolume = 5
+
+	// the longest accepted record of the log
+	walMaxRecord = 1 << 30
+
+	// DefaultSnapshotAfter is the default of WalIndex.SnapshotAfter.
+	DefaultSnapshotAfter = 100000
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// returned by readWalRecord for a last record of the log which has not been written completely
+var errWalTorn = errors.New("torn record")
+
+// WalIndex is an index which is held in memory and persisted in a directory, without
+// cgo or a database server. Every change is appended to a write-ahead log before it is
+// applied. Once SnapshotAfter changes have been logged, and when the index is closed,
+// the whole index is written to a snapshot and the log starts over. OpenWalIndex
+// recovers the index from the snapshot and the log.
+//
+// The log is not synced after every change: all changes survive a crash of the
+// process, the latest changes may be lost if the system crashes.
+type WalIndex struct {
+	*memoryIndex
+
+	// the number of changes after which a snapshot is written, zero disables snapshots
+	// until the index is closed. must not be changed while the index is used.
+	SnapshotAfter int
+
+	// receives the errors of snapshots which are written after SnapshotAfter changes.
+	// slog.Default() is used if Log is nil.
+	Log *slog.Logger
+
+	mu      sync.Mutex // serializes changes, the log and snapshots
+	dir     string
+	log     *os.File // nil once the index is closed
+	size    int64    // the size of the log
+	pending int      // the number of changes since the last snapshot attempt
+	err     error    // set if the log could not be repaired after a failed write
+	buf     []byte
+	frame   []byte
+}
+
+var _ Index = (*WalIndex)(nil)
+
+// OpenWalIndex opens the index in the directory, which is created if it does not exist.
+// A torn record at the end of the log, which is left behind by a crash while it was
+// written, is discarded. A damaged record before the end of the log is reported as an
+// error. The directory can only be opened by one index at a time.
+func OpenWalIndex(ctx context.Context, dir string) (*WalIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, walLogFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(log); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("the index %s is in use: %w", dir, err)
+	}
+	w := &WalIndex{
+		memoryIndex:   NewMemoryIndex().(*memoryIndex),
+		SnapshotAfter: DefaultSnapshotAfter,
+		dir:           dir,
+		log:           log,
+	}
+	if err = w.loadSnapshot(ctx); err == nil {
+		err = w.replay(ctx)
+	}
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WalIndex) loadSnapshot(ctx context.Context) error {
+	f, err := os.Open(filepath.Join(w.dir, walSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := NewRecordReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid snapshot %s: %w", f.Name(), err)
+		}
+		if rec.Blob != nil {
+			w.put(rec.Blob)
+		} else {
+			w.volumes[rec.Volume.Name] = *rec.Volume
+		}
+	}
+}
+
+// replay applies the records of the log and truncates a torn record at its end.
+//
+// The log may hold changes which are already part of the snapshot, if the process crashed
+// after the snapshot was written but before the log was truncated. Replaying them is harmless,
+// the state of every name and volume is determined by the last change which applies to it.
+func (w *WalIndex) replay(ctx context.Context) error {
+	r := bufio.NewReader(w.log)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		payload, n, err := readWalRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err == errWalTorn {
+			break
+		} else if err != nil {
+			return fmt.Errorf("damaged record at offset %d of %s: %w", w.size, w.log.Name(), err)
+		}
+		if err = w.apply(payload); err != nil {
+			return fmt.Errorf("invalid record at offset %d of %s: %w", w.size, w.log.Name(), err)
+		}
+		w.size += n
+		w.pending++
+	}
+	return w.log.Truncate(w.size)
+}
+
+// readWalRecord returns the content of the next record and the number of bytes it occupies
+// in the log, or io.EOF at the end of the log. errWalTorn is returned for a last record
+// which is incomplete, has a wrong checksum or, as the space of a record which has not
+// been written may read as zeros, is followed by zeros only.
+func readWalRecord(r *bufio.Reader) ([]byte, int64, error) {
+	size, err := binary.ReadUvarint(r)
+	if err == io.ErrUnexpectedEOF {
+		return nil, 0, errWalTorn
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if size == 0 && walZeros(r) {
+		return nil, 0, errWalTorn
+	}
+	if size == 0 || size > walMaxRecord {
+		return nil, 0, fmt.Errorf("invalid record length %d", size)
+	}
+	var sum [4]byte
+	if _, err = io.ReadFull(r, sum[:]); err != nil {
+		return nil, 0, errWalTorn
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, 0, errWalTorn
+	}
+	if crc32.Checksum(payload, walCRCTable) != binary.LittleEndian.Uint32(sum[:]) {
+		if _, err = r.Peek(1); err == io.EOF {
+			return nil, 0, errWalTorn
+		}
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	n := len(binary.AppendUvarint(nil, size)) + len(sum) + len(payload)
+	return payload, int64(n), nil
+}
+
+// walZeros reports whether the rest of the log consists of zeros.
+func walZeros(r *bufio.Reader) bool {
+	rest, err := io.ReadAll(r)
+	return err == nil && len(bytes.TrimLeft(rest, "\x00")) == 0
+}
+
+// apply applies the content of a record of the log while the index is opened.
+func (w *WalIndex) apply(payload []byte) error {
+	if payload[0] == binaryTypeBlob || payload[0] == binaryTypeVolume {
+		rec, err := (&binaryReader{r: bytes.NewReader(payload)}).Read()
+		if err != nil {
+			return err
+		}
+		if rec.Blob != nil {
+			w.put(rec.Blob)
+		} else {
+			w.volumes[rec.Volume.Name] = *rec.Volume
+		}
+		return nil
+	}
+
+	br := &binaryReader{r: bytes.NewReader(payload[1:])}
+	n := br.uvarint()
+	if n > uint64(len(payload)) {
+		return fmt.Errorf("invalid number of names %d", n)
+	}
+	names := make(Names, 0, n)
+	for i := uint64(0); i < n && br.err == nil; i++ {
+		names = append(names, br.string())
+	}
+	if br.err != nil {
+		return br.err
+	}
+	switch payload[0] {
+	case walTypeRemove:
+		w.remove(names)
+	case walTypeRemoveUnder:
+		w.remove(w.namesUnder(names))
+	case walTypeRemoveVolume:
+		for _, name := range names {
+			delete(w.volumes, name)
+		}
+	default:
+		return fmt.Errorf("invalid record type %d", payload[0])
+	}
+	return nil
+}
+
+func appendNames(buf []byte, typ byte, names Names) []byte {
+	buf = append(buf, typ)
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = appendBytes(buf, []byte(name))
+	}
+	return buf
+}
+
+// append appends a record to the log. w.mu must be held.
+func (w *WalIndex) append(payload []byte) error {
+	if w.log == nil {
+		return os.ErrClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	frame := binary.AppendUvarint(w.frame[:0], uint64(len(payload)))
+	frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(payload, walCRCTable))
+	frame = append(frame, payload...)
+	w.frame = frame
+	if _, err := w.log.Write(frame); err != nil {
+		// records after a partially written one would not be recovered
+		if truncErr := w.log.Truncate(w.size); truncErr != nil {
+			w.err = fmt.Errorf("the log %s is damaged: %w", w.log.Name(), truncErr)
+		}
+		return err
+	}
+	w.size += int64(len(frame))
+	w.pending++
+	return nil
+}
+
+// changed writes a snapshot once enough changes have been logged. a failed snapshot is
+// logged and retried after as many changes again; the log still holds all changes.
+// w.mu must be held.
+func (w *WalIndex) changed(ctx context.Context) {
+	if w.SnapshotAfter > 0 && w.pending >= w.SnapshotAfter {
+		if err := w.snapshot(ctx); err != nil {
+			log := w.Log
+			if log == nil {
+				log = slog.Default()
+			}
+			log.ErrorContext(ctx, "snapshot failed",
+				slog.String("dir", w.dir),
+				slog.Int64("log_size", w.size),
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+// snapshot replaces the snapshot with the current content of the index and empties the log.
+// w.mu must be held.
+func (w *WalIndex) snapshot(ctx context.Context) error {
+	w.pending = 0
+	name := filepath.Join(w.dir, walSnapshotFile)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	bw, err := NewBinaryWriter(f)
+	if err == nil {
+		_, err = Export(ctx, w.memoryIndex, bw)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	syncDir(w.dir)
+
+	if err = w.log.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	return nil
+}
+
+// syncDir makes a rename within the directory durable, where the platform supports it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close writes a snapshot if there are logged changes and closes the log.
+// The index must not be used afterwards.
+func (w *WalIndex) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.log == nil {
+		return os.ErrClosed
+	}
+	var err error
+	if w.size > 0 && w.err == nil {
+		err = w.snapshot(context.Background())
+	}
+	if closeErr := w.log.Close(); err == nil {
+		err = closeErr
+	}
+	w.log = nil
+	return err
+}
+
+func (w *WalIndex) Store(ctx context.Context, blob *Blob) error {
+	if err := blob.Validate(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// changes are serialized by w.mu, the version can not change until the blob is stored
+	if b, _ := w.memoryIndex.LookupByName(ctx, blob.Name); b != nil {
+		if err := b.CheckOptimisticLock(blob); err != nil {
+			return err
+		}
+	}
+	buf, err := appendRecord(w.buf[:0], Record{Blob: blob})
+	if err != nil {
+		return err
+	}
+	w.buf = buf
+	if err = w.append(buf); err != nil {
+		return err
+	}
+	err = w.memoryIndex.Store(ctx, blob)
+	w.changed(ctx)
+	return err
+}
+
+func (w *WalIndex) Remove(ctx context.Context, names Names) error {
+	if len(names) == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = appendNames(w.buf[:0], walTypeRemove, names)
+	if err := w.append(w.buf); err != nil {
+		return err
+	}
+	err := w.memoryIndex.Remove(ctx, names)
+	w.changed(ctx)
+	return err
+}
+
+func (w *WalIndex) RemoveUnder(ctx context.Context, under Names) (int, error) {
+	if len(under) == 0 {
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = appendNames(w.buf[:0], walTypeRemoveUnder, under)
+	if err := w.append(w.buf); err != nil {
+		return 0, err
+	}
+	n, err := w.memoryIndex.RemoveUnder(ctx, under)
+	w.changed(ctx)
+	return n, err
+}
+
+func (w *WalIndex) StoreVolume(ctx context.Context, volume *Volume) error {
+	if err := volume.Validate(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf, err := appendRecord(w.buf[:0], Record{Volume: volume})
+	if err != nil {
+		return err
+	}
+	w.buf = buf
+	if err = w.append(buf); err != nil {
+		return err
+	}
+	err = w.memoryIndex.StoreVolume(ctx, volume)
+	w.changed(ctx)
+	return err
+}
+
+func (w *WalIndex) RemoveVolume(ctx context.Context, name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = appendNames(w.buf[:0], walTypeRemoveVolume, Names{name})
+	if err := w.append(w.buf); err != nil {
+		return err
+	}
+	err := w.memoryIndex.RemoveVolume(ctx, name)
+	w.changed(ctx)
+	return err
+}
@@ -0,0 +1,231 @@
+package blkidx
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func openWal(t *testing.T, dir string) *WalIndex {
+	w, err := OpenWalIndex(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// crash closes the log without writing a snapshot.
+func crash(w *WalIndex) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.log.Close()
+	w.log = nil
+}
+
+func walContent(t *testing.T, idx Index) string {
+	ctx := context.Background()
+	names, err := idx.AllNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := idx.Volumes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range volumes {
+		names = append(names, "volume:"+v.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestWalIndexRecovery(t *testing.T) {
+	ctx := context.Background()
+	for _, snapshotAfter := range []int{0, 1, 3} {
+		dir := t.TempDir()
+		w := openWal(t, dir)
+		w.SnapshotAfter = snapshotAfter
+		for _, n := range []string{"/a", "/b/x", "/b/y", "/c", "/d"} {
+			storeContent(t, w, n, n)
+		}
+		blob := storeContent(t, w, "/e", "e")
+		update := *blob
+		update.Version++
+		update.Size = 2
+		if err := w.Store(ctx, &update); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Remove(ctx, Names{"/a"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.RemoveUnder(ctx, Names{"/b"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"usb", "nas"} {
+			if err := w.StoreVolume(ctx, &Volume{Name: v, ID: "marker:" + v, Root: "/mnt/" + v}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.RemoveVolume(ctx, "usb"); err != nil {
+			t.Fatal(err)
+		}
+		want := walContent(t, w)
+		crash(w)
+
+		w = openWal(t, dir)
+		if got := walContent(t, w); got != want {
+			t.Errorf("snapshot after %d - want %q; got %q", snapshotAfter, want, got)
+		}
+		if b, err := w.LookupByName(ctx, "/e"); err != nil || b == nil || b.Version != 1 || b.Size != 2 {
+			t.Errorf("snapshot after %d - want the updated blob; got %+v, %v", snapshotAfter, b, err)
+		}
+
+		// close writes a snapshot and empties the log
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(filepath.Join(dir, walLogFile)); err != nil || info.Size() != 0 {
+			t.Errorf("want an empty log; got %v, %v", info, err)
+		}
+		w = openWal(t, dir)
+		if got := walContent(t, w); got != want {
+			t.Errorf("after close - want %q; got %q", want, got)
+		}
+		w.Close()
+	}
+}
+
+func TestWalIndexTornLog(t *testing.T) {
+	dir := t.TempDir()
+	w := openWal(t, dir)
+	storeContent(t, w, "/a", "a")
+	storeContent(t, w, "/b", "b")
+	crash(w)
+
+	// cut the last record short, as if the process crashed while writing it
+	log := filepath.Join(dir, walLogFile)
+	info, err := os.Stat(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(log, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openWal(t, dir)
+	if got := walContent(t, w); got != "/a" {
+		t.Errorf("want the intact record; got %q", got)
+	}
+	storeContent(t, w, "/c", "c")
+	crash(w)
+
+	w = openWal(t, dir)
+	defer w.Close()
+	if got := walContent(t, w); got != "/a /c" {
+		t.Errorf("want the records after the torn one; got %q", got)
+	}
+}
+
+func TestWalIndexClosed(t *testing.T) {
+	dir := t.TempDir()
+	w := openWal(t, dir)
+	if runtime.GOOS == "linux" {
+		if _, err := OpenWalIndex(context.Background(), dir); err == nil {
+			t.Error("want an error while the index is in use")
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove(context.Background(), Names{"/a"}); err != os.ErrClosed {
+		t.Errorf("want os.ErrClosed; got %v", err)
+	}
+}
+
+func TestWalIndexDamagedLog(t *testing.T) {
+	write := func(t *testing.T) (dir, log string, size int64) {
+		dir = t.TempDir()
+		w := openWal(t, dir)
+		storeContent(t, w, "/a", "a")
+		storeContent(t, w, "/b", "b")
+		crash(w)
+		log = filepath.Join(dir, walLogFile)
+		info, err := os.Stat(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir, log, info.Size()
+	}
+	flip := func(t *testing.T, log string, offset int64) {
+		data, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[offset] ^= 0xff
+		if err = os.WriteFile(log, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("middle", func(t *testing.T) {
+		dir, log, _ := write(t)
+		flip(t, log, 10)
+		if w, err := OpenWalIndex(context.Background(), dir); err == nil {
+			w.Close()
+			t.Fatal("want an error for a damaged record before the end of the log")
+		}
+	})
+	t.Run("last", func(t *testing.T) {
+		dir, log, size := write(t)
+		flip(t, log, size-2)
+		w := openWal(t, dir)
+		defer w.Close()
+		if got := walContent(t, w); got != "/a" {
+			t.Errorf("want the intact record; got %q", got)
+		}
+	})
+	t.Run("zeros", func(t *testing.T) {
+		dir, log, size := write(t)
+		f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, 100))
+		f.Close()
+		w := openWal(t, dir)
+		defer w.Close()
+		if got := walContent(t, w); got != "/a /b" {
+			t.Errorf("want all records; got %q", got)
+		}
+		if info, err := os.Stat(log); err != nil || info.Size() != size {
+			t.Errorf("want the zeros truncated to %d bytes; got %v, %v", size, info, err)
+		}
+	})
+}
+
+func TestWalIndexSnapshotFailed(t *testing.T) {
+	dir := t.TempDir()
+	w := openWal(t, dir)
+	var logged bytes.Buffer
+	w.Log = slog.New(slog.NewTextHandler(&logged, nil))
+	w.SnapshotAfter = 1
+	// the temporary snapshot can not be created
+	if err := os.Mkdir(filepath.Join(dir, walSnapshotFile+".tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	storeContent(t, w, "/a", "a")
+	if !strings.Contains(logged.String(), "snapshot failed") {
+		t.Errorf("want the failed snapshot logged; got %q", logged.String())
+	}
+	crash(w)
+
+	w = openWal(t, dir)
+	defer w.Close()
+	if got := walContent(t, w); got != "/a" {
+		t.Errorf("want the logged change; got %q", got)
+	}
+}
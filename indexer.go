@@ -2,9 +2,12 @@ package blkidx
 
 import (
 	"bufio"
+	"context"
 	"crypto"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
@@ -34,34 +37,60 @@ type IndexConfig struct {
 	BlockSizes    int
 }
 
-func IndexFile(name string, config IndexConfig) (blob *Blob, err error) {
-	var file *os.File
-	file, err = os.Open(name)
+// returned by IndexFile if a file has been modified while it was being hashed
+var ErrFileChanged = errors.New("file changed while being hashed")
+
+// stats a file after it has been hashed, replaced by tests
+var statAfterHash = (*os.File).Stat
+
+// IndexFile opens and hashes the named file.
+// errors are returned as *IndexError which records the failing stage.
+// The file is stat-ed again after hashing, if its size, modification time or
+// change time changed in the meantime an *IndexError wrapping ErrFileChanged is returned.
+func IndexFile(ctx context.Context, name string, config IndexConfig) (*Blob, error) {
+	file, err := os.Open(name)
 	if err != nil {
-		return
+		return nil, &IndexError{Path: name, Stage: StageOpen, Err: err}
 	}
 	defer file.Close()
 
-	var fileInfo os.FileInfo
-	fileInfo, err = file.Stat()
+	fileInfo, err := file.Stat()
 	if err != nil {
-		return
+		return nil, &IndexError{Path: name, Stage: StageStat, Err: err}
 	}
 
-	blob = new(Blob)
+	before := NewFileStamp(fileInfo)
+	blob := new(Blob)
 	blob.Name = name
 	blob.IndexTime = time.Now().UTC()
-	blob.ModTime = fileInfo.ModTime().UTC()
+	blob.ModTime = before.ModTime
+	blob.ChangeTime = before.ChangeTime
+	blob.Inode = before.Inode
+	blob.ChangeAttr = before.ChangeAttr
 	blob.HashAlgorithm = config.HashAlgorithm
 	blob.HashBlockSize = config.BlockSizes
 
-	blob.Hash, blob.HashedBlocks, blob.Size, err = HashAll(file, blob.HashAlgorithm, blob.HashBlockSize)
-	return
+	blob.Hash, blob.HashedBlocks, blob.Size, err = HashAll(ctx, file, blob.HashAlgorithm, blob.HashBlockSize)
+	if err != nil {
+		return nil, &IndexError{Path: name, Stage: StageRead, Err: err}
+	}
+
+	afterInfo, err := statAfterHash(file)
+	if err != nil {
+		return nil, &IndexError{Path: name, Stage: StageStat, Err: err}
+	}
+	after := NewFileStamp(afterInfo)
+	if !before.Equal(after) || blob.Size != after.Size {
+		return nil, &IndexError{Path: name, Stage: StageUnstable, Err: ErrFileChanged}
+	}
+	return blob, nil
 }
 
-func HashAll(r io.Reader, algorithm crypto.Hash, blockSize int) (all []byte, blocks [][]byte, n int64, err error) {
+// HashAll hashes everything that can be read from r.
+// reading stops with the context's error once the context is done.
+func HashAll(ctx context.Context, r io.Reader, algorithm crypto.Hash, blockSize int) (all []byte, blocks [][]byte, n int64, err error) {
 	var (
-		bufrdr *bufio.Reader = bufio.NewReader(r)
+		bufrdr *bufio.Reader = bufio.NewReader(&contextReader{ctx: ctx, r: r})
 		hasher Hasher        = NewHasher(algorithm, blockSize)
 	)
 
@@ -74,73 +103,269 @@ func HashAll(r io.Reader, algorithm crypto.Hash, blockSize int) (all []byte, blo
 	return
 }
 
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// the stage of indexing a file in which an error occurred
+type IndexStage int
+
+const (
+	StageWalk IndexStage = iota
+	StageLookup
+	StageOpen
+	StageStat
+	StageRead
+	StageStore
+	StageOptimisticLock
+	StageUnstable
+)
+
+var indexStageNames = [...]string{
+	StageWalk:           "walk",
+	StageLookup:         "lookup",
+	StageOpen:           "open",
+	StageStat:           "stat",
+	StageRead:           "read",
+	StageStore:          "store",
+	StageOptimisticLock: "optimistic lock",
+	StageUnstable:       "unstable",
+}
+
+func (s IndexStage) String() string {
+	if s >= 0 && int(s) < len(indexStageNames) {
+		return indexStageNames[s]
+	}
+	return fmt.Sprintf("IndexStage(%d)", int(s))
+}
+
+type IndexError struct {
+	Path  string
+	Stage IndexStage
+	Err   error
+}
+
+var _ error = (*IndexError)(nil)
+
+func (e *IndexError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s failed for %q: %v", e.Stage, e.Path, e.Err)
+}
+
+func (e *IndexError) Unwrap() error { return e.Err }
+
+// IndexResult summarizes a run of Indexer.IndexAll.
+type IndexResult struct {
+	New       int
+	Updated   int
+	Unchanged int
+	Failed    int
+
+	// files which kept changing while being hashed. they are not stored in the index.
+	Unstable int
+
+	BytesHashed int64
+	Duration    time.Duration
+
+	// one error per failed or unstable file, in the order in which they occurred
+	Errors []*IndexError
+}
+
+// RetryPolicy defines how often a file which changed while it was being hashed is
+// hashed again before it is reported as unstable.
+type RetryPolicy struct {
+	Retries int
+	Delay   time.Duration
+}
+
 type Indexer struct {
 	Index Index
 
-	Log *log.Logger
+	// receives structured records about every indexed or failed file.
+	// nothing is logged if Log is nil.
+	Log *slog.Logger
 
 	Concurrency int
 
+	// applies to files which are modified while they are being indexed.
+	// the zero value does not retry.
+	Retry RetryPolicy
+
+	// re-index files whose status change time, inode or change attribute differ
+	// from the indexed blob even if their size and modification time are unchanged.
+	Paranoid bool
+
+	// blobs of files below the root of a volume are named relative to the volume.
+	// all blobs are named by their path if Volumes is nil.
+	Volumes *VolumeSet
+
 	wg sync.WaitGroup
+
+	mu     sync.Mutex
+	result *IndexResult
 }
 
-func (i *Indexer) IndexAll(c <-chan *fs.PathElem) {
+// IndexAll indexes all files received from c until c is closed or the context is done.
+// Files which are being hashed when the context is done are abandoned, but blobs which
+// are already being stored are stored in any case.
+// The returned result covers all files which have been processed, the error is the
+// context's error if indexing has been interrupted.
+func (i *Indexer) IndexAll(ctx context.Context, c <-chan *fs.PathElem) (*IndexResult, error) {
 	if i.Concurrency < 1 {
 		i.Concurrency = 1
 	}
+	start := time.Now()
+	i.result = new(IndexResult)
 	for x := 0; x < i.Concurrency; x++ {
 		i.wg.Add(1)
-		go i.indexWorker(c)
+		go i.indexWorker(ctx, c)
 	}
 	i.wg.Wait()
+
+	result := i.result
+	i.result = nil
+	result.Duration = time.Since(start)
+	return result, ctx.Err()
 }
 
-func (i *Indexer) indexWorker(c <-chan *fs.PathElem) {
-	for pe := range c {
+func (i *Indexer) indexWorker(ctx context.Context, c <-chan *fs.PathElem) {
+	defer i.wg.Done()
+	for {
+		var pe *fs.PathElem
+		var ok bool
+		select {
+		case pe, ok = <-c:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
 		if pe.Err != nil {
-			i.logf("ERROR: %v", pe.Err)
+			i.failed(ctx, &IndexError{Path: pe.Path, Stage: StageWalk, Err: pe.Err})
 			continue
 		}
-		i.index(pe)
+		i.index(ctx, pe)
 	}
-	i.wg.Done()
 }
 
-func (i *Indexer) logf(format string, x ...interface{}) {
+func (i *Indexer) log(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
 	if i.Log != nil {
-		i.Log.Printf(format, x...)
+		i.Log.LogAttrs(ctx, level, msg, attrs...)
+	}
+}
+
+// failed records an error unless it is a consequence of the context being done.
+func (i *Indexer) failed(ctx context.Context, err *IndexError) {
+	if ctx.Err() != nil && err.Stage != StageStore && err.Stage != StageOptimisticLock {
+		return
+	}
+	i.log(ctx, slog.LevelError, "indexing failed",
+		slog.String("path", err.Path),
+		slog.String("stage", err.Stage.String()),
+		slog.String("error", err.Err.Error()))
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err.Stage == StageUnstable {
+		i.result.Unstable++
+	} else {
+		i.result.Failed++
 	}
+	i.result.Errors = append(i.result.Errors, err)
+}
+
+func (i *Indexer) count(fn func(r *IndexResult)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fn(i.result)
 }
 
-func (i *Indexer) index(pe *fs.PathElem) {
-	previous, err := i.Index.LookupByName(pe.Path)
+func (i *Indexer) index(ctx context.Context, pe *fs.PathElem) {
+	name := i.Volumes.Name(pe.Path)
+	previous, err := i.Index.LookupByName(ctx, name)
 	if err != nil {
-		i.logf("ERROR: index lookup failed: %v", err)
+		i.failed(ctx, &IndexError{Path: pe.Path, Stage: StageLookup, Err: err})
 		return
 	}
 
-	var action string = "indexing"
+	var action string = "new"
 	if previous != nil {
-		var size int64 = pe.Info.Size()
-		var mtime time.Time = pe.Info.ModTime()
-		if !previous.HasChanged(size, mtime) {
+		// blobs with merged block hashes are hashed again even if the file is unchanged
+		if !previous.HasChangedStamp(NewFileStamp(pe.Info), i.Paranoid) && !previous.HasMergedBlocks() {
+			i.count(func(r *IndexResult) { r.Unchanged++ })
+			i.log(ctx, slog.LevelDebug, "unchanged", slog.String("path", pe.Path))
 			return
 		}
-		action = "updating"
+		action = "update"
 	}
 
-	i.logf("INFO: %s %q", action, pe.Path)
-
-	indexed, err := IndexFile(pe.Path, genConfig(previous))
+	start := time.Now()
+	indexed, err := i.indexFile(ctx, pe.Path, genConfig(previous))
 	if err != nil {
-		i.logf("ERROR: file indexing failed: %v", err)
+		var ie *IndexError
+		if !errors.As(err, &ie) {
+			ie = &IndexError{Path: pe.Path, Stage: StageRead, Err: err}
+		}
+		i.failed(ctx, ie)
 		return
 	}
+	i.count(func(r *IndexResult) { r.BytesHashed += indexed.Size })
+	indexed.Name = name
 	if previous != nil {
 		indexed.Version = previous.Version + 1
 	}
-	if err := i.Index.Store(indexed); err != nil {
-		i.logf("ERROR: index store failed: %v", err)
+	// a blob which has been fully hashed is stored even if indexing is being interrupted
+	if err := i.Index.Store(context.WithoutCancel(ctx), indexed); err != nil {
+		var stage IndexStage = StageStore
+		var ole *OptimisticLockingError
+		if errors.As(err, &ole) {
+			stage = StageOptimisticLock
+		}
+		i.failed(ctx, &IndexError{Path: pe.Path, Stage: stage, Err: err})
+		return
+	}
+	i.count(func(r *IndexResult) {
+		if previous == nil {
+			r.New++
+		} else {
+			r.Updated++
+		}
+	})
+	i.log(ctx, slog.LevelInfo, "indexed",
+		slog.String("path", pe.Path),
+		slog.String("action", action),
+		slog.Int64("size", indexed.Size),
+		slog.Duration("duration", time.Since(start)))
+}
+
+// indexFile calls IndexFile and retries according to the retry policy
+// as long as the file changes while it is being hashed.
+func (i *Indexer) indexFile(ctx context.Context, name string, config IndexConfig) (*Blob, error) {
+	for attempt := 0; ; attempt++ {
+		blob, err := IndexFile(ctx, name, config)
+		if !errors.Is(err, ErrFileChanged) || attempt >= i.Retry.Retries {
+			return blob, err
+		}
+		i.log(ctx, slog.LevelWarn, "changed while hashing",
+			slog.String("path", name),
+			slog.Int("attempt", attempt+1))
+
+		select {
+		case <-time.After(i.Retry.Delay):
+		case <-ctx.Done():
+			return nil, &IndexError{Path: name, Stage: StageRead, Err: ctx.Err()}
+		}
 	}
 }
 
@@ -1 +1,194 @@
 package blkidx
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/phicode/blkidx/fs"
+)
+
+func TestIndexerIndexAll(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	idx := NewMemoryIndex()
+	indexer := &Indexer{Index: idx, Concurrency: 2}
+
+	result, err := indexer.IndexAll(ctx, fs.WalkFiles(ctx, fs.Paths{root: {}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.New != 3 || result.Unchanged != 0 || result.BytesHashed != 3 {
+		t.Errorf("want 3 new files of 3 bytes; got %+v", result)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "b"), []byte("bb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(root, "b"), time.Now(), time.Now().Add(time.Hour))
+	result, err = indexer.IndexAll(ctx, fs.WalkFiles(ctx, fs.Paths{root: {}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.New != 0 || result.Updated != 1 || result.Unchanged != 2 {
+		t.Errorf("want 1 updated and 2 unchanged files; got %+v", result)
+	}
+	if n, _ := idx.Count(ctx); n != 3 {
+		t.Errorf("want 3 indexed blobs; got %d", n)
+	}
+}
+
+func TestIndexerIndexAllFailures(t *testing.T) {
+	ctx := context.Background()
+	missing := filepath.Join(t.TempDir(), "missing")
+	c := make(chan *fs.PathElem, 2)
+	c <- &fs.PathElem{Err: os.ErrPermission}
+	c <- &fs.PathElem{Path: missing, Info: fakeFileInfo{}}
+	close(c)
+
+	indexer := &Indexer{Index: NewMemoryIndex()}
+	result, err := indexer.IndexAll(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != 2 || len(result.Errors) != 2 {
+		t.Fatalf("want 2 failures; got %+v", result)
+	}
+	stages := map[IndexStage]bool{}
+	for _, e := range result.Errors {
+		stages[e.Stage] = true
+	}
+	if !stages[StageWalk] || !stages[StageOpen] {
+		t.Errorf("want walk and open failures; got %v", result.Errors)
+	}
+}
+
+type fakeFileInfo struct{ os.FileInfo }
+
+func (fakeFileInfo) Size() int64        { return 1 }
+func (fakeFileInfo) ModTime() time.Time { return time.Now() }
+
+func TestIndexerIndexAllCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := make(chan *fs.PathElem) // never closed
+	indexer := &Indexer{Index: NewMemoryIndex()}
+	if _, err := indexer.IndexAll(ctx, c); err != context.Canceled {
+		t.Errorf("want %v; got %v", context.Canceled, err)
+	}
+}
+
+func TestHashAllCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, _, _, err := HashAll(ctx, f, DefaultHashAlgorithm, DefaultHashBlockSize); err != context.Canceled {
+		t.Errorf("want %v; got %v", context.Canceled, err)
+	}
+}
+
+// a file which reports a larger size than it had when it was opened
+type grownFileInfo struct{ os.FileInfo }
+
+func (g grownFileInfo) Size() int64 { return g.FileInfo.Size() + 1 }
+
+func TestIndexerRetryUnstable(t *testing.T) {
+	defer func(restore func(*os.File) (os.FileInfo, error)) { statAfterHash = restore }(statAfterHash)
+
+	name := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(name, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		changes, retries           int
+		wantAttempts, wantUnstable int
+	}{
+		{changes: 1, retries: 2, wantAttempts: 2},
+		{changes: 5, retries: 2, wantAttempts: 3, wantUnstable: 1},
+		{changes: 1, retries: 0, wantAttempts: 1, wantUnstable: 1},
+	} {
+		attempts, changes := 0, tc.changes
+		statAfterHash = func(f *os.File) (os.FileInfo, error) {
+			attempts++
+			info, err := f.Stat()
+			if err == nil && changes > 0 {
+				changes--
+				info = grownFileInfo{info}
+			}
+			return info, err
+		}
+
+		ctx := context.Background()
+		c := make(chan *fs.PathElem, 1)
+		c <- &fs.PathElem{Path: name, Info: info}
+		close(c)
+		idx := NewMemoryIndex()
+		indexer := &Indexer{Index: idx, Retry: RetryPolicy{Retries: tc.retries}}
+		result, err := indexer.IndexAll(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != tc.wantAttempts {
+			t.Errorf("%+v: want %d attempts; got %d", tc, tc.wantAttempts, attempts)
+		}
+		if result.Unstable != tc.wantUnstable || result.New != 1-tc.wantUnstable || result.Failed != 0 {
+			t.Errorf("%+v: want %d unstable files; got %+v", tc, tc.wantUnstable, result)
+		}
+		if tc.wantUnstable > 0 {
+			if len(result.Errors) != 1 || result.Errors[0].Stage != StageUnstable || !errors.Is(result.Errors[0], ErrFileChanged) {
+				t.Errorf("%+v: want an unstable error; got %v", tc, result.Errors)
+			}
+		}
+		if n, _ := idx.Count(ctx); n != 1-tc.wantUnstable {
+			t.Errorf("%+v: want %d indexed blobs; got %d", tc, 1-tc.wantUnstable, n)
+		}
+	}
+}
+
+func TestIndexerRehashMergedBlocks(t *testing.T) {
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(name, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := IndexFile(ctx, name, IndexConfig{HashAlgorithm: DefaultHashAlgorithm, BlockSizes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hashed blocks as merged by earlier versions of Hasher
+	blob.HashedBlocks = blob.HashedBlocks[:1]
+	idx := NewMemoryIndex()
+	if err := idx.Store(ctx, blob); err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := &Indexer{Index: idx}
+	result, err := indexer.IndexAll(ctx, fs.WalkFiles(ctx, fs.Paths{name: {}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Updated != 1 {
+		t.Errorf("want 1 updated file; got %+v", result)
+	}
+	if blob, _ := idx.LookupByName(ctx, name); blob == nil || len(blob.HashedBlocks) != 3 {
+		t.Errorf("want 3 hashed blocks; got %+v", blob)
+	}
+}
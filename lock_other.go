@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package blkidx
+
+import "os"
+
+// lockFile is a no-op, files are not locked on this platform.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package blkidx
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive lock of the file without waiting. the lock is
+// released when the file is closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,417 @@
+package blkidx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "crypto/md5"
+)
+
+// ManifestFormat is the format of a checksum manifest as written by common tools.
+type ManifestFormat int
+
+const (
+	// "<hex>  <name>" as written by sha1sum, sha256sum and md5sum
+	ManifestGNU ManifestFormat = iota
+	// "SHA256 (<name>) = <hex>" as written by sha256sum --tag and BSD sha256
+	ManifestBSD
+	// "<name> <crc32>" simple file verification
+	ManifestSFV
+	// size,hash,filename as written by hashdeep and md5deep -z
+	ManifestHashdeep
+)
+
+var manifestFormatNames = []string{"gnu", "bsd", "sfv", "hashdeep"}
+
+func (f ManifestFormat) String() string {
+	if f >= 0 && int(f) < len(manifestFormatNames) {
+		return manifestFormatNames[f]
+	}
+	return fmt.Sprintf("ManifestFormat(%d)", int(f))
+}
+
+func ParseManifestFormat(s string) (ManifestFormat, error) {
+	for i, name := range manifestFormatNames {
+		if s == name {
+			return ManifestFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid manifest format %q", s)
+}
+
+// the manifest name of the crc32 checksum of SFV files
+const ManifestCRC32 = "crc32"
+
+// the hash algorithms of manifests by their lower case name, as used in hashdeep headers
+var manifestHashes = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// the tags of the BSD format by algorithm name
+var manifestBSDTags = map[string]string{
+	"md5":    "MD5",
+	"sha1":   "SHA1",
+	"sha256": "SHA256",
+	"sha512": "SHA512",
+}
+
+// ManifestAlgorithm returns the manifest name of a hash algorithm.
+func ManifestAlgorithm(h crypto.Hash) (string, bool) {
+	for name, mh := range manifestHashes {
+		if mh == h {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// NewManifestHash returns a new hash of the named manifest algorithm.
+func NewManifestHash(algorithm string) (hash.Hash, error) {
+	if algorithm == ManifestCRC32 {
+		return crc32.NewIEEE(), nil
+	}
+	h, found := manifestHashes[algorithm]
+	if !found || !h.Available() {
+		return nil, fmt.Errorf("unsupported manifest hash algorithm %q", algorithm)
+	}
+	return h.New(), nil
+}
+
+// HashFileManifest hashes the named file with a manifest algorithm
+// and returns the hash and the number of bytes read.
+func HashFileManifest(ctx context.Context, name, algorithm string) ([]byte, int64, error) {
+	h, err := NewManifestHash(algorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, &contextReader{ctx: ctx, r: f})
+	if err != nil {
+		return nil, n, err
+	}
+	return h.Sum(nil), n, nil
+}
+
+// ManifestEntry is a single file of a manifest.
+type ManifestEntry struct {
+	// the slash separated name, relative to the directory of the manifest or absolute
+	Name string
+
+	// a lower case name as accepted by NewManifestHash
+	Algorithm string
+
+	Hash []byte
+
+	// the size of the file or -1 if the format does not include the size
+	Size int64
+}
+
+// ManifestWriter writes the entries of a manifest.
+// Formats which only support a single algorithm fail for entries of another algorithm.
+type ManifestWriter struct {
+	w         *bufio.Writer
+	format    ManifestFormat
+	algorithm string // of the first entry
+}
+
+func NewManifestWriter(w io.Writer, format ManifestFormat) *ManifestWriter {
+	return &ManifestWriter{w: bufio.NewWriter(w), format: format}
+}
+
+func (m *ManifestWriter) Write(e ManifestEntry) error {
+	if m.algorithm == "" {
+		m.algorithm = e.Algorithm
+		if m.format == ManifestHashdeep {
+			fmt.Fprintf(m.w, "%%%%%%%% HASHDEEP-1.0\n%%%%%%%% size,%s,filename\n## generated by blkidx\n##\n", e.Algorithm)
+		}
+	}
+	if e.Algorithm != m.algorithm && m.format != ManifestBSD {
+		return fmt.Errorf("%s: hash algorithm %s differs from %s", e.Name, e.Algorithm, m.algorithm)
+	}
+	var err error
+	h := hex.EncodeToString(e.Hash)
+	switch m.format {
+	case ManifestGNU:
+		if strings.ContainsAny(e.Name, "\\\n") {
+			name := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(e.Name)
+			_, err = fmt.Fprintf(m.w, "\\%s  %s\n", h, name)
+		} else {
+			_, err = fmt.Fprintf(m.w, "%s  %s\n", h, e.Name)
+		}
+	case ManifestBSD:
+		tag, found := manifestBSDTags[e.Algorithm]
+		if !found {
+			return fmt.Errorf("%s: hash algorithm %s is not supported by the bsd format", e.Name, e.Algorithm)
+		}
+		_, err = fmt.Fprintf(m.w, "%s (%s) = %s\n", tag, e.Name, h)
+	case ManifestSFV:
+		if e.Algorithm != ManifestCRC32 {
+			return fmt.Errorf("%s: the sfv format requires %s checksums", e.Name, ManifestCRC32)
+		}
+		_, err = fmt.Fprintf(m.w, "%s %s\n", e.Name, strings.ToUpper(h))
+	case ManifestHashdeep:
+		_, err = fmt.Fprintf(m.w, "%d,%s,%s\n", e.Size, h, e.Name)
+	default:
+		err = fmt.Errorf("invalid manifest format %v", m.format)
+	}
+	return err
+}
+
+func (m *ManifestWriter) Flush() error { return m.w.Flush() }
+
+// ManifestReader reads the entries of a manifest in any of the supported formats,
+// the format is detected for each line.
+type ManifestReader struct {
+	s    *bufio.Scanner
+	line int
+
+	// the columns of a hashdeep manifest, nil if no hashdeep header has been read
+	columns []string
+}
+
+func NewManifestReader(r io.Reader) *ManifestReader {
+	return &ManifestReader{s: bufio.NewScanner(r)}
+}
+
+var (
+	manifestBSDLine = regexp.MustCompile(`^([A-Z0-9]+) \((.*)\) = ([0-9a-fA-F]+)$`)
+	manifestGNULine = regexp.MustCompile(`^([0-9a-fA-F]+) [ *](.+)$`)
+	manifestSFVLine = regexp.MustCompile(`^(.+) ([0-9a-fA-F]{8})$`)
+
+	// the algorithms of GNU manifests by the length of the hex encoded hash
+	manifestGNULengths = map[int]string{32: "md5", 40: "sha1", 64: "sha256", 128: "sha512"}
+)
+
+// Read returns the next entry or io.EOF after the last entry.
+func (m *ManifestReader) Read() (ManifestEntry, error) {
+	for m.s.Scan() {
+		m.line++
+		line := strings.TrimRight(m.s.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue // sfv comments
+		}
+		if strings.HasPrefix(line, "%%%%") {
+			m.columns = parseHashdeepHeader(line)
+			continue
+		}
+		if m.columns != nil && strings.HasPrefix(line, "#") {
+			continue // hashdeep comments
+		}
+		e, err := m.parse(line)
+		if err != nil {
+			return e, fmt.Errorf("manifest line %d: %v", m.line, err)
+		}
+		return e, nil
+	}
+	if err := m.s.Err(); err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{}, io.EOF
+}
+
+// parseHashdeepHeader returns the columns of a "%%%% size,md5,sha256,filename" line,
+// or an empty slice for other header lines such as "%%%% HASHDEEP-1.0".
+func parseHashdeepHeader(line string) []string {
+	fields := strings.TrimSpace(strings.TrimPrefix(line, "%%%%"))
+	if !strings.Contains(fields, ",") {
+		return []string{}
+	}
+	return strings.Split(fields, ",")
+}
+
+func (m *ManifestReader) parse(line string) (ManifestEntry, error) {
+	e := ManifestEntry{Size: -1}
+	if len(m.columns) > 0 {
+		return parseHashdeepLine(line, m.columns)
+	}
+	if g := manifestBSDLine.FindStringSubmatch(line); g != nil {
+		for alg, tag := range manifestBSDTags {
+			if tag == g[1] {
+				e.Algorithm, e.Name = alg, g[2]
+				return e, decodeManifestHash(&e, g[3])
+			}
+		}
+		return e, fmt.Errorf("unsupported hash algorithm %q", g[1])
+	}
+	escaped := strings.HasPrefix(line, `\`)
+	if g := manifestGNULine.FindStringSubmatch(strings.TrimPrefix(line, `\`)); g != nil {
+		if alg, found := manifestGNULengths[len(g[1])]; found {
+			e.Algorithm, e.Name = alg, g[2]
+			if escaped {
+				e.Name = unescapeGNU(e.Name)
+			}
+			return e, decodeManifestHash(&e, g[1])
+		}
+	}
+	if g := manifestSFVLine.FindStringSubmatch(line); g != nil {
+		e.Algorithm, e.Name = ManifestCRC32, g[1]
+		return e, decodeManifestHash(&e, g[2])
+	}
+	return e, errors.New("unknown manifest format")
+}
+
+func parseHashdeepLine(line string, columns []string) (ManifestEntry, error) {
+	e := ManifestEntry{Size: -1}
+	values := strings.SplitN(line, ",", len(columns))
+	if len(values) != len(columns) {
+		return e, fmt.Errorf("want %d columns; got %d", len(columns), len(values))
+	}
+	// the strongest supported hash of the line
+	for _, alg := range []string{"sha512", "sha256", "sha1", "md5"} {
+		for i, c := range columns {
+			if c == alg && e.Algorithm == "" {
+				e.Algorithm = alg
+				if err := decodeManifestHash(&e, values[i]); err != nil {
+					return e, err
+				}
+			}
+		}
+	}
+	for i, c := range columns {
+		switch c {
+		case "size":
+			size, err := strconv.ParseInt(values[i], 10, 64)
+			if err != nil {
+				return e, err
+			}
+			e.Size = size
+		case "filename":
+			e.Name = values[i]
+		}
+	}
+	if e.Algorithm == "" || e.Name == "" {
+		return e, errors.New("no supported hash or filename column")
+	}
+	return e, nil
+}
+
+func decodeManifestHash(e *ManifestEntry, h string) error {
+	var err error
+	e.Hash, err = hex.DecodeString(h)
+	return err
+}
+
+func unescapeGNU(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+1 < len(name) {
+			i++
+			if name[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// ManifestStatus is the result of checking a file against its manifest entry.
+type ManifestStatus int
+
+const (
+	ManifestOK ManifestStatus = iota
+	ManifestFailed
+	ManifestMissing
+	ManifestError
+)
+
+func (s ManifestStatus) String() string {
+	switch s {
+	case ManifestOK:
+		return "OK"
+	case ManifestFailed:
+		return "FAILED"
+	case ManifestMissing:
+		return "MISSING"
+	case ManifestError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("ManifestStatus(%d)", int(s))
+}
+
+type ManifestCheck struct {
+	Entry ManifestEntry
+
+	// the file system path of the entry
+	Path string
+
+	Status ManifestStatus
+
+	// set for ManifestError
+	Err error
+
+	// true if the hash of an up to date blob of the index has been compared
+	// instead of hashing the file
+	FromIndex bool
+}
+
+// CheckManifestEntry verifies a file against its manifest entry. Relative names are
+// resolved against dir. The hash of the file's blob is used if the blob has the same
+// hash algorithm as the entry and the file has not changed since it has been indexed,
+// otherwise the file is hashed.
+func CheckManifestEntry(ctx context.Context, idx Index, vols *VolumeSet, dir string, e ManifestEntry) ManifestCheck {
+	c := ManifestCheck{Entry: e, Path: filepath.FromSlash(e.Name)}
+	if !filepath.IsAbs(c.Path) {
+		c.Path = filepath.Join(dir, c.Path)
+	}
+	info, err := os.Stat(c.Path)
+	switch {
+	case os.IsNotExist(err):
+		c.Status = ManifestMissing
+		return c
+	case err != nil:
+		c.Status, c.Err = ManifestError, err
+		return c
+	case e.Size >= 0 && info.Size() != e.Size:
+		c.Status = ManifestFailed
+		return c
+	}
+
+	if alg, found := manifestHashes[e.Algorithm]; found {
+		blob, err := idx.LookupByName(ctx, vols.Name(c.Path))
+		if err != nil {
+			c.Status, c.Err = ManifestError, err
+			return c
+		}
+		if blob != nil && blob.HashAlgorithm == alg && !blob.HasChangedStamp(NewFileStamp(info), false) {
+			c.FromIndex = true
+			c.Status = manifestStatus(bytes.Equal(blob.Hash, e.Hash))
+			return c
+		}
+	}
+	h, _, err := HashFileManifest(ctx, c.Path, e.Algorithm)
+	if err != nil {
+		c.Status, c.Err = ManifestError, err
+		return c
+	}
+	c.Status = manifestStatus(bytes.Equal(h, e.Hash))
+	return c
+}
+
+func manifestStatus(equal bool) ManifestStatus {
+	if equal {
+		return ManifestOK
+	}
+	return ManifestFailed
+}
@@ -0,0 +1,114 @@
+package blkidx
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestWriteRead(t *testing.T) {
+	hash := func(alg, content string) []byte {
+		h, _ := NewManifestHash(alg)
+		h.Write([]byte(content))
+		return h.Sum(nil)
+	}
+	for _, tc := range []struct {
+		format  ManifestFormat
+		alg     string
+		size    bool
+		written string
+	}{
+		{ManifestGNU, "sha256", false, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  dir/a b\n"},
+		{ManifestBSD, "sha1", false, "SHA1 (dir/a b) = aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n"},
+		{ManifestSFV, ManifestCRC32, false, "dir/a b 3610A686\n"},
+		{ManifestHashdeep, "md5", true, "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n## generated by blkidx\n##\n" +
+			"5,5d41402abc4b2a76b9719d911017c592,dir/a b\n"},
+	} {
+		t.Run(tc.format.String(), func(t *testing.T) {
+			e := ManifestEntry{Name: "dir/a b", Algorithm: tc.alg, Hash: hash(tc.alg, "hello"), Size: -1}
+			if tc.size {
+				e.Size = 5
+			}
+			var buf bytes.Buffer
+			w := NewManifestWriter(&buf, tc.format)
+			if err := w.Write(e); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			if buf.String() != tc.written {
+				t.Errorf("want %q; got %q", tc.written, buf.String())
+			}
+			entries := readManifest(t, buf.String())
+			if len(entries) != 1 || !reflect.DeepEqual(entries[0], e) {
+				t.Errorf("want %+v; got %+v", e, entries)
+			}
+		})
+	}
+}
+
+func TestManifestReadGNUEscaped(t *testing.T) {
+	const sum = "d41d8cd98f00b204e9800998ecf8427e"
+	entries := readManifest(t, `\`+sum+` *a\\b\nc`+"\n")
+	if len(entries) != 1 || entries[0].Name != "a\\b\nc" || entries[0].Algorithm != "md5" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+	var buf bytes.Buffer
+	w := NewManifestWriter(&buf, ManifestGNU)
+	w.Write(entries[0])
+	w.Flush()
+	if got, want := buf.String(), `\`+sum+`  a\\b\nc`+"\n"; got != want {
+		t.Errorf("want %q; got %q", want, got)
+	}
+}
+
+func TestCheckManifestEntry(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	idx := NewMemoryIndex()
+	a := writeIndexed(t, idx, filepath.Join(dir, "a"), "content")
+	os.WriteFile(filepath.Join(dir, "b"), []byte("not indexed"), 0644)
+
+	blob, _ := idx.LookupByName(ctx, a)
+	alg, _ := ManifestAlgorithm(blob.HashAlgorithm)
+	sha256, _ := hex.DecodeString("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	other, _ := NewManifestHash("sha256")
+	other.Write([]byte("not indexed"))
+
+	for _, tc := range []struct {
+		e         ManifestEntry
+		status    ManifestStatus
+		fromIndex bool
+	}{
+		{ManifestEntry{Name: "a", Algorithm: alg, Hash: blob.Hash, Size: -1}, ManifestOK, true},
+		{ManifestEntry{Name: a, Algorithm: alg, Hash: blob.Hash, Size: 7}, ManifestOK, true},
+		{ManifestEntry{Name: "a", Algorithm: alg, Hash: blob.Hash, Size: 8}, ManifestFailed, false},
+		{ManifestEntry{Name: "a", Algorithm: "sha256", Hash: sha256, Size: -1}, ManifestFailed, false},
+		{ManifestEntry{Name: "b", Algorithm: "sha256", Hash: other.Sum(nil), Size: -1}, ManifestOK, false},
+		{ManifestEntry{Name: "c", Algorithm: "sha256", Hash: sha256, Size: -1}, ManifestMissing, false},
+	} {
+		c := CheckManifestEntry(ctx, idx, nil, dir, tc.e)
+		if c.Status != tc.status || c.FromIndex != tc.fromIndex {
+			t.Errorf("%+v - want (%v, %v); got (%v, %v, %v)", tc.e, tc.status, tc.fromIndex, c.Status, c.FromIndex, c.Err)
+		}
+	}
+}
+
+func readManifest(t *testing.T, manifest string) (rv []ManifestEntry) {
+	r := NewManifestReader(strings.NewReader(manifest))
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			return rv
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv = append(rv, e)
+	}
+}
@@ -0,0 +1,187 @@
+package blkidx
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// QueryOrder is the order of query results.
+type QueryOrder int
+
+const (
+	OrderByName QueryOrder = iota
+	OrderBySize
+	OrderByModTime
+	OrderByIndexTime
+)
+
+var queryOrderNames = []string{"name", "size", "mtime", "itime"}
+
+func (o QueryOrder) String() string {
+	if o >= 0 && int(o) < len(queryOrderNames) {
+		return queryOrderNames[o]
+	}
+	return fmt.Sprintf("QueryOrder(%d)", int(o))
+}
+
+func ParseQueryOrder(s string) (QueryOrder, error) {
+	for i, name := range queryOrderNames {
+		if s == name {
+			return QueryOrder(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid query order %q", s)
+}
+
+// Query selects blobs by their metadata. The zero value selects all blobs,
+// every field which is set restricts the result further.
+type Query struct {
+	// blobs which are any of the names or are located below them (see NameIsUnder)
+	Under Names
+
+	// a path.Match pattern which is matched against the last element of the name if it
+	// contains no slash, otherwise against the whole name with slashes as separators
+	Glob string
+
+	// inclusive lower and exclusive upper bound of the size, 0 for no bound
+	MinSize, MaxSize int64
+
+	// inclusive lower and exclusive upper bounds of the modification and index time
+	ModifiedSince, ModifiedBefore time.Time
+	IndexedSince, IndexedBefore   time.Time
+
+	// a prefix of the hex encoded hash of the full content
+	HashPrefix string
+
+	HashAlgorithm crypto.Hash
+	HashBlockSize int
+
+	Order      QueryOrder
+	Descending bool
+
+	// the maximum number of blobs, 0 for no limit
+	Limit int
+}
+
+var queryErrHash = errors.New("invalid hash prefix: must be hexadecimal")
+
+func (q *Query) Validate() error {
+	if _, err := q.hashPrefix(); err != nil {
+		return err
+	}
+	if _, err := path.Match(q.Glob, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", q.Glob, err)
+	}
+	if q.Order < OrderByName || q.Order > OrderByIndexTime {
+		return fmt.Errorf("invalid query order %v", q.Order)
+	}
+	return nil
+}
+
+// hashPrefix returns the complete bytes of the hash prefix, a trailing nibble is dropped.
+func (q *Query) hashPrefix() ([]byte, error) {
+	h := strings.ToLower(q.HashPrefix)
+	b, err := hex.DecodeString(h[:len(h)&^1])
+	if err != nil || strings.Trim(h, "0123456789abcdef") != "" {
+		return nil, queryErrHash
+	}
+	return b, nil
+}
+
+// Match reports whether the blob is selected by the query.
+func (q *Query) Match(b *Blob) bool {
+	if len(q.Under) > 0 && !NameIsUnderAny(b.Name, q.Under) {
+		return false
+	}
+	if q.Glob != "" && !q.matchGlob(b.Name) {
+		return false
+	}
+	if b.Size < q.MinSize || (q.MaxSize > 0 && b.Size >= q.MaxSize) {
+		return false
+	}
+	if !inTimeRange(b.ModTime, q.ModifiedSince, q.ModifiedBefore) ||
+		!inTimeRange(b.IndexTime, q.IndexedSince, q.IndexedBefore) {
+		return false
+	}
+	if q.HashPrefix != "" && !strings.HasPrefix(hex.EncodeToString(b.Hash), strings.ToLower(q.HashPrefix)) {
+		return false
+	}
+	if q.HashAlgorithm != 0 && b.HashAlgorithm != q.HashAlgorithm {
+		return false
+	}
+	if q.HashBlockSize != 0 && b.HashBlockSize != q.HashBlockSize {
+		return false
+	}
+	return true
+}
+
+func (q *Query) matchGlob(name string) bool {
+	if !strings.HasPrefix(name, VolumeNamePrefix) {
+		name = filepath.ToSlash(name)
+	}
+	if !strings.Contains(q.Glob, "/") {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(q.Glob, name)
+	return matched
+}
+
+func inTimeRange(t, since, before time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (before.IsZero() || t.Before(before))
+}
+
+// less reports whether a is ordered before b, names order blobs with equal keys.
+func (q *Query) less(a, b *Blob) bool {
+	var c int
+	switch q.Order {
+	case OrderBySize:
+		c = compareInt64(a.Size, b.Size)
+	case OrderByModTime:
+		c = a.ModTime.Compare(b.ModTime)
+	case OrderByIndexTime:
+		c = a.IndexTime.Compare(b.IndexTime)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if q.Descending {
+		return c > 0
+	}
+	return c < 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortAndLimit orders blobs as requested by the query and applies its limit.
+func (q *Query) sortAndLimit(blobs []*Blob) []*Blob {
+	sort.Slice(blobs, func(i, j int) bool { return q.less(blobs[i], blobs[j]) })
+	if q.Limit > 0 && len(blobs) > q.Limit {
+		blobs = blobs[:q.Limit]
+	}
+	return blobs
+}
+
+// exact reports whether the range restrictions of a backend select exactly the matching blobs,
+// which is not the case for globs and hash prefixes which do not end on a base64 group.
+func (q *Query) exact() bool {
+	if q.Glob != "" {
+		return false
+	}
+	b, _ := q.hashPrefix()
+	return len(q.HashPrefix) == 2*len(b) && len(b)%3 == 0
+}
@@ -0,0 +1,79 @@
+package blkidx
+
+import (
+	"context"
+	"crypto"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			blobs := map[string]*Blob{}
+			for i, f := range []struct {
+				name, content string
+			}{
+				{"/data/a.txt", "a"},
+				{"/data/b.jpg", "bbbb"},
+				{"/data/sub/c.txt", "cccccccc"},
+				{"/data-x/d.txt", "dd"},
+				{"/other/e.jpg", "eeeeeeeeeeee"},
+			} {
+				blob := *storeContent(t, idx, f.name, f.content)
+				blob.ModTime = day(i + 1)
+				blob.Version = 1
+				if err := idx.Store(ctx, &blob); err != nil {
+					t.Fatal(err)
+				}
+				blobs[f.name] = &blob
+			}
+			hashC := hex.EncodeToString(blobs["/data/sub/c.txt"].Hash)
+
+			for _, tc := range []struct {
+				desc string
+				q    Query
+				want string
+			}{
+				{"all", Query{}, "/data-x/d.txt /data/a.txt /data/b.jpg /data/sub/c.txt /other/e.jpg"},
+				{"under", Query{Under: Names{"/data"}}, "/data/a.txt /data/b.jpg /data/sub/c.txt"},
+				{"under file", Query{Under: Names{"/data/a.txt", "/other"}}, "/data/a.txt /other/e.jpg"},
+				{"glob base", Query{Glob: "*.txt"}, "/data-x/d.txt /data/a.txt /data/sub/c.txt"},
+				{"glob path", Query{Glob: "/data/*/*"}, "/data/sub/c.txt"},
+				{"size", Query{MinSize: 2, MaxSize: 8}, "/data-x/d.txt /data/b.jpg"},
+				{"mtime", Query{ModifiedSince: day(2), ModifiedBefore: day(4)}, "/data/b.jpg /data/sub/c.txt"},
+				{"indexed", Query{IndexedBefore: day(1)}, ""},
+				{"hash", Query{HashPrefix: strings.ToUpper(hashC[:7])}, "/data/sub/c.txt"},
+				{"hash group", Query{HashPrefix: hashC[:12]}, "/data/sub/c.txt"},
+				{"algorithm", Query{HashAlgorithm: crypto.MD5}, ""},
+				{"block size", Query{HashBlockSize: 4}, "/data-x/d.txt /data/a.txt /data/b.jpg /data/sub/c.txt /other/e.jpg"},
+				{"by size", Query{Order: OrderBySize}, "/data/a.txt /data-x/d.txt /data/b.jpg /data/sub/c.txt /other/e.jpg"},
+				{"by mtime desc", Query{Order: OrderByModTime, Descending: true, Limit: 2}, "/other/e.jpg /data-x/d.txt"},
+				{"limit", Query{Glob: "*.txt", Limit: 2}, "/data-x/d.txt /data/a.txt"},
+				{"name desc", Query{Descending: true, Limit: 1}, "/other/e.jpg"},
+			} {
+				got, err := idx.Query(ctx, &tc.q)
+				if err != nil {
+					t.Fatalf("%s: %v", tc.desc, err)
+				}
+				var names []string
+				for _, b := range got {
+					names = append(names, b.Name)
+				}
+				if s := strings.Join(names, " "); s != tc.want {
+					t.Errorf("%s - want %q; got %q", tc.desc, tc.want, s)
+				}
+			}
+
+			for _, q := range []Query{{HashPrefix: "xy"}, {Glob: "["}, {Order: -1}} {
+				if _, err := idx.Query(ctx, &q); err == nil {
+					t.Errorf("%+v: no error", q)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package remote
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/phicode/blkidx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type client struct {
+	cc grpc.ClientConnInterface
+}
+
+var _ blkidx.Index = (*client)(nil)
+
+// NewClient returns an index which forwards all calls to the index service of the connection.
+func NewClient(cc grpc.ClientConnInterface) blkidx.Index {
+	return &client{cc: cc}
+}
+
+// Dial connects to the index service at target, e.g. "host:port", without encryption.
+// The connection is established on the first call and closed by the returned Closer.
+func Dial(target string) (blkidx.Index, io.Closer, error) {
+	cc, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewClient(cc), cc, nil
+}
+
+func (c *client) invoke(ctx context.Context, method string, req, resp interface{}) error {
+	err := c.cc.Invoke(ctx, "/"+serviceName+"/"+method, req, resp, grpc.CallContentSubtype(codec{}.Name()))
+	return fromStatus(ctx, err)
+}
+
+// stream calls a streaming method with req and passes every message received to fn.
+// messages are decoded into the values returned by msg. the stream is canceled if fn returns an error.
+func (c *client) stream(ctx context.Context, method string, req interface{}, msg func() interface{}, fn func(interface{}) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s, err := c.cc.NewStream(ctx, &serviceDesc.Streams[streamIndex(method)], "/"+serviceName+"/"+method,
+		grpc.CallContentSubtype(codec{}.Name()))
+	if err != nil {
+		return fromStatus(ctx, err)
+	}
+	if err = s.SendMsg(req); err != nil {
+		return fromStatus(ctx, err)
+	}
+	if err = s.CloseSend(); err != nil {
+		return fromStatus(ctx, err)
+	}
+	for {
+		m := msg()
+		if err = s.RecvMsg(m); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fromStatus(ctx, err)
+		}
+		if err = fn(m); err != nil {
+			return err
+		}
+	}
+}
+
+// blobs calls a streaming method which sends one blob per message and returns the blobs.
+func (c *client) blobs(ctx context.Context, method string, req interface{}) ([]*blkidx.Blob, error) {
+	var rv []*blkidx.Blob
+	err := c.stream(ctx, method, req, func() interface{} { return new(blkidx.Blob) },
+		func(m interface{}) error {
+			rv = append(rv, m.(*blkidx.Blob))
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (c *client) Store(ctx context.Context, blob *blkidx.Blob) error {
+	if err := blob.Validate(); err != nil {
+		return err
+	}
+	return c.invoke(ctx, "Store", blob, &empty{})
+}
+
+func (c *client) LookupByName(ctx context.Context, name string) (*blkidx.Blob, error) {
+	var resp blobMsg
+	err := c.invoke(ctx, "LookupByName", &nameMsg{Name: name}, &resp)
+	return resp.Blob, err
+}
+
+func (c *client) LookupByHash(ctx context.Context, hash []byte) ([]*blkidx.Blob, error) {
+	return c.blobs(ctx, "LookupByHash", &hashMsg{Hash: hash})
+}
+
+func (c *client) LookupByBlockHashes(ctx context.Context, alg crypto.Hash, blockSize int, hashes [][]byte) ([]*blkidx.Blob, error) {
+	return c.blobs(ctx, "LookupByBlockHashes", &blockHashesMsg{Algorithm: alg, BlockSize: blockSize, Hashes: hashes})
+}
+
+func (c *client) Query(ctx context.Context, q *blkidx.Query) ([]*blkidx.Blob, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	return c.blobs(ctx, "Query", q)
+}
+
+func (c *client) FindEqualHashes(ctx context.Context) (rv []blkidx.EqualBlobs, err error) {
+	err = c.ForEachEqualHashes(ctx, nil, func(equal blkidx.EqualBlobs) error {
+		rv = append(rv, equal)
+		return nil
+	})
+	return rv, err
+}
+
+func (c *client) ForEachEqualHashes(ctx context.Context, under blkidx.Names, fn func(blkidx.EqualBlobs) error) error {
+	return c.stream(ctx, "ForEachEqualHashes", &namesMsg{Names: under}, func() interface{} { return new(blkidx.EqualBlobs) },
+		func(m interface{}) error { return fn(*m.(*blkidx.EqualBlobs)) })
+}
+
+func (c *client) Stats(ctx context.Context, under blkidx.Names, top int) (*blkidx.Stats, error) {
+	var data []byte
+	err := c.stream(ctx, "Stats", &statsMsg{Under: under, Top: top}, func() interface{} { return new(dataMsg) },
+		func(m interface{}) error {
+			data = append(data, m.(*dataMsg).Data...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	stats := new(blkidx.Stats)
+	if err = json.Unmarshal(data, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (c *client) AllNames(ctx context.Context) (rv blkidx.Names, err error) {
+	err = c.ForEachName(ctx, nil, func(name string) error {
+		rv = append(rv, name)
+		return nil
+	})
+	return rv, err
+}
+
+func (c *client) ForEachName(ctx context.Context, under blkidx.Names, fn func(string) error) error {
+	return c.stream(ctx, "ForEachName", &namesMsg{Names: under}, func() interface{} { return new(namesMsg) },
+		func(m interface{}) error {
+			for _, name := range m.(*namesMsg).Names {
+				if err := fn(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+func (c *client) ForEach(ctx context.Context, fn func(*blkidx.Blob) error) error {
+	return c.stream(ctx, "ForEach", &empty{}, func() interface{} { return new(blkidx.Blob) },
+		func(m interface{}) error { return fn(m.(*blkidx.Blob)) })
+}
+
+func (c *client) Remove(ctx context.Context, names blkidx.Names) error {
+	return c.invoke(ctx, "Remove", &namesMsg{Names: names}, &empty{})
+}
+
+func (c *client) RemoveUnder(ctx context.Context, under blkidx.Names) (int, error) {
+	var resp countMsg
+	err := c.invoke(ctx, "RemoveUnder", &namesMsg{Names: under}, &resp)
+	return resp.Count, err
+}
+
+func (c *client) Count(ctx context.Context) (int, error) {
+	var resp countMsg
+	err := c.invoke(ctx, "Count", &empty{}, &resp)
+	return resp.Count, err
+}
+
+func (c *client) StoreVolume(ctx context.Context, volume *blkidx.Volume) error {
+	if err := volume.Validate(); err != nil {
+		return err
+	}
+	return c.invoke(ctx, "StoreVolume", volume, &empty{})
+}
+
+func (c *client) Volumes(ctx context.Context) ([]*blkidx.Volume, error) {
+	var resp volumesMsg
+	err := c.invoke(ctx, "Volumes", &empty{}, &resp)
+	return resp.Volumes, err
+}
+
+func (c *client) RemoveVolume(ctx context.Context, name string) error {
+	return c.invoke(ctx, "RemoveVolume", &nameMsg{Name: name}, &empty{})
+}
@@ -0,0 +1,245 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phicode/blkidx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testClient returns a client of a server which serves a memory index.
+func testClient(t *testing.T) blkidx.Index {
+	return testServer(t, blkidx.NewMemoryIndex())
+}
+
+// testServer returns a client of a server which serves idx.
+func testServer(t *testing.T, idx blkidx.Index) blkidx.Index {
+	l := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	Register(s, idx)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return NewClient(cc)
+}
+
+func storeContent(t *testing.T, idx blkidx.Index, name, content string) *blkidx.Blob {
+	blob := &blkidx.Blob{
+		Name:          name,
+		IndexTime:     time.Now().UTC(),
+		ModTime:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		HashAlgorithm: blkidx.DefaultHashAlgorithm,
+		HashBlockSize: 4,
+	}
+	var err error
+	blob.Hash, blob.HashedBlocks, blob.Size, err = blkidx.HashAll(context.Background(),
+		strings.NewReader(content), blob.HashAlgorithm, blob.HashBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.Store(context.Background(), blob); err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestStoreAndLookup(t *testing.T) {
+	ctx := context.Background()
+	idx := testClient(t)
+
+	blob := storeContent(t, idx, "/a", "content")
+	storeContent(t, idx, "/b", "content")
+	storeContent(t, idx, "/c", "other content")
+
+	got, err := idx.LookupByName(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Name != blob.Name || got.Size != blob.Size || !got.ModTime.Equal(blob.ModTime) ||
+		!got.EqualHash(blob) || len(got.HashedBlocks) != len(blob.HashedBlocks) {
+		t.Errorf("want %+v; got %+v", blob, got)
+	}
+	if got, err = idx.LookupByName(ctx, "/missing"); got != nil || err != nil {
+		t.Errorf("missing - want nil, nil; got %v, %v", got, err)
+	}
+
+	blobs, err := idx.LookupByHash(ctx, blob.Hash)
+	if err != nil || len(blobs) != 2 || blobs[0].Name != "/a" || blobs[1].Name != "/b" {
+		t.Errorf("by hash - got %v, %v", blobs, err)
+	}
+	blobs, err = idx.LookupByBlockHashes(ctx, blob.HashAlgorithm, blob.HashBlockSize, blob.HashedBlocks[:1])
+	if err != nil || len(blobs) != 2 {
+		t.Errorf("by block hashes - got %v, %v", blobs, err)
+	}
+	blobs, err = idx.Query(ctx, &blkidx.Query{MinSize: 8})
+	if err != nil || len(blobs) != 1 || blobs[0].Name != "/c" {
+		t.Errorf("query - got %v, %v", blobs, err)
+	}
+	if n, err := idx.Count(ctx); n != 3 || err != nil {
+		t.Errorf("count - want 3; got %d, %v", n, err)
+	}
+
+	// the version of the stored blob is 0, storing it again must fail
+	err = idx.Store(ctx, blob)
+	var lockErr *blkidx.OptimisticLockingError
+	if !errors.As(err, &lockErr) || lockErr.Name != "/a" || lockErr.FailedVersion != 0 {
+		t.Errorf("want an optimistic locking error; got %v", err)
+	}
+	if err = idx.Store(ctx, &blkidx.Blob{}); err == nil {
+		t.Error("want a validation error")
+	}
+
+	if err = idx.Remove(ctx, blkidx.Names{"/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := idx.RemoveUnder(ctx, blkidx.Names{"/c"}); n != 1 || err != nil {
+		t.Errorf("remove under - want 1; got %d, %v", n, err)
+	}
+	names, err := idx.AllNames(ctx)
+	if err != nil || len(names) != 1 || names[0] != "/b" {
+		t.Errorf("after remove - got %v, %v", names, err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	ctx := context.Background()
+	idx := testClient(t)
+
+	n := namesPerMessage*2 + 10
+	for i := 0; i < n; i++ {
+		storeContent(t, idx, fmt.Sprintf("/%05d", i), fmt.Sprint(i%(n-5)))
+	}
+
+	names, err := idx.AllNames(ctx)
+	if err != nil || len(names) != n {
+		t.Fatalf("all names - want %d; got %d, %v", n, len(names), err)
+	}
+	equal, err := idx.FindEqualHashes(ctx)
+	if err != nil || len(equal) != 5 {
+		t.Fatalf("equal hashes - want 5 groups; got %v, %v", equal, err)
+	}
+	for _, e := range equal {
+		if len(e.Names) != 2 {
+			t.Errorf("want pairs; got %v", e.Names)
+		}
+	}
+
+	var under []string
+	err = idx.ForEachName(ctx, blkidx.Names{"/00001", "/02047"}, func(name string) error {
+		under = append(under, name)
+		return nil
+	})
+	if err != nil || strings.Join(under, " ") != "/00001 /02047" {
+		t.Errorf("names under - got %v, %v", under, err)
+	}
+	var groups int
+	err = idx.ForEachEqualHashes(ctx, blkidx.Names{"/00001"}, func(equal blkidx.EqualBlobs) error {
+		groups++
+		if strings.Join(equal.Names, " ") != fmt.Sprintf("/00001 /%05d", n-4) {
+			t.Errorf("group under - got %v", equal.Names)
+		}
+		return nil
+	})
+	if err != nil || groups != 1 {
+		t.Errorf("groups under - got %d, %v", groups, err)
+	}
+
+	var visited []string
+	stop := errors.New("stop")
+	err = idx.ForEach(ctx, func(blob *blkidx.Blob) error {
+		visited = append(visited, blob.Name)
+		if len(visited) == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || !sort.StringsAreSorted(visited) || len(visited) != 3 {
+		t.Errorf("for each - got %v, %v", visited, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = idx.AllNames(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled; got %v", err)
+	}
+}
+
+func TestStatsAndVolumes(t *testing.T) {
+	ctx := context.Background()
+	idx := testClient(t)
+
+	storeContent(t, idx, "/a/x.txt", "content")
+	storeContent(t, idx, "/b/x.txt", "content")
+	stats, err := idx.Stats(ctx, blkidx.Names{"/a"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total.Files != 1 || stats.Total.Bytes != 7 || len(stats.Extensions) != 1 {
+		t.Errorf("stats - got %+v", stats)
+	}
+
+	v := &blkidx.Volume{Name: "usb", ID: "marker:1234", Root: "/mnt/usb"}
+	if err = idx.StoreVolume(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := idx.Volumes(ctx)
+	if err != nil || len(volumes) != 1 || *volumes[0] != *v {
+		t.Errorf("volumes - got %v, %v", volumes, err)
+	}
+	if err = idx.RemoveVolume(ctx, "usb"); err != nil {
+		t.Fatal(err)
+	}
+	if volumes, err = idx.Volumes(ctx); err != nil || len(volumes) != 0 {
+		t.Errorf("volumes after remove - got %v, %v", volumes, err)
+	}
+}
+
+// results which exceed the maximum message size of 4 MiB
+func TestLargeResults(t *testing.T) {
+	ctx := context.Background()
+	idx := blkidx.NewMemoryIndex()
+	client := testServer(t, idx)
+
+	const n = 20000
+	dir := "/" + strings.Repeat("d", 240)
+	var blob *blkidx.Blob
+	for i := 0; i < n; i++ {
+		blob = storeContent(t, idx, fmt.Sprintf("%s/%05d", dir, i), "same content")
+	}
+
+	blobs, err := client.Query(ctx, &blkidx.Query{Under: blkidx.Names{dir}})
+	if err != nil || len(blobs) != n || blobs[n-1].Name != blob.Name {
+		t.Errorf("query - want %d blobs; got %d, %v", n, len(blobs), err)
+	}
+	blobs, err = client.LookupByHash(ctx, blob.Hash)
+	if err != nil || len(blobs) != n {
+		t.Errorf("by hash - want %d blobs; got %d, %v", n, len(blobs), err)
+	}
+	blobs, err = client.LookupByBlockHashes(ctx, blob.HashAlgorithm, blob.HashBlockSize, blob.HashedBlocks[:1])
+	if err != nil || len(blobs) != n {
+		t.Errorf("by block hashes - want %d blobs; got %d, %v", n, len(blobs), err)
+	}
+	stats, err := client.Stats(ctx, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Groups) != 1 || len(stats.Groups[0].Names) != n || stats.Duplicates.Files != n {
+		t.Errorf("stats - want a group of %d names; got %+v", n, stats.Duplicates)
+	}
+}
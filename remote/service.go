@@ -0,0 +1,327 @@
+// Package remote serves an index over gRPC and provides a client which implements
+// blkidx.Index on top of a connection to such a server, so that several machines can
+// index their disks into one central index.
+//
+// Messages are encoded as JSON with a codec named "json" instead of protocol buffers,
+// the service is described by hand. The service offers neither authentication nor
+// encryption, it must only be reachable from trusted networks.
+package remote
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/phicode/blkidx"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	serviceName = "blkidx.Index"
+
+	// the number of names per message of ForEachName
+	namesPerMessage = 1024
+
+	// the number of bytes of the encoded statistics per message of Stats
+	bytesPerMessage = 1 << 20
+
+	// the domain and reason of the error details of an OptimisticLockingError
+	errorDomain        = "blkidx"
+	errorReasonVersion = "OPTIMISTIC_LOCKING"
+	errorMetaName      = "name"
+	errorMetaVersion   = "failed_version"
+)
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// codec encodes messages as JSON.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (codec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (codec) Name() string                               { return "json" }
+
+type empty struct{}
+
+type nameMsg struct {
+	Name string
+}
+
+type hashMsg struct {
+	Hash []byte
+}
+
+type blockHashesMsg struct {
+	Algorithm crypto.Hash
+	BlockSize int
+	Hashes    [][]byte
+}
+
+type blobMsg struct {
+	Blob *blkidx.Blob // nil if there is no such blob
+}
+
+type statsMsg struct {
+	Under blkidx.Names
+	Top   int
+}
+
+// dataMsg is a part of a value which is encoded as a whole, see Stats
+type dataMsg struct {
+	Data []byte
+}
+
+type namesMsg struct {
+	Names blkidx.Names
+}
+
+type countMsg struct {
+	Count int
+}
+
+type volumesMsg struct {
+	Volumes []*blkidx.Volume
+}
+
+// serviceDesc describes the index service, each method of blkidx.Index is mapped to
+// a method of the same name. Results which may exceed the maximum message size are streamed,
+// the blobs of lookups and queries one per message. FindEqualHashes and AllNames are implemented
+// by the client on top of ForEachEqualHashes and ForEachName.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*blkidx.Index)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Store", func() interface{} { return new(blkidx.Blob) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				return &empty{}, idx.Store(ctx, req.(*blkidx.Blob))
+			}),
+		unary("LookupByName", func() interface{} { return new(nameMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				blob, err := idx.LookupByName(ctx, req.(*nameMsg).Name)
+				return &blobMsg{Blob: blob}, err
+			}),
+		unary("Remove", func() interface{} { return new(namesMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				return &empty{}, idx.Remove(ctx, req.(*namesMsg).Names)
+			}),
+		unary("RemoveUnder", func() interface{} { return new(namesMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				n, err := idx.RemoveUnder(ctx, req.(*namesMsg).Names)
+				return &countMsg{Count: n}, err
+			}),
+		unary("Count", func() interface{} { return new(empty) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				n, err := idx.Count(ctx)
+				return &countMsg{Count: n}, err
+			}),
+		unary("StoreVolume", func() interface{} { return new(blkidx.Volume) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				return &empty{}, idx.StoreVolume(ctx, req.(*blkidx.Volume))
+			}),
+		unary("Volumes", func() interface{} { return new(empty) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				volumes, err := idx.Volumes(ctx)
+				return &volumesMsg{Volumes: volumes}, err
+			}),
+		unary("RemoveVolume", func() interface{} { return new(nameMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error) {
+				return &empty{}, idx.RemoveVolume(ctx, req.(*nameMsg).Name)
+			}),
+	},
+	Streams: []grpc.StreamDesc{
+		serverStream("LookupByHash", func() interface{} { return new(hashMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				blobs, err := idx.LookupByHash(ctx, req.(*hashMsg).Hash)
+				return sendBlobs(send, blobs, err)
+			}),
+		serverStream("LookupByBlockHashes", func() interface{} { return new(blockHashesMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				m := req.(*blockHashesMsg)
+				blobs, err := idx.LookupByBlockHashes(ctx, m.Algorithm, m.BlockSize, m.Hashes)
+				return sendBlobs(send, blobs, err)
+			}),
+		serverStream("Query", func() interface{} { return new(blkidx.Query) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				blobs, err := idx.Query(ctx, req.(*blkidx.Query))
+				return sendBlobs(send, blobs, err)
+			}),
+		serverStream("Stats", func() interface{} { return new(statsMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				// a single group or directory may be large, the encoded statistics are split
+				m := req.(*statsMsg)
+				stats, err := idx.Stats(ctx, m.Under, m.Top)
+				if err != nil {
+					return err
+				}
+				data, err := json.Marshal(stats)
+				if err != nil {
+					return err
+				}
+				for len(data) > 0 {
+					n := min(len(data), bytesPerMessage)
+					if err = send(&dataMsg{Data: data[:n]}); err != nil {
+						return err
+					}
+					data = data[n:]
+				}
+				return nil
+			}),
+		serverStream("ForEachEqualHashes", func() interface{} { return new(namesMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				return idx.ForEachEqualHashes(ctx, req.(*namesMsg).Names, func(equal blkidx.EqualBlobs) error {
+					return send(&equal)
+				})
+			}),
+		serverStream("ForEachName", func() interface{} { return new(namesMsg) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				var names blkidx.Names
+				err := idx.ForEachName(ctx, req.(*namesMsg).Names, func(name string) error {
+					if names = append(names, name); len(names) < namesPerMessage {
+						return nil
+					}
+					err := send(&namesMsg{Names: names})
+					names = names[:0]
+					return err
+				})
+				if err == nil && len(names) > 0 {
+					err = send(&namesMsg{Names: names})
+				}
+				return err
+			}),
+		serverStream("ForEach", func() interface{} { return new(empty) },
+			func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error {
+				return idx.ForEach(ctx, func(blob *blkidx.Blob) error { return send(blob) })
+			}),
+	},
+}
+
+// sendBlobs sends every blob as a message, unless err is not nil.
+func sendBlobs(send func(interface{}) error, blobs []*blkidx.Blob, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if err = send(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register registers the index service of idx with s.
+func Register(s grpc.ServiceRegistrar, idx blkidx.Index) {
+	s.RegisterService(&serviceDesc, idx)
+}
+
+// streamIndex returns the index of the stream in serviceDesc.Streams.
+func streamIndex(name string) int {
+	for i, s := range serviceDesc.Streams {
+		if s.StreamName == name {
+			return i
+		}
+	}
+	panic("unknown stream " + name)
+}
+
+func unary(name string, newReq func() interface{},
+	call func(ctx context.Context, idx blkidx.Index, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				resp, err := call(ctx, srv.(blkidx.Index), req)
+				if err != nil {
+					return nil, toStatus(err)
+				}
+				return resp, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + name}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+// serverStream describes a method which receives one message and sends a stream of messages.
+func serverStream(name string, newReq func() interface{},
+	call func(ctx context.Context, idx blkidx.Index, req interface{}, send func(interface{}) error) error) grpc.StreamDesc {
+	return grpc.StreamDesc{
+		StreamName:    name,
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := newReq()
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			if err := call(stream.Context(), srv.(blkidx.Index), req, stream.SendMsg); err != nil {
+				return toStatus(err)
+			}
+			return nil
+		},
+	}
+}
+
+// toStatus converts an error of an index to a status error. the details of an
+// OptimisticLockingError are retained, see fromStatus.
+func toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var lockErr *blkidx.OptimisticLockingError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.As(err, &lockErr):
+		s, detailsErr := status.New(codes.Aborted, err.Error()).WithDetails(&errdetails.ErrorInfo{
+			Domain: errorDomain,
+			Reason: errorReasonVersion,
+			Metadata: map[string]string{
+				errorMetaName:    lockErr.Name,
+				errorMetaVersion: strconv.FormatUint(lockErr.FailedVersion, 10),
+			},
+		})
+		if detailsErr == nil {
+			return s.Err()
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// fromStatus converts a status error of a call to the error which the index of the server returned.
+func fromStatus(ctx context.Context, err error) error {
+	s, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	switch s.Code() {
+	case codes.Canceled, codes.DeadlineExceeded:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	case codes.Aborted:
+		for _, d := range s.Details() {
+			if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain && info.Reason == errorReasonVersion {
+				version, _ := strconv.ParseUint(info.Metadata[errorMetaVersion], 10, 64)
+				return &blkidx.OptimisticLockingError{Name: info.Metadata[errorMetaName], FailedVersion: version}
+			}
+		}
+	case codes.Unknown:
+		return errors.New(s.Message())
+	}
+	return err
+}
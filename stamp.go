@@ -0,0 +1,38 @@
+package blkidx
+
+import (
+	"os"
+	"time"
+)
+
+// FileStamp is the metadata of a file which changes whenever its content changes.
+type FileStamp struct {
+	Size    int64
+	ModTime time.Time
+
+	// status change time, zero if the platform does not provide it
+	ChangeTime time.Time
+
+	// inode number, zero if the platform does not provide it
+	Inode uint64
+
+	// change attribute (i_version) of the file system, zero if it is not available
+	ChangeAttr uint64
+}
+
+func NewFileStamp(info os.FileInfo) FileStamp {
+	s := FileStamp{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+	}
+	platformStamp(info, &s)
+	return s
+}
+
+func (s FileStamp) Equal(other FileStamp) bool {
+	return s.Size == other.Size &&
+		s.ModTime.Equal(other.ModTime) &&
+		s.ChangeTime.Equal(other.ChangeTime) &&
+		s.Inode == other.Inode &&
+		s.ChangeAttr == other.ChangeAttr
+}
@@ -0,0 +1,16 @@
+//go:build darwin || freebsd || netbsd
+
+package blkidx
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func platformStamp(info os.FileInfo, s *FileStamp) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		s.ChangeTime = time.Unix(st.Ctimespec.Unix()).UTC()
+		s.Inode = uint64(st.Ino)
+	}
+}
@@ -0,0 +1,16 @@
+package blkidx
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// the change attribute is only available inside the kernel (STATX_CHANGE_COOKIE),
+// statx does not report it to user space yet.
+func platformStamp(info os.FileInfo, s *FileStamp) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		s.ChangeTime = time.Unix(st.Ctim.Unix()).UTC()
+		s.Inode = st.Ino
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package blkidx
+
+import (
+	"os"
+)
+
+func platformStamp(info os.FileInfo, s *FileStamp) {}
@@ -0,0 +1,33 @@
+package blkidx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStamp(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(name, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := statStamp(t, name)
+	if !before.Equal(statStamp(t, name)) {
+		t.Error("unmodified file reports a different stamp")
+	}
+
+	if err := os.WriteFile(name, []byte("bb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if before.Equal(statStamp(t, name)) {
+		t.Error("modified file reports the same stamp")
+	}
+}
+
+func statStamp(t *testing.T, name string) FileStamp {
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileStamp(info)
+}
@@ -0,0 +1,226 @@
+package blkidx
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StatsSizeBuckets are the exclusive upper bounds of all but the last bucket of the size histogram.
+var StatsSizeBuckets = []int64{1 << 10, 16 << 10, 256 << 10, 4 << 20, 64 << 20, 1 << 30, 16 << 30}
+
+// Stats are aggregates over the blobs of an index.
+// Duplicates are non-empty blobs whose hash is shared by another blob of the same selection.
+type Stats struct {
+	Total StatsCount
+
+	// all duplicates, including the first name of each content
+	Duplicates StatsCount
+
+	// the bytes which would be freed by keeping only one name of each content
+	RedundantBytes int64
+
+	// one bucket per size range of StatsSizeBuckets, including empty buckets
+	Sizes []SizeBucket
+
+	// by bytes, largest first
+	Extensions []ExtensionStats
+
+	// by redundant bytes, largest first
+	Groups []EqualBlobs
+
+	// the duplicates located below each directory, most bytes first. directories
+	// whose duplicates are all located in one subdirectory are omitted.
+	Dirs []DirStats
+}
+
+type StatsCount struct {
+	Files, Bytes int64
+}
+
+func (c *StatsCount) add(files, bytes int64) {
+	c.Files += files
+	c.Bytes += bytes
+}
+
+// SizeBucket counts the blobs with Min <= size < Max, Max is 0 for the last bucket.
+type SizeBucket struct {
+	Min, Max int64
+	StatsCount
+}
+
+// ExtensionStats counts the blobs by the lower case extension of their name, see filepath.Ext.
+type ExtensionStats struct {
+	Extension string
+	StatsCount
+}
+
+// DirStats counts the duplicates located below a directory.
+type DirStats struct {
+	Dir string
+	StatsCount
+}
+
+func newStats() *Stats {
+	s := &Stats{Sizes: make([]SizeBucket, len(StatsSizeBuckets)+1)}
+	for i := range s.Sizes {
+		if i > 0 {
+			s.Sizes[i].Min = StatsSizeBuckets[i-1]
+		}
+		if i < len(StatsSizeBuckets) {
+			s.Sizes[i].Max = StatsSizeBuckets[i]
+		}
+	}
+	return s
+}
+
+func sizeBucket(size int64) int {
+	return sort.Search(len(StatsSizeBuckets), func(i int) bool { return size < StatsSizeBuckets[i] })
+}
+
+// the separators of names, file system and volume names
+const nameSeparators = "/" + string(filepath.Separator)
+
+// nameDir returns the directory part of a name including its trailing separator.
+func nameDir(name string) string {
+	return name[:strings.LastIndexAny(name, nameSeparators)+1]
+}
+
+// nameExt returns the extension of a name with ascii letters in lower case.
+func nameExt(name string) string {
+	base := name[len(nameDir(name)):]
+	i := strings.LastIndexByte(base, '.')
+	if i < 0 {
+		return ""
+	}
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, base[i:])
+}
+
+// parentDir returns the parent directory of a name, the root of a volume
+// or "" if the name has no parent.
+func parentDir(name string) string {
+	dir := nameDir(name)
+	if len(dir) > 1 {
+		dir = dir[:len(dir)-1]
+	}
+	return dir
+}
+
+// addDirStats adds the duplicates of a directory, given with its trailing separator, to the
+// directory and all its parents which are located below one of the names of under.
+func addDirStats(dirs map[string]*StatsCount, dir string, under Names, files, bytes int64) {
+	if len(dir) > 1 {
+		dir = dir[:len(dir)-1]
+	}
+	for dir != "" && (len(under) == 0 || NameIsUnderAny(dir, under)) {
+		c := dirs[dir]
+		if c == nil {
+			c = new(StatsCount)
+			dirs[dir] = c
+		}
+		c.add(files, bytes)
+		parent := parentDir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+}
+
+// statsBuilder aggregates the stats of blobs one by one, for indexes which have no
+// better means to compute them.
+type statsBuilder struct {
+	stats  *Stats
+	under  Names
+	exts   map[string]*StatsCount
+	byHash map[string]*EqualBlobs
+}
+
+func newStatsBuilder(under Names) *statsBuilder {
+	return &statsBuilder{
+		stats:  newStats(),
+		under:  under,
+		exts:   make(map[string]*StatsCount),
+		byHash: make(map[string]*EqualBlobs),
+	}
+}
+
+func (b *statsBuilder) add(blob *Blob) {
+	s := b.stats
+	s.Total.add(1, blob.Size)
+	s.Sizes[sizeBucket(blob.Size)].add(1, blob.Size)
+	ext := nameExt(blob.Name)
+	if b.exts[ext] == nil {
+		b.exts[ext] = new(StatsCount)
+	}
+	b.exts[ext].add(1, blob.Size)
+	if blob.Size > 0 {
+		if b.byHash[string(blob.Hash)] == nil {
+			b.byHash[string(blob.Hash)] = new(EqualBlobs)
+		}
+		b.byHash[string(blob.Hash)].Append(blob)
+	}
+}
+
+func (b *statsBuilder) finish(top int) *Stats {
+	s := b.stats
+	for ext, c := range b.exts {
+		s.Extensions = append(s.Extensions, ExtensionStats{Extension: ext, StatsCount: *c})
+	}
+	dirs := make(map[string]*StatsCount)
+	for _, equal := range b.byHash {
+		n := int64(len(equal.Names))
+		if n < 2 {
+			continue
+		}
+		s.Duplicates.add(n, n*equal.Size)
+		s.RedundantBytes += (n - 1) * equal.Size
+		s.Groups = append(s.Groups, *equal)
+		for _, name := range equal.Names {
+			addDirStats(dirs, nameDir(name), b.under, 1, equal.Size)
+		}
+	}
+	s.finish(dirs, top)
+	return s
+}
+
+// finish sorts the aggregates and limits their number to top, if top is greater than 0.
+func (s *Stats) finish(dirs map[string]*StatsCount, top int) {
+	omit := make(map[string]bool)
+	for dir, c := range dirs {
+		if parent := parentDir(dir); parent != dir && dirs[parent] != nil && *dirs[parent] == *c {
+			omit[parent] = true
+		}
+	}
+	for dir, c := range dirs {
+		if !omit[dir] {
+			s.Dirs = append(s.Dirs, DirStats{Dir: dir, StatsCount: *c})
+		}
+	}
+	sort.Slice(s.Dirs, func(i, j int) bool {
+		a, b := s.Dirs[i], s.Dirs[j]
+		return a.Bytes > b.Bytes || (a.Bytes == b.Bytes && a.Dir < b.Dir)
+	})
+	sort.Slice(s.Extensions, func(i, j int) bool {
+		a, b := s.Extensions[i], s.Extensions[j]
+		return a.Bytes > b.Bytes || (a.Bytes == b.Bytes && a.Extension < b.Extension)
+	})
+	for _, g := range s.Groups {
+		g.Names.Sort()
+	}
+	sort.Slice(s.Groups, func(i, j int) bool {
+		a, b := s.Groups[i], s.Groups[j]
+		ra, rb := a.Size*int64(len(a.Names)-1), b.Size*int64(len(b.Names)-1)
+		return ra > rb || (ra == rb && a.Names[0] < b.Names[0])
+	})
+	if top > 0 {
+		s.Dirs = s.Dirs[:min(top, len(s.Dirs))]
+		s.Extensions = s.Extensions[:min(top, len(s.Extensions))]
+		s.Groups = s.Groups[:min(top, len(s.Groups))]
+	}
+}
@@ -0,0 +1,79 @@
+package blkidx
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	indexes := testIndexes(t)
+	for _, idx := range indexes {
+		storeContent(t, idx, "/data/a.txt", "hello")
+		storeContent(t, idx, "/data/sub/a.TXT", "hello")
+		storeContent(t, idx, "/data/sub/deep/a", "hello")
+		storeContent(t, idx, "/data/b.jpg", "large image")
+		storeContent(t, idx, "/other/b.jpg", "large image")
+		storeContent(t, idx, "/other/.hidden", "x")
+		storeContent(t, idx, "/other/empty.txt", "")
+		storeContent(t, idx, "/other/empty2.txt", "")
+		storeContent(t, idx, "vol:usb/b.jpg", "large image")
+		storeContent(t, idx, "vol:usb/c.dir/big", strings.Repeat("z", 2000))
+	}
+
+	for _, tc := range []struct {
+		under Names
+		top   int
+		check func(t *testing.T, s *Stats)
+	}{
+		{nil, 0, func(t *testing.T, s *Stats) {
+			if s.Total != (StatsCount{10, 2049}) {
+				t.Errorf("total: %+v", s.Total)
+			}
+			if s.Duplicates != (StatsCount{6, 48}) || s.RedundantBytes != 32 {
+				t.Errorf("duplicates: %+v, redundant: %d", s.Duplicates, s.RedundantBytes)
+			}
+			if len(s.Sizes) != len(StatsSizeBuckets)+1 || s.Sizes[0].StatsCount != (StatsCount{9, 49}) ||
+				s.Sizes[1] != (SizeBucket{1 << 10, 16 << 10, StatsCount{1, 2000}}) {
+				t.Errorf("sizes: %+v", s.Sizes)
+			}
+			want := []ExtensionStats{{"", StatsCount{2, 2005}}, {".jpg", StatsCount{3, 33}},
+				{".txt", StatsCount{4, 10}}, {".hidden", StatsCount{1, 1}}}
+			if !reflect.DeepEqual(s.Extensions, want) {
+				t.Errorf("extensions: %+v", s.Extensions)
+			}
+			if len(s.Groups) != 2 || strings.Join(s.Groups[0].Names, " ") != "/data/b.jpg /other/b.jpg vol:usb/b.jpg" ||
+				s.Groups[1].Size != 5 {
+				t.Errorf("groups: %+v", s.Groups)
+			}
+			wantDirs := []DirStats{{"/", StatsCount{5, 37}}, {"/data", StatsCount{4, 26}}, {"/other", StatsCount{1, 11}},
+				{"vol:usb", StatsCount{1, 11}}, {"/data/sub", StatsCount{2, 10}}, {"/data/sub/deep", StatsCount{1, 5}}}
+			if !reflect.DeepEqual(s.Dirs, wantDirs) {
+				t.Errorf("dirs: %+v", s.Dirs)
+			}
+		}},
+		{Names{"/data/sub", "/other"}, 1, func(t *testing.T, s *Stats) {
+			if s.Total != (StatsCount{6, 22}) || s.Duplicates != (StatsCount{2, 10}) {
+				t.Errorf("total: %+v, duplicates: %+v", s.Total, s.Duplicates)
+			}
+			if len(s.Extensions) != 1 || s.Extensions[0].Extension != ".jpg" {
+				t.Errorf("extensions: %+v", s.Extensions)
+			}
+			if len(s.Groups) != 1 || len(s.Groups[0].Names) != 2 {
+				t.Errorf("groups: %+v", s.Groups)
+			}
+			if want := []DirStats{{"/data/sub", StatsCount{2, 10}}}; !reflect.DeepEqual(s.Dirs, want) {
+				t.Errorf("dirs: %+v", s.Dirs)
+			}
+		}},
+	} {
+		for name, idx := range indexes {
+			s, err := idx.Stats(context.Background(), tc.under, tc.top)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Run(name+" "+strings.Join(tc.under, ","), func(t *testing.T) { tc.check(t, s) })
+		}
+	}
+}
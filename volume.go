@@ -0,0 +1,348 @@
+package blkidx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/phicode/blkidx/fs"
+)
+
+const (
+	// prefix of blob names which are relative to a volume: "vol:<volume>/<relative path>"
+	VolumeNamePrefix = "vol:"
+
+	// name of the file in the root directory of a volume which identifies the volume
+	// if it is not identified by the uuid of its file system
+	VolumeMarkerFile = ".blkidx-volume"
+
+	volumeIDUUID   = "uuid:"
+	volumeIDMarker = "marker:"
+)
+
+// Volume is a named root directory, usually of a removable or network drive.
+// Blobs below the root of a volume are stored with names relative to the volume,
+// so that the volume can be found again when it is mounted at a different location.
+type Volume struct {
+	Name string
+
+	// a stable identifier, either "uuid:<file system uuid>" or "marker:<id>"
+	// where the id is stored in the VolumeMarkerFile of the volume's root directory
+	ID string
+
+	// the last known location of the volume's root directory
+	Root string
+}
+
+var (
+	volumeErrNil  = errors.New("invalid nil volume")
+	volumeErrName = errors.New("invalid volume name")
+	volumeErrID   = errors.New("invalid volume id")
+	volumeErrRoot = errors.New("invalid volume root")
+)
+
+func (v *Volume) Validate() error {
+	if v == nil {
+		return volumeErrNil
+	}
+	if v.Name == "" || strings.TrimSpace(v.Name) != v.Name || strings.ContainsAny(v.Name, `/\`) {
+		return volumeErrName
+	}
+	if !strings.HasPrefix(v.ID, volumeIDUUID) && !strings.HasPrefix(v.ID, volumeIDMarker) {
+		return volumeErrID
+	}
+	if !filepath.IsAbs(v.Root) {
+		return volumeErrRoot
+	}
+	return nil
+}
+
+// VolumePath returns the blob name of a path relative to the root of a volume.
+func VolumePath(volume, rel string) string {
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == "" {
+		return VolumeNamePrefix + volume
+	}
+	return VolumeNamePrefix + volume + "/" + rel
+}
+
+// SplitVolumePath splits a blob name into the volume name and the slash separated
+// path relative to the volume's root. ok is false if name is not relative to a volume.
+func SplitVolumePath(name string) (volume, rel string, ok bool) {
+	if !strings.HasPrefix(name, VolumeNamePrefix) {
+		return "", "", false
+	}
+	name = name[len(VolumeNamePrefix):]
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return name[:i], name[i+1:], true
+	}
+	return name, "", true
+}
+
+// NewVolume identifies the directory root as a volume.
+// Mount points with a file system uuid are identified by the uuid unless useMarker is set,
+// all other volumes are identified by a marker file which is created if it does not exist.
+func NewVolume(name, root string, useMarker bool) (*Volume, error) {
+	root, err := fs.CleanAbsolute(root)
+	if err != nil {
+		return nil, err
+	}
+	v := &Volume{Name: name, Root: root}
+	if id, err := readVolumeMarker(root); err == nil {
+		v.ID = id
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if v.ID == "" && !useMarker && isMountPoint(root) {
+		if uuid, err := fs.FilesystemUUID(root); err == nil {
+			v.ID = volumeIDUUID + uuid
+		}
+	}
+	if v.ID == "" {
+		if v.ID, err = writeVolumeMarker(root); err != nil {
+			return nil, err
+		}
+	}
+	return v, v.Validate()
+}
+
+func readVolumeMarker(root string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(root, VolumeMarkerFile))
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", fmt.Errorf("empty volume marker in %q", root)
+	}
+	return volumeIDMarker + id, nil
+}
+
+func writeVolumeMarker(root string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+	if err := os.WriteFile(filepath.Join(root, VolumeMarkerFile), []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return volumeIDMarker + id, nil
+}
+
+func isMountPoint(dir string) bool {
+	mounts, _ := fs.MountPoints()
+	for _, m := range mounts {
+		if m.Dir == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// hasVolumeID reports whether the directory dir is the root of the volume with the given id.
+func hasVolumeID(dir, id string) bool {
+	switch {
+	case strings.HasPrefix(id, volumeIDMarker):
+		marker, err := readVolumeMarker(dir)
+		return err == nil && marker == id
+	case strings.HasPrefix(id, volumeIDUUID):
+		uuid, err := fs.FilesystemUUID(dir)
+		return err == nil && volumeIDUUID+uuid == id
+	}
+	return false
+}
+
+// locateVolume finds the current root directory of a volume, which is either its last
+// known root or one of the mount points. false is returned if the volume is not mounted.
+func locateVolume(v *Volume, mounts []fs.Mount) (string, bool) {
+	if hasVolumeID(v.Root, v.ID) {
+		return v.Root, true
+	}
+	for _, m := range mounts {
+		if m.Dir != v.Root && hasVolumeID(m.Dir, v.ID) {
+			return m.Dir, true
+		}
+	}
+	return "", false
+}
+
+// VolumeSet maps file system paths to blob names and back through the current
+// location of all volumes. A nil *VolumeSet maps every name to itself.
+type VolumeSet struct {
+	volumes []*Volume // ordered by name
+	byRoot  []*Volume // ordered by descending root length
+	online  map[string]bool
+}
+
+// LoadVolumes loads all volumes of an index and locates them.
+// Volumes which are found at a new location are updated in the index.
+func LoadVolumes(ctx context.Context, idx Index) (*VolumeSet, error) {
+	volumes, err := idx.Volumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := fs.MountPoints()
+	if err != nil {
+		return nil, err
+	}
+	s := &VolumeSet{online: make(map[string]bool, len(volumes))}
+	for _, v := range volumes {
+		root, found := locateVolume(v, mounts)
+		if found && root != v.Root {
+			v.Root = root
+			if err := idx.StoreVolume(ctx, v); err != nil {
+				return nil, err
+			}
+		}
+		s.online[v.Name] = found
+		s.volumes = append(s.volumes, v)
+	}
+	// the most specific root wins for nested volumes
+	s.byRoot = append([]*Volume(nil), s.volumes...)
+	sort.SliceStable(s.byRoot, func(i, j int) bool { return len(s.byRoot[i].Root) > len(s.byRoot[j].Root) })
+	return s, nil
+}
+
+// Discover checks whether any of dirs is the root of a volume which has not been
+// found at its last known location or at a mount point. Discovered volumes are
+// updated in the index.
+func (s *VolumeSet) Discover(ctx context.Context, idx Index, dirs ...string) error {
+	if s == nil {
+		return nil
+	}
+	for _, dir := range dirs {
+		for _, v := range s.volumes {
+			if s.online[v.Name] || !hasVolumeID(dir, v.ID) {
+				continue
+			}
+			v.Root = dir
+			if err := idx.StoreVolume(ctx, v); err != nil {
+				return err
+			}
+			s.online[v.Name] = true
+		}
+	}
+	return nil
+}
+
+// Volumes returns all volumes, online and offline.
+func (s *VolumeSet) Volumes() []*Volume {
+	if s == nil {
+		return nil
+	}
+	return s.volumes
+}
+
+// Online reports whether the named volume is currently mounted.
+func (s *VolumeSet) Online(volume string) bool {
+	return s != nil && s.online[volume]
+}
+
+// Name returns the blob name of a clean, absolute file system path.
+func (s *VolumeSet) Name(path string) string {
+	if s == nil {
+		return path
+	}
+	for _, v := range s.byRoot {
+		if s.online[v.Name] && fs.IsUnder(path, v.Root) {
+			rel, err := filepath.Rel(v.Root, path)
+			if err == nil {
+				return VolumePath(v.Name, rel)
+			}
+		}
+	}
+	return path
+}
+
+// Path returns the current file system path of a blob name.
+// false is returned if the name belongs to a volume which is not mounted.
+func (s *VolumeSet) Path(name string) (string, bool) {
+	volume, rel, ok := SplitVolumePath(name)
+	if !ok {
+		return name, true
+	}
+	if s == nil {
+		return "", false
+	}
+	for _, v := range s.volumes {
+		if v.Name == volume {
+			if !s.online[volume] {
+				return "", false
+			}
+			return filepath.Join(v.Root, filepath.FromSlash(rel)), true
+		}
+	}
+	return "", false
+}
+
+// RegisterVolume stores a new volume or updates the root of an existing volume with
+// the same name and id. Blobs which have been indexed below the root of the volume
+// under their absolute path are renamed to be relative to the volume.
+// The number of renamed blobs is returned.
+func RegisterVolume(ctx context.Context, idx Index, v *Volume) (int, error) {
+	if err := v.Validate(); err != nil {
+		return 0, err
+	}
+	existing, err := idx.Volumes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range existing {
+		if e.Name == v.Name && e.ID != v.ID {
+			return 0, fmt.Errorf("volume %q already exists with a different id", v.Name)
+		}
+		if e.Name != v.Name && e.ID == v.ID {
+			return 0, fmt.Errorf("volume %q has already been registered as %q", v.Root, e.Name)
+		}
+	}
+	if err := idx.StoreVolume(ctx, v); err != nil {
+		return 0, err
+	}
+
+	names, err := NamesUnder(ctx, idx, Names{v.Root})
+	if err != nil {
+		return 0, err
+	}
+	var renamed Names
+	for _, name := range names {
+		if err = renameToVolume(ctx, idx, v, name); err != nil {
+			break
+		}
+		renamed = append(renamed, name)
+	}
+	// blobs which have already been stored under their new name are removed in any case
+	if rmErr := idx.Remove(ctx, renamed); err == nil {
+		err = rmErr
+	}
+	return len(renamed), err
+}
+
+func renameToVolume(ctx context.Context, idx Index, v *Volume, name string) error {
+	blob, err := idx.LookupByName(ctx, name)
+	if err != nil || blob == nil {
+		return err
+	}
+	rel, err := filepath.Rel(v.Root, name)
+	if err != nil {
+		return err
+	}
+	moved := *blob
+	moved.Name = VolumePath(v.Name, rel)
+	moved.Version = 0
+	// the blob has already been renamed by a registration which failed before it was removed
+	existing, err := idx.LookupByName(ctx, moved.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		moved.Version = existing.Version + 1
+	}
+	return idx.Store(ctx, &moved)
+}
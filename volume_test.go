@@ -0,0 +1,131 @@
+package blkidx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumePath(t *testing.T) {
+	for _, tc := range []struct {
+		volume, rel, name, slashRel string
+	}{
+		{"usb", ".", "vol:usb", ""},
+		{"usb", "a", "vol:usb/a", "a"},
+		{"usb", filepath.Join("a", "b"), "vol:usb/a/b", "a/b"},
+	} {
+		name := VolumePath(tc.volume, tc.rel)
+		if name != tc.name {
+			t.Errorf("want %q; got %q", tc.name, name)
+		}
+		volume, rel, ok := SplitVolumePath(name)
+		if !ok || volume != tc.volume || rel != tc.slashRel {
+			t.Errorf("split %q - got (%q, %q, %v)", name, volume, rel, ok)
+		}
+	}
+	if _, _, ok := SplitVolumePath("/vol:usb/a"); ok {
+		t.Error("absolute path split as volume path")
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	root := filepath.Join(base, "usb-a")
+	idx := NewMemoryIndex()
+	file := writeIndexed(t, idx, filepath.Join(root, "photos", "p1"), "p1")
+	other := writeIndexed(t, idx, filepath.Join(base, "usb-ab", "p1"), "p1")
+
+	v, err := NewVolume("usb-a", root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := RegisterVolume(ctx, idx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed != 1 {
+		t.Errorf("want 1 renamed blob; got %d", renamed)
+	}
+	const name = "vol:usb-a/photos/p1"
+	if blob, _ := idx.LookupByName(ctx, name); blob == nil || blob.Name != name {
+		t.Errorf("blob not renamed to %q: %+v", name, blob)
+	}
+	if blob, _ := idx.LookupByName(ctx, other); blob == nil {
+		t.Errorf("blob outside of the volume renamed: %q", other)
+	}
+
+	vols, err := LoadVolumes(ctx, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vols.Online("usb-a") {
+		t.Fatal("volume at its registered root is offline")
+	}
+	if got := vols.Name(file); got != name {
+		t.Errorf("want %q; got %q", name, got)
+	}
+	if got, online := vols.Path(name); !online || got != file {
+		t.Errorf("want (%q, true); got (%q, %v)", file, got, online)
+	}
+
+	// remount the volume elsewhere
+	moved := filepath.Join(base, "media", "usb")
+	os.MkdirAll(filepath.Dir(moved), 0755)
+	if err := os.Rename(root, moved); err != nil {
+		t.Fatal(err)
+	}
+	vols, err = LoadVolumes(ctx, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vols.Online("usb-a") {
+		t.Fatal("moved volume is online")
+	}
+	if _, online := vols.Path(name); online {
+		t.Error("name of an offline volume resolved")
+	}
+	if err := vols.Discover(ctx, idx, moved); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(moved, "photos", "p1")
+	if got, online := vols.Path(name); !online || got != want {
+		t.Errorf("want (%q, true); got (%q, %v)", want, got, online)
+	}
+	if vs, _ := idx.Volumes(ctx); len(vs) != 1 || vs[0].Root != moved {
+		t.Errorf("volume root not updated: %+v", vs)
+	}
+}
+
+func TestRegisterVolumeResumed(t *testing.T) {
+	ctx := context.Background()
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "usb")
+			file := writeIndexed(t, idx, filepath.Join(root, "p1"), "p1")
+			v, err := NewVolume("usb", root, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a registration which failed after the blob was stored under its new name
+			blob, _ := idx.LookupByName(ctx, file)
+			renamed := *blob
+			renamed.Name = "vol:usb/p1"
+			if err := idx.Store(ctx, &renamed); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := RegisterVolume(ctx, idx, v)
+			if err != nil || n != 1 {
+				t.Fatalf("want 1 renamed blob; got %d, %v", n, err)
+			}
+			if blob, _ := idx.LookupByName(ctx, "vol:usb/p1"); blob == nil {
+				t.Error("renamed blob not found")
+			}
+			if blob, _ := idx.LookupByName(ctx, file); blob != nil {
+				t.Errorf("blob %q not removed", file)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package web
+
+import (
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/phicode/blkidx"
+)
+
+type fileJSON struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"` // empty if the volume of the name is offline
+}
+
+type blobJSON struct {
+	fileJSON
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mod_time"`
+	IndexTime     time.Time `json:"index_time"`
+	Hash          string    `json:"hash"`
+	HashAlgorithm string    `json:"algorithm"`
+	HashBlockSize int       `json:"block_size"`
+}
+
+// the names of a group of duplicates, sorted
+type groupJSON struct {
+	Size   int64       `json:"size"`
+	Wasted int64       `json:"wasted"`
+	Files  []*fileJSON `json:"files"`
+}
+
+type dupsJSON struct {
+	// the number of groups and the bytes wasted by all of them, regardless of offset and limit
+	Total  int          `json:"total"`
+	Wasted int64        `json:"wasted"`
+	Groups []*groupJSON `json:"groups"`
+}
+
+type countJSON struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+type sizeBucketJSON struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max,omitempty"`
+	countJSON
+}
+
+type extensionJSON struct {
+	Extension string `json:"extension"`
+	countJSON
+}
+
+type dirJSON struct {
+	Dir string `json:"dir"`
+	countJSON
+}
+
+type statsJSON struct {
+	Total          countJSON         `json:"total"`
+	Duplicates     countJSON         `json:"duplicates"`
+	RedundantBytes int64             `json:"redundant_bytes"`
+	Sizes          []*sizeBucketJSON `json:"sizes"`
+	Extensions     []*extensionJSON  `json:"extensions"`
+	Groups         []*groupJSON      `json:"groups"`
+	Dirs           []*dirJSON        `json:"dirs"`
+}
+
+type resultJSON struct {
+	New         int      `json:"new"`
+	Updated     int      `json:"updated"`
+	Unchanged   int      `json:"unchanged"`
+	Failed      int      `json:"failed"`
+	Unstable    int      `json:"unstable"`
+	BytesHashed int64    `json:"bytes_hashed"`
+	Duration    string   `json:"duration"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+func (s *Server) fileJSON(name string) *fileJSON {
+	f := &fileJSON{Name: name}
+	if s.Volumes != nil {
+		f.Path, _ = s.Volumes.Path(name)
+	}
+	return f
+}
+
+func (s *Server) blobJSON(blob *blkidx.Blob) *blobJSON {
+	return &blobJSON{
+		fileJSON:      *s.fileJSON(blob.Name),
+		Size:          blob.Size,
+		ModTime:       blob.ModTime,
+		IndexTime:     blob.IndexTime,
+		Hash:          hex.EncodeToString(blob.Hash),
+		HashAlgorithm: blob.HashAlgorithm.String(),
+		HashBlockSize: blob.HashBlockSize,
+	}
+}
+
+func (s *Server) blobsJSON(blobs []*blkidx.Blob) []*blobJSON {
+	r := make([]*blobJSON, 0, len(blobs))
+	for _, blob := range blobs {
+		r = append(r, s.blobJSON(blob))
+	}
+	return r
+}
+
+func (s *Server) groupJSON(equal blkidx.EqualBlobs) *groupJSON {
+	names := append(blkidx.Names(nil), equal.Names...)
+	sort.Strings(names)
+	g := &groupJSON{Size: equal.Size, Wasted: wasted(equal)}
+	for _, name := range names {
+		g.Files = append(g.Files, s.fileJSON(name))
+	}
+	return g
+}
+
+func newCountJSON(c blkidx.StatsCount) countJSON {
+	return countJSON{Files: c.Files, Bytes: c.Bytes}
+}
+
+func (s *Server) statsJSON(stats *blkidx.Stats) *statsJSON {
+	r := &statsJSON{
+		Total:          newCountJSON(stats.Total),
+		Duplicates:     newCountJSON(stats.Duplicates),
+		RedundantBytes: stats.RedundantBytes,
+		Sizes:          []*sizeBucketJSON{},
+		Extensions:     []*extensionJSON{},
+		Groups:         []*groupJSON{},
+		Dirs:           []*dirJSON{},
+	}
+	for _, b := range stats.Sizes {
+		r.Sizes = append(r.Sizes, &sizeBucketJSON{Min: b.Min, Max: b.Max, countJSON: newCountJSON(b.StatsCount)})
+	}
+	for _, e := range stats.Extensions {
+		r.Extensions = append(r.Extensions, &extensionJSON{Extension: e.Extension, countJSON: newCountJSON(e.StatsCount)})
+	}
+	for _, equal := range stats.Groups {
+		r.Groups = append(r.Groups, s.groupJSON(equal))
+	}
+	for _, d := range stats.Dirs {
+		r.Dirs = append(r.Dirs, &dirJSON{Dir: d.Dir, countJSON: newCountJSON(d.StatsCount)})
+	}
+	return r
+}
+
+func newResultJSON(result *blkidx.IndexResult) *resultJSON {
+	r := &resultJSON{
+		New:         result.New,
+		Updated:     result.Updated,
+		Unchanged:   result.Unchanged,
+		Failed:      result.Failed,
+		Unstable:    result.Unstable,
+		BytesHashed: result.BytesHashed,
+		Duration:    result.Duration.String(),
+	}
+	for _, err := range result.Errors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	return r
+}
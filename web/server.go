@@ -0,0 +1,377 @@
+// Package web serves an index over HTTP: a JSON API for lookups, queries, duplicates,
+// statistics and index runs, and a small web ui to browse duplicates.
+package web
+
+import (
+	"context"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phicode/blkidx"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+const (
+	// the number of blobs and duplicate groups returned if no limit is given
+	defaultLimit = 1000
+
+	// the longest accepted request body
+	maxBodySize = 1 << 20
+)
+
+// Server serves the API and the web ui. All fields must be set before the first request.
+type Server struct {
+	Index blkidx.Index
+
+	// maps blob names to file system paths, may be nil. it must not be modified while serving.
+	Volumes *blkidx.VolumeSet
+
+	// IndexPaths indexes the files below the paths. index runs are rejected if it is nil.
+	IndexPaths func(ctx context.Context, paths []string) (*blkidx.IndexResult, error)
+
+	// the context of index runs, defaults to context.Background()
+	Context context.Context
+
+	Log *slog.Logger
+
+	once sync.Once
+	mux  *http.ServeMux
+
+	mu  sync.Mutex
+	run *indexRun // the current or last index run
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.once.Do(s.init)
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) init() {
+	if s.Context == nil {
+		s.Context = context.Background()
+	}
+	if s.Log == nil {
+		s.Log = slog.Default()
+	}
+	ui, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	m := http.NewServeMux()
+	m.Handle("/api/blobs", methods{http.MethodGet: s.blobs})
+	m.Handle("/api/query", methods{http.MethodGet: s.query})
+	m.Handle("/api/dups", methods{http.MethodGet: s.dups})
+	m.Handle("/api/stats", methods{http.MethodGet: s.stats})
+	m.Handle("/api/index", methods{http.MethodGet: s.indexStatus, http.MethodPost: s.startIndex})
+	m.Handle("/api/", http.NotFoundHandler())
+	m.Handle("/", methods{http.MethodGet: http.FileServerFS(ui).ServeHTTP})
+	s.mux = m
+}
+
+// methods dispatches requests by their method. GET handlers also serve HEAD requests.
+type methods map[string]http.HandlerFunc
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if h := m[method]; h != nil {
+		h(w, r)
+		return
+	}
+	var allowed []string
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+// GET /api/blobs?name=<name> returns the blob of a name,
+// GET /api/blobs?hash=<hex> all blobs with the hash of the full content.
+func (s *Server) blobs(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	switch {
+	case v.Has("name"):
+		blob, err := s.Index.LookupByName(r.Context(), v.Get("name"))
+		if err != nil {
+			s.internalError(w, err)
+		} else if blob == nil {
+			writeError(w, http.StatusNotFound, errors.New("no such blob"))
+		} else {
+			writeJSON(w, http.StatusOK, s.blobJSON(blob))
+		}
+	case v.Has("hash"):
+		hash, err := hex.DecodeString(v.Get("hash"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid hash"))
+			return
+		}
+		blobs, err := s.Index.LookupByHash(r.Context(), hash)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.blobsJSON(blobs))
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("name or hash required"))
+	}
+}
+
+// GET /api/query returns the blobs selected by the parameters, see parseQuery.
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	blobs, err := s.Index.Query(r.Context(), q)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.blobsJSON(blobs))
+}
+
+// GET /api/dups?under=<name>&offset=<n>&limit=<n> returns the groups of duplicates with at least
+// one name below any of the names of under, the groups which waste the most space first.
+func (s *Server) dups(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	offset, limit, err := parsePage(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var resp dupsJSON
+	var groups []blkidx.EqualBlobs
+	err = s.Index.ForEachEqualHashes(r.Context(), blkidx.Names(v["under"]), func(equal blkidx.EqualBlobs) error {
+		groups = append(groups, equal)
+		resp.Wasted += wasted(equal)
+		return nil
+	})
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		wi, wj := wasted(groups[i]), wasted(groups[j])
+		return wi > wj || (wi == wj && groups[i].Names[0] < groups[j].Names[0])
+	})
+	resp.Total = len(groups)
+	resp.Groups = []*groupJSON{}
+	offset = min(offset, len(groups))
+	for _, equal := range groups[offset : offset+min(limit, len(groups)-offset)] {
+		resp.Groups = append(resp.Groups, s.groupJSON(equal))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET /api/stats?under=<name>&top=<n> returns the aggregates of Index.Stats.
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	top := 10
+	if v.Has("top") {
+		var err error
+		if top, err = strconv.Atoi(v.Get("top")); err != nil || top < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid top"))
+			return
+		}
+	}
+	stats, err := s.Index.Stats(r.Context(), blkidx.Names(v["under"]), top)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.statsJSON(stats))
+}
+
+type indexRun struct {
+	Paths    []string    `json:"paths"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Result   *resultJSON `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type indexStatusJSON struct {
+	Enabled bool      `json:"enabled"`
+	Running bool      `json:"running"`
+	Run     *indexRun `json:"run"`
+}
+
+// GET /api/index returns the state of the current or last index run.
+func (s *Server) indexStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := indexStatusJSON{Enabled: s.IndexPaths != nil}
+	if s.run != nil {
+		run := *s.run
+		status.Run, status.Running = &run, run.Finished == nil
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// POST /api/index with the body {"paths": ["/path", ...]} starts an index run
+// unless one is already running.
+func (s *Server) startIndex(w http.ResponseWriter, r *http.Request) {
+	if s.IndexPaths == nil {
+		writeError(w, http.StatusForbidden, errors.New("index runs are disabled"))
+		return
+	}
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Paths) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no paths given"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil && s.run.Finished == nil {
+		writeError(w, http.StatusConflict, errors.New("an index run is in progress"))
+		return
+	}
+	run := &indexRun{Paths: req.Paths, Started: time.Now()}
+	s.run = run
+	go s.index(run)
+	writeJSON(w, http.StatusAccepted, indexStatusJSON{Enabled: true, Running: true, Run: run})
+}
+
+func (s *Server) index(run *indexRun) {
+	s.Log.Info("index run started", "paths", run.Paths)
+	result, err := s.IndexPaths(s.Context, run.Paths)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	run.Finished = &now
+	if result != nil {
+		run.Result = newResultJSON(result)
+	}
+	if err != nil {
+		run.Error = err.Error()
+		s.Log.Error("index run failed", "paths", run.Paths, "err", err)
+	} else {
+		s.Log.Info("index run finished", "paths", run.Paths, "duration", now.Sub(run.Started))
+	}
+}
+
+// parseQuery parses the parameters of a query: under (repeated), glob, min_size, max_size,
+// modified_since, modified_before, indexed_since, indexed_before (RFC 3339), hash (a hex prefix),
+// algorithm, block_size, sort (name, size, mtime or itime), desc and limit.
+func parseQuery(v url.Values) (*blkidx.Query, error) {
+	q := &blkidx.Query{
+		Under:      blkidx.Names(v["under"]),
+		Glob:       v.Get("glob"),
+		HashPrefix: v.Get("hash"),
+		Limit:      defaultLimit,
+	}
+	var err error
+	for _, p := range []struct {
+		name string
+		n    *int64
+	}{{"min_size", &q.MinSize}, {"max_size", &q.MaxSize}} {
+		if v.Has(p.name) {
+			if *p.n, err = strconv.ParseInt(v.Get(p.name), 10, 64); err != nil || *p.n < 0 {
+				return nil, errors.New("invalid " + p.name)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"modified_since", &q.ModifiedSince}, {"modified_before", &q.ModifiedBefore},
+		{"indexed_since", &q.IndexedSince}, {"indexed_before", &q.IndexedBefore},
+	} {
+		if v.Has(p.name) {
+			if *p.t, err = time.Parse(time.RFC3339, v.Get(p.name)); err != nil {
+				return nil, errors.New("invalid " + p.name + ", must be RFC 3339")
+			}
+		}
+	}
+	if v.Has("algorithm") {
+		if q.HashAlgorithm, err = blkidx.ParseHashAlgorithm(v.Get("algorithm")); err != nil {
+			return nil, err
+		}
+	}
+	if v.Has("block_size") {
+		if q.HashBlockSize, err = strconv.Atoi(v.Get("block_size")); err != nil || q.HashBlockSize < 0 {
+			return nil, errors.New("invalid block_size")
+		}
+	}
+	if v.Has("sort") {
+		if q.Order, err = blkidx.ParseQueryOrder(v.Get("sort")); err != nil {
+			return nil, err
+		}
+	}
+	if v.Has("desc") {
+		if q.Descending, err = strconv.ParseBool(v.Get("desc")); err != nil {
+			return nil, errors.New("invalid desc")
+		}
+	}
+	if v.Has("limit") {
+		if q.Limit, err = strconv.Atoi(v.Get("limit")); err != nil || q.Limit < 0 {
+			return nil, errors.New("invalid limit")
+		}
+	}
+	return q, q.Validate()
+}
+
+// parsePage parses the offset and limit parameters.
+func parsePage(v url.Values) (offset, limit int, err error) {
+	limit = defaultLimit
+	if v.Has("offset") {
+		if offset, err = strconv.Atoi(v.Get("offset")); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	if v.Has("limit") {
+		if limit, err = strconv.Atoi(v.Get("limit")); err != nil || limit < 0 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	return offset, limit, nil
+}
+
+func wasted(equal blkidx.EqualBlobs) int64 {
+	return equal.Size * int64(len(equal.Names)-1)
+}
+
+func (s *Server) internalError(w http.ResponseWriter, err error) {
+	s.Log.Error("request failed", "err", err)
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,210 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phicode/blkidx"
+)
+
+func testServer(t *testing.T, indexPaths func(context.Context, []string) (*blkidx.IndexResult, error)) *httptest.Server {
+	idx := blkidx.NewMemoryIndex()
+	store := func(name, content string) {
+		blob := &blkidx.Blob{
+			Name:          name,
+			IndexTime:     time.Now().UTC(),
+			ModTime:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			HashAlgorithm: blkidx.DefaultHashAlgorithm,
+			HashBlockSize: 4,
+		}
+		var err error
+		blob.Hash, blob.HashedBlocks, blob.Size, err = blkidx.HashAll(context.Background(),
+			strings.NewReader(content), blob.HashAlgorithm, blob.HashBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = idx.Store(context.Background(), blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("/a/small", "abc")
+	store("/b/small", "abc")
+	store("/a/large", "0123456789")
+	store("/b/large", "0123456789")
+	store("/c/large", "0123456789")
+	store("/c/unique.txt", "unique")
+
+	ts := httptest.NewServer(&Server{
+		Index:      idx,
+		IndexPaths: indexPaths,
+		Log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, url string, wantCode int, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, resp, wantCode, v)
+}
+
+func decode(t *testing.T, resp *http.Response, wantCode int, v interface{}) {
+	defer resp.Body.Close()
+	if resp.StatusCode != wantCode {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s: want status %d; got %d: %s", resp.Request.URL, wantCode, resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	ts := testServer(t, nil)
+
+	var blob blobJSON
+	get(t, ts.URL+"/api/blobs?name=/c/unique.txt", http.StatusOK, &blob)
+	if blob.Name != "/c/unique.txt" || blob.Size != 6 || blob.HashBlockSize != 4 {
+		t.Errorf("blob - got %+v", blob)
+	}
+
+	var blobs []blobJSON
+	get(t, ts.URL+"/api/blobs?hash="+blob.Hash, http.StatusOK, &blobs)
+	if len(blobs) != 1 || blobs[0].Name != blob.Name {
+		t.Errorf("by hash - got %+v", blobs)
+	}
+
+	var e struct{ Error string }
+	get(t, ts.URL+"/api/blobs?name=/missing", http.StatusNotFound, &e)
+	get(t, ts.URL+"/api/blobs?hash=xyz", http.StatusBadRequest, &e)
+	get(t, ts.URL+"/api/blobs", http.StatusBadRequest, &e)
+	if e.Error == "" {
+		t.Error("want an error message")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ts := testServer(t, nil)
+
+	var blobs []blobJSON
+	get(t, ts.URL+"/api/query?under=/a&under=/c&min_size=5&sort=name&desc=true", http.StatusOK, &blobs)
+	var names []string
+	for _, b := range blobs {
+		names = append(names, b.Name)
+	}
+	if got, want := strings.Join(names, " "), "/c/unique.txt /c/large /a/large"; got != want {
+		t.Errorf("want %q; got %q", want, got)
+	}
+
+	var e struct{ Error string }
+	for _, q := range []string{"min_size=x", "sort=color", "modified_since=yesterday", "limit=-1", "algorithm=rot13"} {
+		get(t, ts.URL+"/api/query?"+q, http.StatusBadRequest, &e)
+	}
+}
+
+func TestDups(t *testing.T) {
+	ts := testServer(t, nil)
+
+	var dups dupsJSON
+	get(t, ts.URL+"/api/dups", http.StatusOK, &dups)
+	if dups.Total != 2 || dups.Wasted != 2*10+3 || len(dups.Groups) != 2 {
+		t.Fatalf("dups - got %+v", dups)
+	}
+	if g := dups.Groups[0]; g.Size != 10 || g.Wasted != 20 || len(g.Files) != 3 || g.Files[0].Name != "/a/large" {
+		t.Errorf("largest group first - got %+v", g)
+	}
+
+	get(t, ts.URL+"/api/dups?offset=1&limit=5", http.StatusOK, &dups)
+	if dups.Total != 2 || len(dups.Groups) != 1 || dups.Groups[0].Size != 3 {
+		t.Errorf("second page - got %+v", dups)
+	}
+
+	get(t, ts.URL+"/api/dups?offset=9223372036854775807&limit=5", http.StatusOK, &dups)
+	if dups.Total != 2 || len(dups.Groups) != 0 {
+		t.Errorf("offset beyond the last group - got %+v", dups)
+	}
+
+	get(t, ts.URL+"/api/dups?under=/c", http.StatusOK, &dups)
+	if dups.Total != 1 || dups.Groups[0].Size != 10 {
+		t.Errorf("under /c - got %+v", dups)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ts := testServer(t, nil)
+
+	var stats statsJSON
+	get(t, ts.URL+"/api/stats?top=1", http.StatusOK, &stats)
+	if stats.Total.Files != 6 || stats.Total.Bytes != 42 || stats.RedundantBytes != 23 {
+		t.Errorf("stats - got %+v", stats)
+	}
+	if len(stats.Groups) != 1 || stats.Groups[0].Size != 10 {
+		t.Errorf("top groups - got %+v", stats.Groups)
+	}
+}
+
+func TestIndexRuns(t *testing.T) {
+	post := func(ts *httptest.Server, body string, wantCode int, v interface{}) {
+		resp, err := http.Post(ts.URL+"/api/index", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decode(t, resp, wantCode, v)
+	}
+
+	var e struct{ Error string }
+	post(testServer(t, nil), `{"paths": ["/a"]}`, http.StatusForbidden, &e)
+
+	release := make(chan struct{})
+	ts := testServer(t, func(ctx context.Context, paths []string) (*blkidx.IndexResult, error) {
+		<-release
+		return &blkidx.IndexResult{New: len(paths)}, errors.New("partial failure")
+	})
+	post(ts, `{"paths": []}`, http.StatusBadRequest, &e)
+
+	var status indexStatusJSON
+	post(ts, `{"paths": ["/a", "/b"]}`, http.StatusAccepted, &status)
+	if !status.Running || len(status.Run.Paths) != 2 {
+		t.Errorf("started - got %+v", status)
+	}
+	post(ts, `{"paths": ["/c"]}`, http.StatusConflict, &e)
+
+	close(release)
+	for i := 0; ; i++ {
+		get(t, ts.URL+"/api/index", http.StatusOK, &status)
+		if !status.Running {
+			break
+		}
+		if i == 100 {
+			t.Fatal("index run did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Run.Result == nil || status.Run.Result.New != 2 || status.Run.Error != "partial failure" {
+		t.Errorf("finished - got %+v", status.Run)
+	}
+}
+
+func TestUI(t *testing.T) {
+	ts := testServer(t, nil)
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "api/dups") {
+		t.Errorf("want the ui; got %d: %.100s", resp.StatusCode, body)
+	}
+}